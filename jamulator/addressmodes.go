@@ -1,5 +1,9 @@
 package jamulator
 
+import (
+	"strings"
+)
+
 type AddrMode int
 
 const (
@@ -20,6 +24,64 @@ const (
 	addrModeCount
 )
 
+// addressing modes, as seen by users of the package
+type AddressingMode int
+
+const (
+	AbsoluteMode  = AddressingMode(absAddr)
+	AbsoluteXMode = AddressingMode(absXAddr)
+	AbsoluteYMode = AddressingMode(absYAddr)
+	ImmediateMode = AddressingMode(immedAddr)
+	ImpliedMode   = AddressingMode(impliedAddr)
+	IndirectMode  = AddressingMode(indirectAddr)
+	IndirectXMode = AddressingMode(xIndexIndirectAddr)
+	IndirectYMode = AddressingMode(indirectYIndexAddr)
+	RelativeMode  = AddressingMode(relativeAddr)
+	ZeroPageMode  = AddressingMode(zeroPageAddr)
+	ZeroPageXMode = AddressingMode(zeroXIndexAddr)
+	ZeroPageYMode = AddressingMode(zeroYIndexAddr)
+)
+
+var addressingModeNames = map[AddressingMode]string{
+	AbsoluteMode:  "absolute",
+	AbsoluteXMode: "absolute,x",
+	AbsoluteYMode: "absolute,y",
+	ImmediateMode: "immediate",
+	ImpliedMode:   "implied",
+	IndirectMode:  "indirect",
+	IndirectXMode: "(indirect,x)",
+	IndirectYMode: "(indirect),y",
+	RelativeMode:  "relative",
+	ZeroPageMode:  "zeropage",
+	ZeroPageXMode: "zeropage,x",
+	ZeroPageYMode: "zeropage,y",
+}
+
+func (m AddressingMode) String() string {
+	name, ok := addressingModeNames[m]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// instruction size in bytes, including the op code
+var addrModeSize = [addrModeCount]int{
+	nilAddr:            0,
+	absAddr:            3,
+	absXAddr:           3,
+	absYAddr:           3,
+	immedAddr:          2,
+	impliedAddr:        1,
+	indirectAddr:       3,
+	xIndexIndirectAddr: 2,
+	indirectYIndexAddr: 2,
+	relativeAddr:       2,
+	zeroPageAddr:       2,
+	zeroXIndexAddr:     2,
+	zeroYIndexAddr:     2,
+}
+
 type opCodeData struct {
 	opName   string
 	addrMode AddrMode
@@ -27,6 +89,21 @@ type opCodeData struct {
 
 var opNameToOpCode [addrModeCount]map[string]byte
 
+type opCodeInfo struct {
+	opName   string
+	addrMode AddrMode
+	// instruction size in bytes, including the op code
+	size int
+	// undefined op codes are left as data by the disassembler
+	illegal bool
+	// stable, but not part of the documented instruction set
+	undocumented bool
+}
+
+// everything the disassembler needs to know about each op code, built
+// from opCodeDataMap
+var opCodeTable [256]opCodeInfo
+
 var opCodeDataMap = []opCodeData{
 	// 0x00
 	{"brk", impliedAddr},
@@ -317,6 +394,114 @@ var opCodeDataMap = []opCodeData{
 	{"", nilAddr},
 }
 
+type undocumentedOpCode struct {
+	opCodeData
+	cycles int
+}
+
+// the stable undocumented op codes which some games use. they are
+// assembled like any other instruction, but only disassembled and
+// compiled when asked for.
+var undocumentedOpCodes = map[byte]undocumentedOpCode{
+	// load A and X
+	0xa7: {opCodeData{"lax", zeroPageAddr}, 3},
+	0xb7: {opCodeData{"lax", zeroYIndexAddr}, 4},
+	0xaf: {opCodeData{"lax", absAddr}, 4},
+	0xbf: {opCodeData{"lax", absYAddr}, 4},
+	0xa3: {opCodeData{"lax", xIndexIndirectAddr}, 6},
+	0xb3: {opCodeData{"lax", indirectYIndexAddr}, 5},
+	// store A & X
+	0x87: {opCodeData{"sax", zeroPageAddr}, 3},
+	0x97: {opCodeData{"sax", zeroYIndexAddr}, 4},
+	0x8f: {opCodeData{"sax", absAddr}, 4},
+	0x83: {opCodeData{"sax", xIndexIndirectAddr}, 6},
+	// dec then cmp
+	0xc7: {opCodeData{"dcp", zeroPageAddr}, 5},
+	0xd7: {opCodeData{"dcp", zeroXIndexAddr}, 6},
+	0xcf: {opCodeData{"dcp", absAddr}, 6},
+	0xdf: {opCodeData{"dcp", absXAddr}, 7},
+	0xdb: {opCodeData{"dcp", absYAddr}, 7},
+	0xc3: {opCodeData{"dcp", xIndexIndirectAddr}, 8},
+	0xd3: {opCodeData{"dcp", indirectYIndexAddr}, 8},
+	// inc then sbc
+	0xe7: {opCodeData{"isc", zeroPageAddr}, 5},
+	0xf7: {opCodeData{"isc", zeroXIndexAddr}, 6},
+	0xef: {opCodeData{"isc", absAddr}, 6},
+	0xff: {opCodeData{"isc", absXAddr}, 7},
+	0xfb: {opCodeData{"isc", absYAddr}, 7},
+	0xe3: {opCodeData{"isc", xIndexIndirectAddr}, 8},
+	0xf3: {opCodeData{"isc", indirectYIndexAddr}, 8},
+	// nop, which reads its operand and ignores it. the assembler picks
+	// the lowest op code for each mode, and ea for implied.
+	0x1a: {opCodeData{"nop", impliedAddr}, 2},
+	0x3a: {opCodeData{"nop", impliedAddr}, 2},
+	0x5a: {opCodeData{"nop", impliedAddr}, 2},
+	0x7a: {opCodeData{"nop", impliedAddr}, 2},
+	0xda: {opCodeData{"nop", impliedAddr}, 2},
+	0xfa: {opCodeData{"nop", impliedAddr}, 2},
+	0x80: {opCodeData{"nop", immedAddr}, 2},
+	0x82: {opCodeData{"nop", immedAddr}, 2},
+	0x89: {opCodeData{"nop", immedAddr}, 2},
+	0xc2: {opCodeData{"nop", immedAddr}, 2},
+	0xe2: {opCodeData{"nop", immedAddr}, 2},
+	0x04: {opCodeData{"nop", zeroPageAddr}, 3},
+	0x44: {opCodeData{"nop", zeroPageAddr}, 3},
+	0x64: {opCodeData{"nop", zeroPageAddr}, 3},
+	0x14: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0x34: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0x54: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0x74: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0xd4: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0xf4: {opCodeData{"nop", zeroXIndexAddr}, 4},
+	0x0c: {opCodeData{"nop", absAddr}, 4},
+	0x1c: {opCodeData{"nop", absXAddr}, 4},
+	0x3c: {opCodeData{"nop", absXAddr}, 4},
+	0x5c: {opCodeData{"nop", absXAddr}, 4},
+	0x7c: {opCodeData{"nop", absXAddr}, 4},
+	0xdc: {opCodeData{"nop", absXAddr}, 4},
+	0xfc: {opCodeData{"nop", absXAddr}, 4},
+}
+
+// base cycle counts, not including the extra cycles taken when an
+// indexed read crosses a page boundary or a branch is taken.
+// unused op codes are 0.
+var opCodeCycles = [256]int{
+	7, 6, 0, 0, 0, 3, 5, 0, 3, 2, 2, 0, 0, 4, 6, 0, // 0x00
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0x10
+	6, 6, 0, 0, 3, 3, 5, 0, 4, 2, 2, 0, 4, 4, 6, 0, // 0x20
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0x30
+	6, 6, 0, 0, 0, 3, 5, 0, 3, 2, 2, 0, 3, 4, 6, 0, // 0x40
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0x50
+	6, 6, 0, 0, 0, 3, 5, 0, 4, 2, 2, 0, 5, 4, 6, 0, // 0x60
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0x70
+	0, 6, 0, 0, 3, 3, 3, 0, 2, 0, 2, 0, 4, 4, 4, 0, // 0x80
+	2, 6, 0, 0, 4, 4, 4, 0, 2, 5, 2, 0, 0, 5, 0, 0, // 0x90
+	2, 6, 2, 0, 3, 3, 3, 0, 2, 2, 2, 0, 4, 4, 4, 0, // 0xa0
+	2, 5, 0, 0, 4, 4, 4, 0, 2, 4, 2, 0, 4, 4, 4, 0, // 0xb0
+	2, 6, 0, 0, 3, 3, 5, 0, 2, 2, 2, 0, 4, 4, 6, 0, // 0xc0
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0xd0
+	2, 6, 0, 0, 3, 3, 5, 0, 2, 2, 2, 0, 4, 4, 6, 0, // 0xe0
+	2, 5, 0, 0, 0, 4, 6, 0, 2, 4, 0, 0, 0, 4, 7, 0, // 0xf0
+}
+
+// whether the op code can take extra cycles depending on the page
+// boundaries involved: indexed reads, and branches.
+func opCodeMayCrossPage(opCode byte) bool {
+	info := opCodeTable[opCode]
+	switch info.addrMode {
+	case relativeAddr:
+		return true
+	case absXAddr, absYAddr, indirectYIndexAddr:
+		switch info.opName {
+		case "sta", "asl", "lsr", "rol", "ror", "inc", "dec", "dcp", "isc":
+			// stores and read-modify-write always take the extra cycle
+			return false
+		}
+		return true
+	}
+	return false
+}
+
 func init() {
 	for i := 0; i < int(addrModeCount); i++ {
 		opNameToOpCode[i] = make(map[string]byte)
@@ -324,6 +509,87 @@ func init() {
 	for opCode := 0; opCode < 256; opCode++ {
 		info := opCodeDataMap[opCode]
 		opNameToOpCode[info.addrMode][info.opName] = byte(opCode)
+		opCodeTable[opCode] = opCodeInfo{
+			opName:   info.opName,
+			addrMode: info.addrMode,
+			size:     addrModeSize[info.addrMode],
+			illegal:  info.addrMode == nilAddr,
+		}
+	}
+	for opCode, info := range undocumentedOpCodes {
+		opCodeTable[opCode] = opCodeInfo{
+			opName:       info.opName,
+			addrMode:     info.addrMode,
+			size:         addrModeSize[info.addrMode],
+			undocumented: true,
+		}
+		opCodeCycles[opCode] = info.cycles
+	}
+	for opCode, info := range undocumentedOpCodes {
+		existing, ok := opNameToOpCode[info.addrMode][info.opName]
+		if !ok || (opCodeTable[existing].undocumented && opCode < existing) {
+			opNameToOpCode[info.addrMode][info.opName] = opCode
+		}
 	}
 }
 
+// finds the op code for an instruction such as lda in the given mode.
+// size is the length of the whole instruction in bytes.
+func LookupOpcode(mnemonic string, mode AddressingMode) (opcode int, size int, ok bool) {
+	addrMode := AddrMode(mode)
+	if addrMode <= nilAddr || addrMode >= addrModeCount {
+		return 0, 0, false
+	}
+	opCode, ok := opNameToOpCode[addrMode][strings.ToLower(mnemonic)]
+	if !ok || mnemonic == "" {
+		return 0, 0, false
+	}
+	return int(opCode), addrModeSize[addrMode], true
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// the known instruction closest to word, or "" if none are within an
+// edit distance of 2. ties go to the alphabetically first.
+func suggestMnemonic(word string) string {
+	word = strings.ToLower(word)
+	best := ""
+	bestDistance := 3
+	for _, opCodes := range opNameToOpCode {
+		for opName := range opCodes {
+			if opName == "" {
+				continue
+			}
+			d := editDistance(word, opName)
+			if d < bestDistance || (d == bestDistance && opName < best) {
+				best = opName
+				bestDistance = d
+			}
+		}
+	}
+	return best
+}
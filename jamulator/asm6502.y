@@ -10,6 +10,10 @@ import (
 type AssignStatement struct {
 	VarName string
 	Value int
+	Line int
+	// value expression which could not be folded at parse time. it may
+	// refer to other variables, including later ones, and to labels.
+	Expr interface{}
 }
 
 type LabelStatement struct {
@@ -26,6 +30,81 @@ type OrgPseudoOp struct {
 	Value int
 	Fill byte
 	Line int
+	// no fill was given, so .fillvalue's applies
+	DefaultFill bool
+}
+
+// sets the fill byte of the org, align and reserve statements after it
+// which don't give their own. removed by Resolve.
+type FillValueStatement struct {
+	Value byte
+	Line int
+}
+
+// replaced by the contents of the file after parsing
+type IncludeStatement struct {
+	Filename string
+	Line int
+}
+
+// starts a macro definition. the statements up to the matching
+// EndMacroStatement are its body, which is expanded after parsing.
+type MacroStatement struct {
+	Name string
+	Params []string
+	Line int
+}
+
+type EndMacroStatement struct {
+	Line int
+}
+
+// a macro invocation with arguments. one without arguments parses as a
+// LabelStatement.
+type MacroCall struct {
+	Name string
+	Args *list.List
+	Line int
+}
+
+// conditional assembly. the statements up to the matching ElseStatement
+// or EndIfStatement are only assembled if Cond is nonzero.
+type IfStatement struct {
+	Cond interface{}
+	Line int
+}
+
+type ElseStatement struct {
+	Line int
+}
+
+type EndIfStatement struct {
+	Line int
+}
+
+// reserves Size bytes, such as for a buffer. they are Fill in the
+// assembled image.
+type ReserveStatement struct {
+	Size int
+	Fill byte
+	Line int
+	DefaultFill bool
+
+	// filled in later
+	Offset int
+	Payload []byte
+}
+
+// pads with Fill up to the next multiple of Value
+type AlignStatement struct {
+	Value int
+	Fill byte
+	Line int
+	DefaultFill bool
+
+	// filled in later
+	Offset int
+	Payload []byte
 }
 
 type InstructionType int
@@ -39,6 +118,8 @@ const (
 	IndirectXInstruction
 	IndirectYInstruction
 	IndirectInstruction
+	// asl a, which only asl, lsr, rol and ror have
+	AccumulatorInstruction
 )
 
 type Instruction struct {
@@ -50,9 +131,15 @@ type Instruction struct {
 	Value int
 	LabelName string
 	RegisterName string
+	// operand expression which could not be folded at parse time
+	Expr interface{}
+	// written with a: or ! before the operand, for the absolute mode
+	// even when the address is in the zero page
+	ForceAbsolute bool
 
 	// filled in later
 	OpCode byte
+	AddressingMode AddressingMode
 	Offset int
 	Payload []byte
 }
@@ -67,6 +154,8 @@ type DataStatement struct {
 	Type DataStmtType
 	dataList *list.List
 	Line int
+	// word data for something other than the 6502, high byte first
+	BigEndian bool
 
 	// filled in later
 	Offset int
@@ -79,8 +168,97 @@ type StringDataItem string
 type LabelCall struct {
 	LabelName string
 }
+
+// the number of bytes from a label to the next label
+type SizeofExpr struct {
+	LabelName string
+}
+
+// .lobyte(Expr) or .hibyte(Expr)
+type ByteExpr struct {
+	High bool
+	Expr interface{}
+}
+
+type ExprOperator int
+const (
+	AddOperator ExprOperator = iota
+	SubOperator
+	MulOperator
+	DivOperator
+)
+
+type BinaryExpr struct {
+	Op ExprOperator
+	Left interface{}
+	Right interface{}
+}
+
+// folds the expression if both sides are integers
+func newBinaryExpr(op ExprOperator, left interface{}, right interface{}) interface{} {
+	l, lok := left.(*IntegerDataItem)
+	r, rok := right.(*IntegerDataItem)
+	if lok && rok && (op != DivOperator || *r != 0) {
+		tmp := IntegerDataItem(op.apply(int(*l), int(*r)))
+		return &tmp
+	}
+	return &BinaryExpr{op, left, right}
+}
+
+// folds the expression if its operand is an integer
+func newByteExpr(high bool, expr interface{}) interface{} {
+	b := &ByteExpr{high, expr}
+	value, ok := expr.(*IntegerDataItem)
+	if ok {
+		tmp := IntegerDataItem(b.apply(int(*value)))
+		return &tmp
+	}
+	return b
+}
+
+// fills in Value if the operand folded to an integer, otherwise Expr
+func (i *Instruction) setValueOperand(expr interface{}) {
+	switch t := expr.(type) {
+	case *IntegerDataItem:
+		i.Value = int(*t)
+	default:
+		i.Expr = expr
+	}
+}
+
+// like setValueOperand except that a lone label goes into LabelName
+func (i *Instruction) setOperand(expr interface{}) {
+	call, ok := expr.(*LabelCall)
+	if ok {
+		i.LabelName = call.LabelName
+		return
+	}
+	i.setValueOperand(expr)
+}
+
+func newAssignStatement(name string, expr interface{}) *AssignStatement {
+	s := &AssignStatement{VarName: name, Line: parseLineNumber}
+	value, ok := expr.(*IntegerDataItem)
+	if ok {
+		s.Value = int(*value)
+	} else {
+		s.Expr = expr
+	}
+	return s
+}
+
+func newAlignStatement(yylex yyLexer, value int, fill byte) *AlignStatement {
+	if value <= 0 || value&(value-1) != 0 {
+		yylex.Error("ALIGN directive value must be a power of two.")
+	}
+	return &AlignStatement{Value: value, Fill: fill, Line: parseLineNumber}
+}
+
 type ProgramAst struct {
 	List *list.List
+	// the file which each statement from an included file came from, so
+	// that errors about it can name the file
+	Files map[interface{}]string
 }
 
 var programAst ProgramAst
@@ -92,7 +270,10 @@ var programAst ProgramAst
 	list *list.List
 	assignStatement *AssignStatement
 	orgPsuedoOp *OrgPseudoOp
+	alignStatement *AlignStatement
+	reserveStatement *ReserveStatement
 	node interface{}
+	strs []string
 }
 
 %type <list> statementList
@@ -106,9 +287,20 @@ var programAst ProgramAst
 %type <str> processorDecl
 %type <str> labelName
 %type <orgPsuedoOp> orgPsuedoOp
+%type <alignStatement> alignStatement
+%type <reserveStatement> reserveStatement
+%type <node> fillValueStatement
 %type <node> subroutineDecl
-%type <node> numberExpr
+%type <node> macroStatement
+%type <node> conditionalStatement
+%type <strs> macroParams
 %type <node> numberExprOptionalPound
+%type <node> expr
+%type <node> term
+%type <node> factor
+%type <node> atom
+%type <node> directExpr
+%type <node> directTerm
 
 %token <str> tokIdentifier
 %token <str> tokRegister
@@ -116,27 +308,47 @@ var programAst ProgramAst
 %token <str> tokQuotedString
 %token <str> tokInstruction
 %token tokEqual
+%token tokEqu
 %token tokPound
+%token tokForceAbsolute
 %token tokDot
 %token tokComma
-%token tokNewline
+%token <integer> tokNewline
 %token tokData
 %token tokDataWord
+%token tokDataWordBigEndian
+%token tokHighString
 %token tokProcessor
 %token tokLParen
 %token tokRParen
 %token tokDot
 %token tokColon
 %token tokOrg
+%token tokAlign
+%token tokReserve
+%token tokFillValue
+%token tokInclude
 %token tokSubroutine
+%token tokSizeof
+%token tokLoByte
+%token tokHiByte
+%token tokMacro
+%token tokEndMacro
+%token tokIf
+%token tokElse
+%token tokEndIf
+%token tokPlus
+%token tokMinus
+%token tokStar
+%token tokSlash
 
 %%
 
 programAst : statementList {
-	programAst = ProgramAst{$1}
+	programAst = ProgramAst{$1, map[interface{}]string{}}
 }
 
-statementList : statementList tokNewline statement {
+statementList : statementList newline statement {
 	if $3 == nil {
 		$$ = $1
 	} else {
@@ -152,6 +364,12 @@ statementList : statementList tokNewline statement {
 	}
 }
 
+// the line number is bumped only once the newline is shifted, so that
+// statements reduced with the newline as lookahead get the right line
+newline : tokNewline {
+	parseLineNumber += $1
+}
+
 statement : tokDot tokIdentifier instructionStatement {
 	$$ = &LabeledStatement{
 		&LabelStatement{"." + $2, parseLineNumber},
@@ -164,8 +382,30 @@ statement : tokDot tokIdentifier instructionStatement {
 	}
 } | orgPsuedoOp {
 	$$ = $1
+} | alignStatement {
+	$$ = $1
+} | reserveStatement {
+	$$ = $1
+} | fillValueStatement {
+	$$ = $1
+} | tokIdentifier tokColon reserveStatement {
+	$$ = &LabeledStatement{
+		&LabelStatement{$1, parseLineNumber},
+		$3,
+	}
+} | tokDot tokIdentifier reserveStatement {
+	$$ = &LabeledStatement{
+		&LabelStatement{"." + $2, parseLineNumber},
+		$3,
+	}
+} | tokInclude tokQuotedString {
+	$$ = &IncludeStatement{$2, parseLineNumber}
 } | subroutineDecl {
 	$$ = $1
+} | macroStatement {
+	$$ = $1
+} | conditionalStatement {
+	$$ = $1
 } | instructionStatement {
 	$$ = $1
 } | tokDot tokIdentifier dataStatement {
@@ -209,6 +449,31 @@ dataStatement : tokData dataList {
 		dataList: $2,
 		Line: parseLineNumber,
 	}
+} | tokDataWordBigEndian wordList {
+	$$ = &DataStatement{
+		Type: WordDataStmt,
+		dataList: $2,
+		Line: parseLineNumber,
+		BigEndian: true,
+	}
+} | tokHighString dataList {
+	// text engines which mark characters with bit 7
+	for e := $2.Front(); e != nil; e = e.Next() {
+		s, ok := e.Value.(*StringDataItem)
+		if ok {
+			high := []byte(*s)
+			for i := range high {
+				high[i] |= 0x80
+			}
+			tmp := StringDataItem(high)
+			e.Value = &tmp
+		}
+	}
+	$$ = &DataStatement{
+		Type: ByteDataStmt,
+		dataList: $2,
+		Line: parseLineNumber,
+	}
 }
 
 processorDecl : tokProcessor tokInteger {
@@ -233,18 +498,63 @@ dataList : dataList tokComma dataItem {
 	$$.PushBack($1)
 }
 
-numberExpr : tokPound tokInteger {
-	tmp := IntegerDataItem($2)
+numberExprOptionalPound : tokPound expr {
+	$$ = $2
+} | expr {
+	$$ = $1
+}
+
+expr : expr tokPlus term {
+	$$ = newBinaryExpr(AddOperator, $1, $3)
+} | expr tokMinus term {
+	$$ = newBinaryExpr(SubOperator, $1, $3)
+} | term {
+	$$ = $1
+}
+
+term : term tokStar factor {
+	$$ = newBinaryExpr(MulOperator, $1, $3)
+} | term tokSlash factor {
+	$$ = newBinaryExpr(DivOperator, $1, $3)
+} | factor {
+	$$ = $1
+}
+
+factor : atom {
+	$$ = $1
+} | tokLParen expr tokRParen {
+	$$ = $2
+}
+
+atom : tokInteger {
+	tmp := IntegerDataItem($1)
 	$$ = &tmp
 } | labelName {
 	$$ = &LabelCall{$1}
+} | tokSizeof tokLParen labelName tokRParen {
+	$$ = &SizeofExpr{$3}
+} | tokLoByte tokLParen expr tokRParen {
+	$$ = newByteExpr(false, $3)
+} | tokHiByte tokLParen expr tokRParen {
+	$$ = newByteExpr(true, $3)
 }
 
-numberExprOptionalPound : numberExpr {
+// same as expr except it may not begin with a parenthesis, which
+// would be ambiguous with indirect addressing
+directExpr : directExpr tokPlus term {
+	$$ = newBinaryExpr(AddOperator, $1, $3)
+} | directExpr tokMinus term {
+	$$ = newBinaryExpr(SubOperator, $1, $3)
+} | directTerm {
+	$$ = $1
+}
+
+directTerm : directTerm tokStar factor {
+	$$ = newBinaryExpr(MulOperator, $1, $3)
+} | directTerm tokSlash factor {
+	$$ = newBinaryExpr(DivOperator, $1, $3)
+} | atom {
 	$$ = $1
-} | tokInteger {
-	tmp := IntegerDataItem($1)
-	$$ = &tmp
 }
 
 dataItem : tokQuotedString {
@@ -254,93 +564,177 @@ dataItem : tokQuotedString {
 	$$ = $1
 }
 
-assignStatement : tokIdentifier tokEqual tokInteger {
-	$$ = &AssignStatement{$1, $3}
+assignStatement : tokIdentifier tokEqual expr {
+	$$ = newAssignStatement($1, $3)
+} | tokIdentifier tokEqu expr {
+	$$ = newAssignStatement($1, $3)
 }
 
 orgPsuedoOp : tokOrg tokInteger {
-	$$ = &OrgPseudoOp{$2, 0xff, parseLineNumber}
+	$$ = &OrgPseudoOp{Value: $2, Fill: 0xff, Line: parseLineNumber, DefaultFill: true}
 } | tokOrg tokInteger tokComma tokInteger {
 	if $4 > 0xff {
 		yylex.Error("ORG directive fill parameter must be a single byte.")
 	}
-	$$ = &OrgPseudoOp{$2, byte($4), parseLineNumber}
+	$$ = &OrgPseudoOp{Value: $2, Fill: byte($4), Line: parseLineNumber}
+}
+
+alignStatement : tokAlign tokInteger {
+	$$ = newAlignStatement(yylex, $2, 0xff)
+	$$.DefaultFill = true
+} | tokAlign tokInteger tokComma tokInteger {
+	if $4 > 0xff {
+		yylex.Error("ALIGN directive fill parameter must be a single byte.")
+	}
+	$$ = newAlignStatement(yylex, $2, byte($4))
+}
+
+reserveStatement : tokReserve tokInteger {
+	$$ = &ReserveStatement{Size: $2, Line: parseLineNumber, DefaultFill: true}
+} | tokReserve tokInteger tokComma tokInteger {
+	if $4 > 0xff {
+		yylex.Error("RES directive fill parameter must be a single byte.")
+	}
+	$$ = &ReserveStatement{Size: $2, Fill: byte($4), Line: parseLineNumber}
+}
+
+fillValueStatement : tokFillValue tokInteger {
+	if $2 > 0xff {
+		yylex.Error("FILLVALUE directive parameter must be a single byte.")
+	}
+	$$ = &FillValueStatement{byte($2), parseLineNumber}
+}
+
+macroStatement : tokMacro tokIdentifier {
+	$$ = &MacroStatement{$2, nil, parseLineNumber}
+} | tokMacro tokIdentifier macroParams {
+	$$ = &MacroStatement{$2, $3, parseLineNumber}
+} | tokEndMacro {
+	$$ = &EndMacroStatement{parseLineNumber}
+} | tokIdentifier wordList {
+	$$ = &MacroCall{$1, $2, parseLineNumber}
+}
+
+conditionalStatement : tokIf expr {
+	$$ = &IfStatement{$2, parseLineNumber}
+} | tokElse {
+	$$ = &ElseStatement{parseLineNumber}
+} | tokEndIf {
+	$$ = &EndIfStatement{parseLineNumber}
+}
+
+macroParams : macroParams tokComma tokIdentifier {
+	$$ = append($1, $3)
+} | tokIdentifier {
+	$$ = []string{$1}
 }
 
 subroutineDecl : tokIdentifier tokSubroutine {
 	$$ = &LabelStatement{$1, parseLineNumber}
 }
 
-instructionStatement : tokInstruction tokPound tokInteger {
-	$$ = &Instruction{
+instructionStatement : tokInstruction tokPound expr {
+	i := &Instruction{
 		Type: ImmediateInstruction,
 		OpName: $1,
-		Value: $3,
 		Line: parseLineNumber,
 	}
+	i.setValueOperand($3)
+	$$ = i
 } | tokInstruction {
 	$$ = &Instruction{
 		Type: ImpliedInstruction,
 		OpName: $1,
 		Line: parseLineNumber,
 	}
-} | tokInstruction labelName tokComma tokRegister {
+} | tokInstruction tokRegister {
+	if $2 != "a" && $2 != "A" {
+		yylex.Error("Register argument must be A.")
+	}
 	$$ = &Instruction{
-		Type: DirectWithLabelIndexedInstruction,
+		Type: AccumulatorInstruction,
 		OpName: $1,
-		LabelName: $2,
-		RegisterName: $4,
+		RegisterName: $2,
 		Line: parseLineNumber,
 	}
-} | tokInstruction tokInteger tokComma tokRegister {
-	$$ = &Instruction{
-		Type: DirectIndexedInstruction,
+} | tokInstruction directExpr tokComma tokRegister {
+	i := &Instruction{
+		Type: DirectWithLabelIndexedInstruction,
 		OpName: $1,
-		Value: $2,
 		RegisterName: $4,
 		Line: parseLineNumber,
 	}
-} | tokInstruction labelName {
-	$$ = &Instruction{
+	i.setOperand($2)
+	if i.Expr == nil && i.LabelName == "" {
+		i.Type = DirectIndexedInstruction
+	}
+	$$ = i
+} | tokInstruction directExpr {
+	i := &Instruction{
 		Type: DirectWithLabelInstruction,
 		OpName: $1,
-		LabelName: $2,
 		Line: parseLineNumber,
 	}
-} | tokInstruction tokInteger {
-	$$ = &Instruction{
-		Type: DirectInstruction,
+	i.setOperand($2)
+	if i.Expr == nil && i.LabelName == "" {
+		i.Type = DirectInstruction
+	}
+	$$ = i
+} | tokInstruction tokForceAbsolute directExpr tokComma tokRegister {
+	i := &Instruction{
+		Type: DirectWithLabelIndexedInstruction,
 		OpName: $1,
-		Value: $2,
+		RegisterName: $5,
 		Line: parseLineNumber,
+		ForceAbsolute: true,
 	}
-} | tokInstruction tokLParen tokInteger tokComma tokRegister tokRParen {
+	i.setOperand($3)
+	if i.Expr == nil && i.LabelName == "" {
+		i.Type = DirectIndexedInstruction
+	}
+	$$ = i
+} | tokInstruction tokForceAbsolute directExpr {
+	i := &Instruction{
+		Type: DirectWithLabelInstruction,
+		OpName: $1,
+		Line: parseLineNumber,
+		ForceAbsolute: true,
+	}
+	i.setOperand($3)
+	if i.Expr == nil && i.LabelName == "" {
+		i.Type = DirectInstruction
+	}
+	$$ = i
+} | tokInstruction tokLParen expr tokComma tokRegister tokRParen {
 	if $5 != "x" && $5 != "X" {
 		yylex.Error("Register argument must be X.")
 	}
-	$$ = &Instruction{
+	i := &Instruction{
 		Type: IndirectXInstruction,
 		OpName: $1,
-		Value: $3,
 		Line: parseLineNumber,
 	}
-} | tokInstruction tokLParen tokInteger tokRParen tokComma tokRegister {
+	i.setValueOperand($3)
+	$$ = i
+} | tokInstruction tokLParen expr tokRParen tokComma tokRegister {
 	if $6 != "y" && $6 != "Y" {
 		yylex.Error("Register argument must be Y.")
 	}
-	$$ = &Instruction{
+	i := &Instruction{
 		Type: IndirectYInstruction,
 		OpName: $1,
-		Value: $3,
 		Line: parseLineNumber,
 	}
-} | tokInstruction tokLParen tokInteger tokRParen {
-	$$ = &Instruction{
+	i.setValueOperand($3)
+	$$ = i
+} | tokInstruction tokLParen expr tokRParen {
+	i := &Instruction{
 		Type: IndirectInstruction,
 		OpName: $1,
-		Value: $3,
 		Line: parseLineNumber,
 	}
+	i.setValueOperand($3)
+	$$ = i
 }
 
 labelName : tokDot {
@@ -2,8 +2,14 @@ package jamulator
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -27,6 +33,136 @@ var testAsmList = []testAsm{
 	},
 }
 
+type testAsmSource struct {
+	source   string
+	expected []byte
+}
+
+var testAsmSourceList = []testAsmSource{
+	{"lda #%00001111\n", []byte{0xa9, 0x0f}},
+	{"dc.b %11110000\n", []byte{0xf0}},
+	{"lda #0o17\n", []byte{0xa9, 0x0f}},
+	{"dc.b 017, 0O20\n", []byte{0x0f, 0x10}},
+	{"dc.w 0177777\n", []byte{0xff, 0xff}},
+	{"lda #'A'\n", []byte{0xa9, 0x41}},
+	{"dc.b 'H','i'\n", []byte{0x48, 0x69}},
+	{"dc.b '\\n', '\\0', '\\'', '\\\\'\n", []byte{0x0a, 0x00, 0x27, 0x5c}},
+	{"label:\nlda label+3,x\n", []byte{0xbd, 0x03, 0x00}},
+	{"WIDTH = 4\nlda #WIDTH*2+1\n", []byte{0xa9, 0x09}},
+	{"lda #(2+3)*4\n", []byte{0xa9, 0x14}},
+	{"lda $10+2\n", []byte{0xa5, 0x12}},
+	{"dc.w table+2, 10-2*3\ntable:\n", []byte{0x06, 0x00, 0x04, 0x00}},
+	{"dc.b \"a\\tb\\n\\\\\\\"\\0\", 0\n", []byte{'a', '\t', 'b', '\n', '\\', '"', 0, 0}},
+	{".hstring \"AB\", 0\n", []byte{0xc1, 0xc2, 0x00}},
+	{"dc.b 1, \"AB\", 3, label\nlabel:\n", []byte{0x01, 'A', 'B', 0x03, 0x05}},
+	{"label:\ndc.b label+2, \"A\", label\n", []byte{0x02, 'A', 0x00}},
+	{"ldx #sizeof(Table)\nrts\nTable:\ndc.b 1, 2, \"abc\"\nEnd:\nnop\n", []byte{0xa2, 0x05, 0x60, 0x01, 0x02, 'a', 'b', 'c', 0xea}},
+	{"TableLen = sizeof(Table) * 2\nlda #TableLen\nTable:\ndc.w 1, 2\n", []byte{0xa9, 0x08, 0x01, 0x00, 0x02, 0x00}},
+	// words are little endian, whether literal or a label's address
+	{"dc.w $1234\n", []byte{0x34, 0x12}},
+	{".org $c000\nStart:\nnop\ndc.w Start, $abcd\n", []byte{0xea, 0x00, 0xc0, 0xcd, 0xab}},
+	// unless they're for something other than the 6502
+	{"dc.w.be $1234\n", []byte{0x12, 0x34}},
+	{".org $c000\nStart:\nnop\n.dw.be Start, $abcd\ndc.w Start\n", []byte{0xea, 0xc0, 0x00, 0xab, 0xcd, 0x00, 0xc0}},
+	{"WIDTH = 8\nlda #WIDTH\ndc.b WIDTH, WIDTH*2\n", []byte{0xa9, 0x08, 0x08, 0x10}},
+	{"ZP = $10\nlda ZP\nsta ZP+1,x\n", []byte{0xa5, 0x10, 0x95, 0x11}},
+	{"dc.b .hibyte($1234), .lobyte($1234)\n", []byte{0x12, 0x34}},
+	{".org $c000\nStart:\nlda #.lobyte(Start+1)\nldx #.HIBYTE(Start)\ndc.b .hibyte(Start), .lobyte(End)\nEnd:\n", []byte{0xa9, 0x01, 0xa2, 0xc0, 0xc0, 0x06}},
+	// zero page is picked by value, however the address is written,
+	// unless absolute is forced
+	{"lda $0010\nsta $0010, x\n", []byte{0xa5, 0x10, 0x95, 0x10}},
+	{"lda a:$0010\nsta A:$10, x\nldx !$10, y\n", []byte{0xad, 0x10, 0x00, 0x9d, 0x10, 0x00, 0xbe, 0x10, 0x00}},
+	{"ZP = $10\nlda a:ZP+1\n", []byte{0xad, 0x11, 0x00}},
+	{"ldx #SIZE\nSIZE = 3\n", []byte{0xa2, 0x03}},
+	{"THIRD = SECOND + 1\nSECOND = FIRST * 2\nFIRST equ 3\nlda #THIRD\n", []byte{0xa9, 0x07}},
+	{"ZP_END = ZP + 2\nZP = $10\nlda ZP_END\n", []byte{0xa5, 0x12}},
+	{"SCREEN_END = SCREEN + 256\nlda SCREEN_END\nSCREEN:\n", []byte{0xad, 0x03, 0x01}},
+	{
+		"First:\nldx #2\n@loop:\ndex\nbne @loop\nrts\n" +
+			"Second:\nldy #3\n@loop:\ndey\nbeq @done\njmp @loop\n@done:\nrts\n",
+		[]byte{0xa2, 0x02, 0xca, 0xd0, 0xfd, 0x60, 0xa0, 0x03, 0x88, 0xf0, 0x03, 0x4c, 0x08, 0x00, 0x60},
+	},
+	{"bit $10\nbit $2002\n", []byte{0x24, 0x10, 0x2c, 0x02, 0x20}},
+	{"nop\n.align 4\nnop\n.align 2, $00\ndc.b 1\n", []byte{0xea, 0xff, 0xff, 0xff, 0xea, 0x00, 0x01}},
+	// the fill value is for every gap after it without a fill of its own
+	{".org $c000\nnop\n.fillvalue $aa\n.org $c002\nnop\n.org $c004, $00\nnop\n.org $c007\nnop\n.res 2\n.align 4\n",
+		[]byte{0xea, 0xaa, 0xea, 0x00, 0xea, 0xaa, 0xaa, 0xea, 0xaa, 0xaa, 0xaa, 0xaa}},
+	{".if 0\n.fillvalue $aa\n.endif\n.org $c000\nnop\n.org $c002\nnop\n", []byte{0xea, 0xff, 0xea}},
+	{"Buf: .res 3, $aa\nnop\n.res 2, $00\n", []byte{0xaa, 0xaa, 0xaa, 0xea, 0x00, 0x00}},
+	// macros
+	{
+		".macro StoreValue value, addr\nlda #value\nsta addr\n.endm\nStoreValue $01, $10\nStoreValue 2, $0200\n",
+		[]byte{0xa9, 0x01, 0x85, 0x10, 0xa9, 0x02, 0x8d, 0x00, 0x02},
+	},
+	{".macro Wait\nLoop: dex\nbne Loop\n.endm\nWait\nWait\n", []byte{0xca, 0xd0, 0xfd, 0xca, 0xd0, 0xfd}},
+	{".macro Inner\ninx\n.endm\n.macro Outer arg\nInner\nlda #arg+1\n.endm\nOuter 5\n", []byte{0xe8, 0xa9, 0x06}},
+	{"lsr a\nlsr $10\nlsr\n", []byte{0x4a, 0x46, 0x10, 0x4a}},
+	{"asl A\nrol a\nror a\n", []byte{0x0a, 0x2a, 0x6a}},
+	// a, a:, ds, sizeof and the undocumented mnemonics are only keywords
+	// where one can go, so they can still name labels and variables
+	{"a = 5\nlda #a\nasl a\n", []byte{0xa9, 0x05, 0x0a}},
+	{".org $c000\na: nop\njmp a\nlda a:a\n", []byte{0xea, 0x4c, 0x00, 0xc0, 0xad, 0x00, 0xc0}},
+	{".org $c000\nds: nop\njmp ds\nBuf: ds 2, $00\n", []byte{0xea, 0x4c, 0x00, 0xc0, 0x00, 0x00}},
+	{"sizeof = 3\nlda #sizeof\nlda #sizeof(T)\nT: dc.b 1, 2\n", []byte{0xa9, 0x03, 0xa9, 0x02, 0x01, 0x02}},
+	{".org $c000\nlax: nop\njmp lax\ndcp equ $10\nlda dcp\nlax $10\n", []byte{0xea, 0x4c, 0x00, 0xc0, 0xa5, 0x10, 0xa7, 0x10}},
+	{"lda #0-1\nldx #$ff\n", []byte{0xa9, 0xff, 0xa2, 0xff}},
+	{"stx $ff, y\nldx $0100, y\n", []byte{0x96, 0xff, 0xbe, 0x00, 0x01}},
+	{"lda $2000,x\nlda $2000,y\n", []byte{0xbd, 0x00, 0x20, 0xb9, 0x00, 0x20}},
+	{"lda $10,x\nlda $10,y\nlsr $0300,x\n", []byte{0xb5, 0x10, 0xb9, 0x10, 0x00, 0x5e, 0x00, 0x03}},
+}
+
+type testAsmError struct {
+	source        string
+	expectedError string
+}
+
+var testAsmErrorList = []testAsmError{
+	{"lda #%111111111\n", "Immediate instruction argument must be a 1 byte integer"},
+	{"dc.b 0o400\n", "Integer byte data item limited to 1 byte"},
+	{".org $c000\nFar:\ndc.b 1, \"A\", Far\n", "Line 3: Byte data item Far is $c000, which doesn't fit in 1 byte."},
+	{"dc.b 1-2\n", "Line 1: Integer byte data item limited to 1 byte."},
+	{"Start:\ndc.b Start-1\n", "Line 2: Byte data item Start - $01 is -1, which is negative."},
+	{"dc.w 1-2\n", "Line 1: Integer word data item limited to 2 bytes."},
+	{"lda #sizeof(Nowhere)\n", "Line 1: Unknown size of Nowhere"},
+	{"dc.w 0o200000\n", "Invalid octal integer"},
+	{"lda #018\n", "Invalid octal integer: 18"},
+	{"lda #09\n", "Invalid octal integer: 9"},
+	{"dc.w 0x10000\n", "Invalid hexadecimal integer: 10000"},
+	{"dc.w %10000000000000000\n", "Invalid binary integer"},
+	{"lda #'\\q'\n", "Unrecognized escape sequence"},
+	{"lda #1/0\n", "Line 1: Division by zero"},
+	{"nop\nlda missing+1\n", "Line 2: Undefined symbol: missing"},
+	{"nop\nnop\nlda #UNDEFINED\n", "Line 3: Undefined symbol: UNDEFINED"},
+	{"dc.b UNDEFINED\n", "Line 1: Undefined symbol: UNDEFINED"},
+	{".align 3\n", "ALIGN directive value must be a power of two."},
+	{".res 4, $100\n", "RES directive fill parameter must be a single byte."},
+	{".fillvalue 256\n", "FILLVALUE directive parameter must be a single byte."},
+	{"ONE = TWO\nTWO = ONE\n", "Line 1: Circular definition: ONE -> TWO -> ONE"},
+	{"ONE = TWO + 1\nTWO = THREE\nTHREE = ONE * 2\n", "Line 1: Circular definition: ONE -> TWO -> THREE -> ONE"},
+	{"ONE = missing\n", "Line 1: Undefined symbol: missing"},
+	{"COUNT = COUNT + 1\n", "Line 1: Circular definition: COUNT -> COUNT"},
+	{
+		"beq Far\n" + strings.Repeat("dc.b 0, 0, 0, 0, 0, 0, 0, 0, 0, 0\n", 20) + "Far:\nrts\n",
+		"Line 1: Branch to Far is 200 bytes away, but branches can only reach -128 to +127 bytes. Try branching to a nearby jmp Far instead.",
+	},
+	{".macro Forever\nForever\n.endm\nForever\n", "Line 2: Macro Forever is nested more than 16 deep"},
+	{".macro Two first, second\nlda #first\n.endm\nTwo 1\n", "Line 4: Macro Two expects 2 arguments, got 1"},
+	{".macro Open\nnop\n", "Line 1: Macro Open has no .endm"},
+	{"Missing 1, 2\n", "Line 1: Undefined macro Missing"},
+	{"nop\n.endif\n", "Line 2: .endif without .if"},
+	{".if 1\nnop\n", "Line 1: .if without .endif"},
+	{".if 1\n.else\n.else\n.endif\n", "Line 3: Second .else for the .if on line 1"},
+	{".if LATER\nnop\n.endif\nLATER = 1\n", "Line 1: Undefined symbol: LATER"},
+	// only asl, lsr, rol and ror take a bare register, so this is a label
+	{"lda a\n", "Line 1: Undefined label: a"},
+	{"nop\nlsr x\n", "Register argument must be A."},
+	{"lda #$1ff\n", "Line 1: Immediate instruction argument must be a 1 byte integer."},
+	{"lda #0-$81\n", "Line 1: Immediate instruction argument must be a 1 byte integer."},
+	{"nop\nstx $0100, y\n", "Line 2: Zero page address is limited to 1 byte, and stx has no absolute, Y mode."},
+	{"sty $1234, x\n", "Line 1: Zero page address is limited to 1 byte, and sty has no absolute, X mode."},
+	{"lda 0-1\n", "Line 1: Memory address -1 is negative."},
+}
+
 var testDisAsmList = []string{
 	"test/suite6502.bin.ref",
 	"test/zelda.bin.ref",
@@ -101,3 +237,1478 @@ func TestDisassembly(t *testing.T) {
 		}
 	}
 }
+
+func assembleSource(source string) ([]byte, error) {
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		return nil, errors.New(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func TestAsmSource(t *testing.T) {
+	for _, ta := range testAsmSourceList {
+		out, err := assembleSource(ta.source)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", ta.source, err.Error()))
+			continue
+		}
+		if bytes.Compare(out, ta.expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x, got % x", ta.source, ta.expected, out))
+		}
+	}
+}
+
+func TestDataDirectiveAliases(t *testing.T) {
+	aliases := []struct {
+		source   string
+		original string
+	}{
+		{".byte 1, $ff, \"hi\"\n", "dc.b 1, $ff, \"hi\"\n"},
+		{".BYTE %1010\n", "dc.b %1010\n"},
+		{".db 1, 2\n", "dc.b 1, 2\n"},
+		{".word $1234, 5\n", "dc.w $1234, 5\n"},
+		{".org $c000\nStart:\n.dw Start\n", ".org $c000\nStart:\ndc.w Start\n"},
+		{".word.be $1234\n", "dc.w.be $1234\n"},
+		{"lda #0x1F\n", "lda #$1F\n"},
+		{"dc.b 0xAA, 0Xab\n", "dc.b $AA, $ab\n"},
+	}
+	for _, a := range aliases {
+		out, err := assembleSource(a.source)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", a.source, err.Error()))
+			continue
+		}
+		expected, err := assembleSource(a.original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(out, expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x, got % x", a.source, expected, out))
+		}
+	}
+}
+
+func TestAsmErrors(t *testing.T) {
+	for _, ta := range testAsmErrorList {
+		_, err := assembleSource(ta.source)
+		if err == nil {
+			t.Error(fmt.Sprintf("%q: expected error", ta.source))
+			continue
+		}
+		if !strings.Contains(err.Error(), ta.expectedError) {
+			t.Error(fmt.Sprintf("%q: expected error %q, got %q", ta.source, ta.expectedError, err.Error()))
+		}
+	}
+}
+
+func TestConditionalAssembly(t *testing.T) {
+	source := ".if DEBUG\n" +
+		"DebugOnly:\n" +
+		"lda #$01\n" +
+		"sta $10\n" +
+		".if VERBOSE\n" +
+		"sta $11\n" +
+		".endif\n" +
+		".else\n" +
+		"nop\n" +
+		".endif\n" +
+		"rts\n"
+	tests := []struct {
+		debug        int
+		instructions int
+		labeled      bool
+	}{
+		{1, 3, true},
+		{0, 2, false},
+	}
+	for _, tt := range tests {
+		defs := fmt.Sprintf("DEBUG = %d\nVERBOSE = 0\n", tt.debug)
+		programAst, err := Parse(strings.NewReader(defs + source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program := programAst.ToProgram()
+		if len(program.Errors) > 0 {
+			t.Fatal(strings.Join(program.Errors, "\n"))
+		}
+		count := 0
+		for e := program.List.Front(); e != nil; e = e.Next() {
+			_, ok := e.Value.(*Instruction)
+			if ok {
+				count += 1
+			}
+		}
+		if count != tt.instructions {
+			t.Error(fmt.Sprintf("DEBUG = %d: expected %d instructions, got %d", tt.debug, tt.instructions, count))
+		}
+		_, labeled := program.Labels["DebugOnly"]
+		if labeled != tt.labeled {
+			t.Error(fmt.Sprintf("DEBUG = %d: expected DebugOnly defined to be %t", tt.debug, tt.labeled))
+		}
+	}
+}
+
+func TestVariableRedefinition(t *testing.T) {
+	programAst, err := Parse(strings.NewReader("W = 1\nW = 2\nlda #W\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	if len(program.Warnings) != 1 || program.Warnings[0] != "Line 2: Variable W redefined." {
+		t.Error(fmt.Sprintf("unexpected warnings: %q", program.Warnings))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf.Bytes(), []byte{0xa9, 0x02}) != 0 {
+		t.Error(fmt.Sprintf("expected a9 02, got % x", buf.Bytes()))
+	}
+}
+
+// a redefinition can use the value it replaces, whether the program is
+// assembled whole or streamed
+func TestVariableRedefinitionFromItself(t *testing.T) {
+	redefinitionTests := []struct {
+		source   string
+		expected []byte
+	}{
+		{"COUNT = 1\nCOUNT = COUNT + 1\nlda #COUNT\n", []byte{0xa9, 0x02}},
+		{"C = 1\nlda #C\nC = C * 3\nlda #C\nC = C + 1\nlda #C\n", []byte{0xa9, 0x01, 0xa9, 0x03, 0xa9, 0x04}},
+		{"N = 4\nM = N + 1\nN = M\nlda #N\nlda #M\n", []byte{0xa9, 0x05, 0xa9, 0x05}},
+	}
+	for _, rt := range redefinitionTests {
+		out, err := assembleSource(rt.source)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", rt.source, err.Error()))
+		} else if bytes.Compare(out, rt.expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x, got % x", rt.source, rt.expected, out))
+		}
+		buf := new(bytes.Buffer)
+		err = AssembleStream(strings.NewReader(rt.source), buf)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: streaming: %s", rt.source, err.Error()))
+		} else if bytes.Compare(buf.Bytes(), rt.expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x streamed, got % x", rt.source, rt.expected, buf.Bytes()))
+		}
+	}
+}
+
+// operand syntax which selects each addressing mode
+var roundTripOperands = map[AddrMode]string{
+	absAddr:            " $1234",
+	absXAddr:           " $1234, x",
+	absYAddr:           " $1234, y",
+	immedAddr:          " #$12",
+	impliedAddr:        "",
+	indirectAddr:       " ($1234)",
+	xIndexIndirectAddr: " ($12, x)",
+	indirectYIndexAddr: " ($12), y",
+	relativeAddr:       " RoundTrip_Next\nRoundTrip_Next:",
+	zeroPageAddr:       " $12",
+	zeroXIndexAddr:     " $12, x",
+	zeroYIndexAddr:     " $12, y",
+}
+
+var roundTripCorpus = []string{
+	"ldx #$08\nLoop:\nlda $0200, x\nsta $10, x\ndex\nbne Loop\n",
+	"lda #$00\nsta ($20), y\nlda ($30, x)\nldx $40, y\nstx $41, y\n",
+	"jsr Sub\njmp Done\nSub:\nasl\nrol $10\nror $1000, x\nrts\nDone:\n",
+	"sec\nlda #$10\nsbc #$01\nbcs Skip\nclc\nSkip:\nbit $2002\nbmi Skip\n",
+	"lda Table, y\nldy Table, x\njmp (Vector)\nTable:\ndc.b 1, 2, 3\nVector:\ndc.w $c000\n",
+}
+
+// assembles source into a PRG bank whose vectors point at the start of
+// the source, disassembles the bank, and checks that every instruction
+// the disassembler finds matches what was assembled. then reassembles the
+// disassembled source and checks it against the original binary.
+func roundTrip(source string) error {
+	fullSource := ".org $c000\nRoundTrip_Start:\n" + source +
+		"\nrts\n.org $fffa\ndc.w RoundTrip_Start, RoundTrip_Start, RoundTrip_Start\n"
+	programAst, err := Parse(strings.NewReader(fullSource))
+	if err != nil {
+		return err
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		return errors.New(strings.Join(program.Errors, "\n"))
+	}
+	binBuf := new(bytes.Buffer)
+	err = program.Assemble(binBuf)
+	if err != nil {
+		return err
+	}
+	bin := binBuf.Bytes()
+
+	dis, err := Disassemble(bytes.NewReader(bin))
+	if err != nil {
+		return err
+	}
+	foundStart := false
+	for e := dis.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			continue
+		}
+		if i.Offset == 0xc000 {
+			foundStart = true
+		}
+		elem, ok := program.Offsets[i.Offset]
+		if !ok {
+			return errors.New(fmt.Sprintf("$%04x: disassembled %q mid-instruction", i.Offset, i.Render()))
+		}
+		src, ok := elem.Value.(*Instruction)
+		if !ok {
+			return errors.New(fmt.Sprintf("$%04x: disassembled data as %q", i.Offset, i.Render()))
+		}
+		if src.OpCode != i.OpCode || bytes.Compare(src.Payload, i.Payload) != 0 {
+			return errors.New(fmt.Sprintf("$%04x: assembled %q as % x but disassembled % x as %q",
+				i.Offset, src.Render(), src.Payload, i.Payload, i.Render()))
+		}
+		if opCodeDataMap[i.OpCode].opName != strings.ToLower(src.OpName) {
+			return errors.New(fmt.Sprintf("$%04x: assembled %q as opcode $%02x which is %s",
+				i.Offset, src.Render(), i.OpCode, opCodeDataMap[i.OpCode].opName))
+		}
+	}
+	if !foundStart {
+		return errors.New("first instruction was not disassembled")
+	}
+
+	sourceBuf := new(bytes.Buffer)
+	err = dis.WriteSource(sourceBuf)
+	if err != nil {
+		return err
+	}
+	programAst, err = Parse(sourceBuf)
+	if err != nil {
+		return err
+	}
+	program = programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		return errors.New(strings.Join(program.Errors, "\n"))
+	}
+	binBuf = new(bytes.Buffer)
+	err = program.Assemble(binBuf)
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(binBuf.Bytes(), bin) != 0 {
+		return errors.New("reassembled disassembly does not match")
+	}
+	return nil
+}
+
+func TestRoundTripOpCodes(t *testing.T) {
+	for opCode, info := range opCodeDataMap {
+		if info.addrMode == nilAddr {
+			continue
+		}
+		source := info.opName + roundTripOperands[info.addrMode] + "\n"
+		err := roundTrip(source)
+		if err != nil {
+			t.Error(fmt.Sprintf("opcode $%02x (%q): %s", opCode, source, err.Error()))
+		}
+	}
+}
+
+func TestRoundTripCorpus(t *testing.T) {
+	for _, source := range roundTripCorpus {
+		err := roundTrip(source)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", source, err.Error()))
+		}
+	}
+}
+
+func TestIhex(t *testing.T) {
+	expected, err := ioutil.ReadFile("test/hello.hex.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	programAst, err := ParseFile("test/hello.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteIhex(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf.Bytes(), expected) != 0 {
+		t.Error(fmt.Sprintf("expected:\n%s\ngot:\n%s", expected, buf.Bytes()))
+	}
+}
+
+func TestWriteBinary(t *testing.T) {
+	programAst, err := Parse(strings.NewReader(".org $c010\nlda #$01\n.org $c000\nnop\nnop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	for _, fill := range []byte{0x00, 0xff} {
+		expected := bytes.Repeat([]byte{fill}, 0x12)
+		expected[0], expected[1] = 0xea, 0xea
+		expected[0x10], expected[0x11] = 0xa9, 0x01
+		buf := new(bytes.Buffer)
+		err = program.WriteBinary(buf, fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(buf.Bytes(), expected) != 0 {
+			t.Error(fmt.Sprintf("fill $%02x: expected % x, got % x", fill, expected, buf.Bytes()))
+		}
+	}
+}
+
+func TestAddressRange(t *testing.T) {
+	source := ".org $c000\nStart:\nlda #$01\njmp Start\n" +
+		".org $8000\nTable:\ndc.b 1, 2, 3\n" +
+		"ZP = $10\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	lo, hi := program.AddressRange()
+	if lo != 0x8000 || hi != 0xc004 {
+		t.Error(fmt.Sprintf("expected $8000-$c004, got $%04x-$%04x", lo, hi))
+	}
+
+	programAst, err = Parse(strings.NewReader("ZP = $10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lo, hi = programAst.ToProgram().AddressRange()
+	if lo != -1 || hi != -1 {
+		t.Error(fmt.Sprintf("expected no range for an empty program, got %d-%d", lo, hi))
+	}
+}
+
+func TestTotalCycles(t *testing.T) {
+	// 2 + 4 + 2 + 2 + 2 + 6 + 6
+	source := "ldx #$00\nloop:\nlda $0300, x\ninx\ncpx #$10\nbne loop\ninc $0400\nrts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	if program.TotalCycles() != 24 {
+		t.Error(fmt.Sprintf("expected 24 cycles, got %d", program.TotalCycles()))
+	}
+	// lda abs,x and bne may each take an extra cycle
+	if program.EstimateCycles(1) != 26 {
+		t.Error(fmt.Sprintf("expected 26 cycles with page crossing, got %d", program.EstimateCycles(1)))
+	}
+}
+
+func TestAlign(t *testing.T) {
+	programAst, err := Parse(strings.NewReader(".org $c000\nlda Table, x\n.align 256\nTable:\ndc.b 1, 2, 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	if program.Labels["Table"] != 0xc100 {
+		t.Error(fmt.Sprintf("expected Table at $c100, got $%04x", program.Labels["Table"]))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0x103 || buf.Bytes()[0xff] != 0xff || buf.Bytes()[0x100] != 1 {
+		t.Error(fmt.Sprintf("unexpected output: %d bytes", buf.Len()))
+	}
+}
+
+func TestReserve(t *testing.T) {
+	programAst, err := Parse(strings.NewReader(".org $0300\nBuffer: .res 16\nAfter:\nnop\nds 2, $aa\nnop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	if program.Labels["Buffer"] != 0x0300 {
+		t.Error(fmt.Sprintf("expected Buffer at $0300, got $%04x", program.Labels["Buffer"]))
+	}
+	if program.Labels["After"] != program.Labels["Buffer"]+16 {
+		t.Error(fmt.Sprintf("expected After at $0310, got $%04x", program.Labels["After"]))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(make([]byte, 16), 0xea, 0xaa, 0xaa, 0xea)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error(fmt.Sprintf("unexpected output: % x", buf.Bytes()))
+	}
+}
+
+func TestAssembleBanks(t *testing.T) {
+	source := ".org $8000\nBank0:\nlda #$01\njmp Bank1\n" +
+		".org $8000, $00\nBank1:\ndc.b $aa, $bb\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	banks := []BankDef{
+		{Name: "bank0.bin", Start: "Bank0", Size: 8},
+		{Name: "bank1.bin", Start: "Bank1", Size: 4},
+	}
+	err = program.AssembleBanksToDir(dir, banks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{
+		{0xa9, 0x01, 0x4c, 0x00, 0x80, 0xff, 0xff, 0xff},
+		{0xaa, 0xbb, 0x00, 0x00},
+	}
+	for i, bank := range banks {
+		image, err := ioutil.ReadFile(path.Join(dir, bank.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(image, expected[i]) {
+			t.Error(fmt.Sprintf("%s: expected % x, got % x", bank.Name, expected[i], image))
+		}
+	}
+
+	banks[1].Size = 1
+	_, err = program.AssembleBanks(banks)
+	if err == nil || !strings.Contains(err.Error(), "more than its size") {
+		t.Error(fmt.Sprintf("expected bank1.bin to be too big, got %v", err))
+	}
+}
+
+func TestInclude(t *testing.T) {
+	programAst, err := ParseFile("test/include/main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xa9, 0x40, 0x8d, 0x00, 0x20, 0x60}
+	if bytes.Compare(buf.Bytes(), expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x, got % x", expected, buf.Bytes()))
+	}
+}
+
+func TestIncludeResolveError(t *testing.T) {
+	programAst, err := ParseFile("test/include/undefined_main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	expected := "test/include/undefined.asm: Line 2: Undefined label: Missing"
+	if len(program.Errors) != 1 || program.Errors[0] != expected {
+		t.Error(fmt.Sprintf("expected %q, got %q", expected, program.Errors))
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	_, err := ParseFile("test/include/cycle_a.asm")
+	if err == nil {
+		t.Fatal("expected include cycle error")
+	}
+	if !strings.Contains(err.Error(), "Include cycle") {
+		t.Error(fmt.Sprintf("expected include cycle error, got %q", err.Error()))
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	source := ".org $c000\nStart:\nlda #$01\nsta $2000\ndc.b 1, 2, 3, 4, 5, 6, 7, 8, 9\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteListing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	expected := []string{
+		"c000:                          .org $c000",
+		"c000:                          Start:",
+		"c000: a9 01                        lda #$01",
+		"c002: 8d 00 20                     sta $2000",
+		"c005: 01 02 03 04 05 06 07 08      .db $01, $02, $03, $04, $05, $06, $07, $08, $09",
+		"c00d: 09",
+	}
+	for i, line := range expected {
+		if i >= len(lines) || lines[i] != line {
+			t.Error(fmt.Sprintf("line %d: expected %q, got:\n%s", i, line, buf.String()))
+			break
+		}
+	}
+
+	program.List.PushBack(&MacroCall{"Wait", list.New(), 6})
+	err = program.WriteListing(ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "MacroCall") {
+		t.Error(fmt.Sprintf("expected an error for the macro call, got %v", err))
+	}
+}
+
+func optimizeSource(source string) ([]byte, error) {
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		return nil, errors.New(strings.Join(program.Errors, "\n"))
+	}
+	program.Optimize(false)
+	if len(program.Errors) > 0 {
+		return nil, errors.New(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var testOptimizeList = []testAsmSource{
+	// idioms which collapse
+	{"nop\nlda #$01\nnop\n", []byte{0xa9, 0x01}},
+	{"php\nplp\nrts\n", []byte{0x60}},
+	{"pha\npla\n", []byte{0x09, 0x00}},
+	{"clc\nsec\nsec\n", []byte{0x38}},
+	{"lda #$01\nlda $10\n", []byte{0xa5, 0x10}},
+	{"tax\ntxa\n", []byte{0xaa}},
+	{"Loop:\nnop\nbne Loop\n", []byte{0xd0, 0xfe}},
+	{"lda #$10\nclc\nadc #$05\nsta $10\ncmp #$20\nadc #$01\n", []byte{0xa9, 0x15, 0x85, 0x10, 0xc9, 0x20, 0x69, 0x01}},
+	{"lda #$10\nsec\nsbc #$20\nclv\nsec\n", []byte{0xa9, 0xf0, 0xb8, 0x38}},
+	// flag and side effect sensitive sequences which are left alone
+	{"lda #$01\nsta $10\nlda #$02\n", []byte{0xa9, 0x01, 0x85, 0x10, 0xa9, 0x02}},
+	{"lda $2002\nlda #$00\n", []byte{0xad, 0x02, 0x20, 0xa9, 0x00}},
+	{"clc\nadc #$01\nclc\n", []byte{0x18, 0x69, 0x01, 0x18}},
+	{"pla\npha\n", []byte{0x68, 0x48}},
+	{"nop $2002\nnop $0300, x\nnop\n", []byte{0x0c, 0x02, 0x20, 0x1c, 0x00, 0x03}},
+	{"tax\nLabel:\ntxa\n", []byte{0xaa, 0x8a}},
+	{"lda #$01\nldx #$02\n", []byte{0xa9, 0x01, 0xa2, 0x02}},
+	{"lda #$10\nclc\nadc #$05\nbcs Done\nDone:\n", []byte{0xa9, 0x10, 0x18, 0x69, 0x05, 0xb0, 0x00}},
+	{"lda #$10\nclc\nadc #$05\nrts\n", []byte{0xa9, 0x10, 0x18, 0x69, 0x05, 0x60}},
+	{"sed\nlda #$09\nclc\nadc #$01\nsta $10\n", []byte{0xf8, 0xa9, 0x09, 0x18, 0x69, 0x01, 0x85, 0x10}},
+}
+
+func TestOptimize(t *testing.T) {
+	for _, ta := range testOptimizeList {
+		out, err := optimizeSource(ta.source)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", ta.source, err.Error()))
+			continue
+		}
+		if bytes.Compare(out, ta.expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x, got % x", ta.source, ta.expected, out))
+		}
+	}
+}
+
+func TestOptimizeDecimalMode(t *testing.T) {
+	programAst, err := Parse(strings.NewReader("lda #$09\nclc\nadc #$01\nsta $10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	program.Optimize(true)
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reset state could have D set, so $09 + $01 may be $10
+	expected := []byte{0xa9, 0x09, 0x18, 0x69, 0x01, 0x85, 0x10}
+	if bytes.Compare(buf.Bytes(), expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x, got % x", expected, buf.Bytes()))
+	}
+}
+
+func TestAstWriteSource(t *testing.T) {
+	source := "Start: LDA #$01\n" +
+		".org $c010\n" +
+		"Table: .db 1, 2, 3, 4, 5, 6, 7, 8, 9, 10\n" +
+		"LongerLabel:\n" +
+		"  sta ($10), y\n"
+	expected := "Start:        lda #$01\n" +
+		".org $c010\n" +
+		"Table:        .db $01, $02, $03, $04, $05, $06, $07, $08\n" +
+		"              .db $09, $0a\n" +
+		"LongerLabel:\n" +
+		"              sta ($10), Y\n" +
+		"LongestLabel: rts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// labels are aligned to the longest one, including ones added
+	// after parsing
+	programAst.List.PushBack(&LabeledStatement{&LabelStatement{"LongestLabel", 0}, &Instruction{Type: ImpliedInstruction, OpName: "RTS"}})
+	if programAst.String() != expected {
+		t.Error(fmt.Sprintf("expected:\n%s\ngot:\n%s", expected, programAst.String()))
+	}
+}
+
+func TestAstWriteSourceMacro(t *testing.T) {
+	programAst, err := Parse(strings.NewReader("nop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	programAst.List.PushBack(&MacroCall{"Wait", list.New(), 2})
+	err = programAst.WriteSource(ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "MacroCall") {
+		t.Error(fmt.Sprintf("expected an error for the macro call, got %v", err))
+	}
+}
+
+func TestAstWriteSourceReparse(t *testing.T) {
+	bin, err := ioutil.ReadFile("test/hello.bin.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := Disassemble(bytes.NewReader(bin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceBuf := new(bytes.Buffer)
+	err = program.WriteSource(sourceBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	programAst, err := Parse(sourceBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rendering the reparsed source again should give the same text and
+	// the same binary
+	rendered := programAst.String()
+	reparsedAst, err := Parse(strings.NewReader(rendered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reparsedAst.String() != rendered {
+		t.Error("rendered source does not reparse to an equivalent AST")
+	}
+	out, err := assembleSource(rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(out, bin) != 0 {
+		t.Error("rendered source does not assemble to the original binary")
+	}
+}
+
+type testLookupOpcode struct {
+	mnemonic string
+	mode     AddressingMode
+	opcode   int
+	size     int
+	ok       bool
+}
+
+var testLookupOpcodeList = []testLookupOpcode{
+	{"lda", AbsoluteXMode, 0xbd, 3, true},
+	{"LDA", ImmediateMode, 0xa9, 2, true},
+	{"sta", IndirectYMode, 0x91, 2, true},
+	{"jmp", IndirectMode, 0x6c, 3, true},
+	{"rts", ImpliedMode, 0x60, 1, true},
+	{"bne", RelativeMode, 0xd0, 2, true},
+	{"ldx", ZeroPageYMode, 0xb6, 2, true},
+	{"sta", ImmediateMode, 0, 0, false},
+	{"foo", AbsoluteMode, 0, 0, false},
+	{"", AbsoluteMode, 0, 0, false},
+}
+
+func TestLookupOpcode(t *testing.T) {
+	for _, tl := range testLookupOpcodeList {
+		opcode, size, ok := LookupOpcode(tl.mnemonic, tl.mode)
+		if opcode != tl.opcode || size != tl.size || ok != tl.ok {
+			t.Error(fmt.Sprintf("%s %d: expected %02x %d %t, got %02x %d %t",
+				tl.mnemonic, tl.mode, tl.opcode, tl.size, tl.ok, opcode, size, ok))
+		}
+	}
+}
+
+func TestOpCodeTable(t *testing.T) {
+	for opCode, info := range opCodeTable {
+		if info.illegal {
+			if info.opName != "" || info.size != 0 {
+				t.Error(fmt.Sprintf("$%02x: illegal op code has name %q and size %d", opCode, info.opName, info.size))
+			}
+			continue
+		}
+		forward, ok := opNameToOpCode[info.addrMode][info.opName]
+		if ok && info.opName == "nop" && int(forward) != opCode && opCodeTable[forward].addrMode == info.addrMode {
+			// an alternative encoding, which assembles as the usual one
+			continue
+		}
+		if !ok || int(forward) != opCode {
+			t.Error(fmt.Sprintf("$%02x: %s maps back to $%02x", opCode, info.opName, forward))
+		}
+		lookup, size, ok := LookupOpcode(info.opName, AddressingMode(info.addrMode))
+		if !ok || lookup != opCode || size != info.size {
+			t.Error(fmt.Sprintf("$%02x: LookupOpcode(%s) gave $%02x, size %d", opCode, info.opName, lookup, size))
+		}
+	}
+}
+
+func TestParseErrorColumn(t *testing.T) {
+	_, err := Parse(strings.NewReader("lda #$01\n    sta $10,, x\n"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	errs, ok := err.(ParseErrors)
+	if !ok || len(errs) == 0 {
+		t.Fatal(fmt.Sprintf("expected ParseErrors, got %T", err))
+	}
+	// the second comma is the problem
+	if errs[0].Line != 2 || errs[0].Column != 13 || errs[0].Token != "," {
+		t.Error(fmt.Sprintf("expected line 2 column 13 at \",\", got line %d column %d at %q",
+			errs[0].Line, errs[0].Column, errs[0].Token))
+	}
+	if !strings.HasPrefix(err.Error(), "line 2 column 13 ") {
+		t.Error(fmt.Sprintf("column missing from %q", err.Error()))
+	}
+	e := &ParseError{Filename: "main.asm", Line: 2, Column: 13, Token: ",", Message: "syntax error"}
+	if e.Error() != "main.asm line 2 column 13 syntax error near \",\"" {
+		t.Error(fmt.Sprintf("unexpected error text %q", e.Error()))
+	}
+}
+
+func TestAstWalk(t *testing.T) {
+	source := "Start: lda #$01\nsta $10\nTable: .db 1, 2, 3\nLoop:\njmp Loop\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrCount := 0
+	dataItemCount := 0
+	programAst.Walk(func(node interface{}) bool {
+		switch node.(type) {
+		case *Instruction:
+			instrCount += 1
+		case *IntegerDataItem:
+			dataItemCount += 1
+		}
+		return true
+	})
+	if instrCount != 3 || dataItemCount != 3 {
+		t.Error(fmt.Sprintf("expected 3 instructions and 3 data items, got %d and %d", instrCount, dataItemCount))
+	}
+
+	// stop at the first label
+	var firstLabel string
+	finished := programAst.Walk(func(node interface{}) bool {
+		l, ok := node.(*LabelStatement)
+		if ok {
+			firstLabel = l.LabelName
+		}
+		return !ok
+	})
+	if finished || firstLabel != "Start" {
+		t.Error(fmt.Sprintf("expected the walk to stop at Start, stopped at %q", firstLabel))
+	}
+}
+
+func TestOpcodeHistogram(t *testing.T) {
+	source := "lda #$01\nsta $10\nlda $0200, x\nLDA $10\nsta $0300\nTable: .db 1, 2\ninx\nrts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"lda": 3, "sta": 2, "inx": 1, "rts": 1}
+	counts := programAst.OpcodeHistogram()
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected %v, got %v", expected, counts))
+	}
+
+	program := programAst.ToProgram()
+	err = program.Assemble(new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]int{
+		"lda immediate":  1,
+		"lda zeropage":   1,
+		"lda absolute,x": 1,
+		"sta zeropage":   1,
+		"sta absolute":   1,
+		"inx implied":    1,
+		"rts implied":    1,
+	}
+	counts = program.OpcodeHistogram()
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected %v, got %v", expected, counts))
+	}
+}
+
+// counts nodes, skipping the items of data statements
+type dataSkippingVisitor struct {
+	visited int
+	ended   int
+}
+
+func (v *dataSkippingVisitor) Visit(node interface{}) bool {
+	v.visited += 1
+	_, isData := node.(*DataStatement)
+	return !isData
+}
+
+func (v *dataSkippingVisitor) VisitEnd(node interface{}) {
+	v.ended += 1
+}
+
+func TestAstAccept(t *testing.T) {
+	source := "Start: lda #$01\nTable: .db " + strings.Repeat("0, ", 500) + "0\nrts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two labeled statements with their labels and statements, and rts
+	v := &dataSkippingVisitor{}
+	programAst.Accept(v)
+	if v.visited != 7 || v.ended != 7 {
+		t.Error(fmt.Sprintf("expected 7 nodes visited and ended, got %d and %d", v.visited, v.ended))
+	}
+
+	all := 0
+	programAst.Accept(VisitorFunc(func(node interface{}) {
+		all += 1
+	}))
+	if all != 7+501 {
+		t.Error(fmt.Sprintf("expected %d nodes, got %d", 7+501, all))
+	}
+}
+
+func TestAstDump(t *testing.T) {
+	programAst, err := Parse(strings.NewReader("Start: lda #$01\ndc.b 2, Start, .hibyte(Start+1), .lobyte($1234)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = programAst.Dump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "*jamulator.LabeledStatement\n" +
+		"  *jamulator.LabelStatement line=1 label=Start\n" +
+		"  *jamulator.Instruction line=1 op=lda operand=$01\n" +
+		"*jamulator.DataStatement line=2\n" +
+		"  *jamulator.IntegerDataItem $02\n" +
+		"  *jamulator.LabelCall Start\n" +
+		"  *jamulator.ByteExpr byte=high operand=Start + $01\n" +
+		"  *jamulator.IntegerDataItem $34\n"
+	if buf.String() != expected {
+		t.Error(fmt.Sprintf("unexpected dump:\n%s", buf.String()))
+	}
+}
+
+func TestSuggestMnemonic(t *testing.T) {
+	_, err := Parse(strings.NewReader("lsa #$01\n"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "did you mean lda?") {
+		t.Error(fmt.Sprintf("expected a suggestion of lda, got %q", err.Error()))
+	}
+	if suggestMnemonic("STX") != "stx" {
+		t.Error(fmt.Sprintf("expected stx, got %q", suggestMnemonic("STX")))
+	}
+	if suggestMnemonic("Reset_Routine") != "" {
+		t.Error(fmt.Sprintf("expected no suggestion, got %q", suggestMnemonic("Reset_Routine")))
+	}
+}
+
+func TestAssembleStream(t *testing.T) {
+	for _, ta := range testAsmList {
+		expected, err := ioutil.ReadFile(ta.expectedOutFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := ioutil.ReadFile(ta.inFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		err = AssembleStream(bytes.NewReader(source), buf)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: %s", ta.inFile, err.Error()))
+			continue
+		}
+		if bytes.Compare(buf.Bytes(), expected) != 0 {
+			t.Error(fmt.Sprintf("%s: streamed output differs from %s", ta.inFile, ta.expectedOutFile))
+		}
+	}
+	for _, source := range []string{
+		".org $c000\nnop\n.fillvalue $aa\n.org $c002\nnop\n.res 2\n.align 8\nnop\n",
+		"Buf: .res 3, $aa\nnop\n",
+	} {
+		expected, err := assembleSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		err = AssembleStream(strings.NewReader(source), buf)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", source, err.Error()))
+			continue
+		}
+		if bytes.Compare(buf.Bytes(), expected) != 0 {
+			t.Error(fmt.Sprintf("%q: streamed % x, expected % x", source, buf.Bytes(), expected))
+		}
+	}
+}
+
+func TestAssembleStreamErrors(t *testing.T) {
+	err := AssembleStream(strings.NewReader("jmp Nowhere\n"), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "Line 1: Undefined label: Nowhere") {
+		t.Error(fmt.Sprintf("expected an undefined symbol error, got %v", err))
+	}
+	err = AssembleStream(strings.NewReader("nop\n.macro Two\n"), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "Line 2: Macros can't be defined while streaming") {
+		t.Error(fmt.Sprintf("expected a macro error, got %v", err))
+	}
+}
+
+func BenchmarkAssembleWholeProgram(b *testing.B) {
+	source, err := ioutil.ReadFile("test/zelda.asm")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		programAst, err := Parse(bytes.NewReader(source))
+		if err != nil {
+			b.Fatal(err)
+		}
+		program := programAst.ToProgram()
+		if len(program.Errors) > 0 {
+			b.Fatal(strings.Join(program.Errors, "\n"))
+		}
+		err = program.Assemble(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAssembleStream(b *testing.B) {
+	source, err := ioutil.ReadFile("test/zelda.asm")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err = AssembleStream(bytes.NewReader(source), ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCallGraph(t *testing.T) {
+	source := "Reset:\n" +
+		"  jsr First\n" +
+		"  jsr Second\n" +
+		"  jsr First\n" +
+		"  rts\n" +
+		"First:\n" +
+		"  jsr Shared\n" +
+		"  rts\n" +
+		"Second:\n" +
+		"@loop:\n" +
+		"  jsr Shared\n" +
+		"  bne @loop\n" +
+		"  jmp ($0010)\n" +
+		"Shared:\n" +
+		"  rts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	expected := map[string][]string{
+		"Reset":  {"First", "Second"},
+		"First":  {"Shared"},
+		"Second": {"Shared", IndirectCallTarget},
+	}
+	graph := program.CallGraph()
+	if fmt.Sprint(graph) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected %v, got %v", expected, graph))
+	}
+}
+
+func TestEliminateDeadCode(t *testing.T) {
+	source := "Start:\n" +
+		"  jsr Used\n" +
+		"  rts\n" +
+		"  lda #$01\n" +
+		"  sta $10\n" +
+		"Used:\n" +
+		"  rts\n" +
+		"Unused:\n" +
+		"  inx\n" +
+		"  rts\n" +
+		"Entry:\n" +
+		"  dey\n" +
+		"  rts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	removed := program.EliminateDeadCode("Start", "Entry")
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	if removed != 6 {
+		t.Error(fmt.Sprintf("expected 6 bytes removed, got %d", removed))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x20, 0x04, 0x00, 0x60, 0x60, 0x88, 0x60}
+	if bytes.Compare(buf.Bytes(), expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x, got % x", expected, buf.Bytes()))
+	}
+	_, ok := program.Labels["Unused"]
+	if ok {
+		t.Error("expected the Unused label to be removed")
+	}
+}
+
+// labels taken with sizeof, and the labels which end their regions,
+// are kept even though nothing jumps to them
+func TestEliminateDeadCodeSizeof(t *testing.T) {
+	deadCodeTests := []struct {
+		source   string
+		expected []byte
+	}{
+		{"Start:\nldx #sizeof(Table)\nrts\nTable:\ndc.b 1, 2, 3\n", []byte{0xa2, 0x03, 0x60, 0x01, 0x02, 0x03}},
+		{"Start:\nldx #sizeof(Table)\nrts\nTable:\ndc.b 1, 2\nOther:\ndc.b 3, 4\n", []byte{0xa2, 0x02, 0x60, 0x01, 0x02, 0x03, 0x04}},
+	}
+	for _, dt := range deadCodeTests {
+		programAst, err := Parse(strings.NewReader(dt.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program := programAst.ToProgram()
+		if len(program.Errors) > 0 {
+			t.Fatal(strings.Join(program.Errors, "\n"))
+		}
+		program.EliminateDeadCode("Start")
+		if len(program.Errors) > 0 {
+			t.Error(fmt.Sprintf("%q: %s", dt.source, strings.Join(program.Errors, "\n")))
+			continue
+		}
+		buf := new(bytes.Buffer)
+		err = program.Assemble(buf)
+		if err != nil {
+			t.Error(fmt.Sprintf("%q: %s", dt.source, err.Error()))
+			continue
+		}
+		if bytes.Compare(buf.Bytes(), dt.expected) != 0 {
+			t.Error(fmt.Sprintf("%q: expected % x, got % x", dt.source, dt.expected, buf.Bytes()))
+		}
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	source := ".org $c000\n" +
+		"Start:\n" +
+		"  jmp Main\n" +
+		"Main:\n" +
+		"  lda Table, x\n" +
+		"  sta Table+1\n" +
+		"  lda $0200\n" +
+		"  bne Main\n" +
+		"  lda #End-Table\n" +
+		"Table:\n" +
+		"  dc.w Start, $1234, Main\n" +
+		"End:\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	expected := []Relocation{
+		{0xc001, "Main", 3},
+		{0xc004, "Table", 5},
+		{0xc007, "Table", 6},
+		{0xc010, "Start", 11},
+		{0xc014, "Main", 11},
+	}
+	relocs := program.Relocations()
+	if fmt.Sprint(relocs) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected %v, got %v", expected, relocs))
+	}
+}
+
+func TestMemoryAccesses(t *testing.T) {
+	source := "lda #$80\n" +
+		"sta $2000\n" +
+		"inc $10\n" +
+		"lda Table, x\n" +
+		"sta ($20), y\n" +
+		"jmp Table\n" +
+		"Table:\n" +
+		"dc.b 1, 2\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	expected := []AccessInfo{
+		{Line: 2, Offset: 0x02, OpName: "sta", Address: 0x2000, Length: 1, Write: true},
+		{Line: 3, Offset: 0x05, OpName: "inc", Address: 0x10, Length: 1, Read: true, Write: true},
+		{Line: 4, Offset: 0x07, OpName: "lda", Address: 0x0f, Length: 0x100, Read: true},
+		{Line: 5, Offset: 0x0a, OpName: "sta", Address: 0x20, Length: 0, Write: true, Dynamic: true},
+	}
+	accesses := program.MemoryAccesses()
+	if fmt.Sprintf("%+v", accesses) != fmt.Sprintf("%+v", expected) {
+		t.Error(fmt.Sprintf("expected %+v, got %+v", expected, accesses))
+	}
+}
+
+func TestInstructionBytes(t *testing.T) {
+	programAst, err := Parse(strings.NewReader("lda Table, x\nbne Loop\nsta $10\njmp Missing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instructions := []*Instruction{}
+	for e := programAst.List.Front(); e != nil; e = e.Next() {
+		instructions = append(instructions, e.Value.(*Instruction))
+	}
+	symbols := map[string]int{"Table": 0x0300, "Loop": 0xc000}
+	expected := [][]byte{{0xbd, 0x00, 0x03}, {0xd0, 0xeb}, {0x85, 0x10}}
+	pc := 0xc010
+	for n, want := range expected {
+		encoded, err := instructions[n].Bytes(symbols, pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, want) {
+			t.Error(fmt.Sprintf("%s at $%04x: expected % x, got % x", instructions[n].Render(), pc, want, encoded))
+		}
+		pc += len(encoded)
+	}
+	if instructions[1].Payload != nil || instructions[1].Offset != 0 {
+		t.Error("Bytes changed the instruction")
+	}
+	_, err = instructions[3].Bytes(symbols, pc)
+	if err == nil || !strings.Contains(err.Error(), "Undefined label: Missing") {
+		t.Error(fmt.Sprintf("expected an undefined label error, got %v", err))
+	}
+}
+
+func TestInstructionAddressingMode(t *testing.T) {
+	source := "lda #$01\nsta $10\nsta $0200, x\nlda ($10), y\nbne Done\njmp ($0300)\nDone:\nrts\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	expected := []AddressingMode{ImmediateMode, ZeroPageMode, AbsoluteXMode, IndirectYMode, RelativeMode, IndirectMode, ImpliedMode}
+	modes := []AddressingMode{}
+	for e := program.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok {
+			modes = append(modes, i.AddressingMode)
+		}
+	}
+	if fmt.Sprint(modes) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected modes %v, got %v", expected, modes))
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	source := ".org $c000\nStart:\nlda #$01\nsta $0200, x\nbne Start\nTable:\ndc.b 1, 2, 3\n" +
+		"Buffer: .res 4\n.align 4\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	out, err := json.Marshal(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc programJson
+	err = json.Unmarshal(out, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Instructions) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 instructions, got %s", out))
+	}
+	operand := 0x0200
+	expected := instructionJson{Address: 0xc002, OpCode: 0x9d, Mnemonic: "sta", Mode: "absolute,x", Operand: &operand, Line: 4}
+	sta := doc.Instructions[1]
+	if sta.Operand == nil || *sta.Operand != *expected.Operand {
+		t.Error(fmt.Sprintf("expected operand $0200, got %s", out))
+	}
+	sta.Operand = expected.Operand
+	if sta != expected {
+		t.Error(fmt.Sprintf("expected %+v, got %+v", expected, sta))
+	}
+	if doc.Instructions[2].Label != "Start" || *doc.Instructions[2].Operand != 0xc000 {
+		t.Error(fmt.Sprintf("expected bne to target Start at $c000, got %+v", doc.Instructions[2]))
+	}
+	expectedData := []dataJson{
+		{0xc007, 3, 7, "data"},
+		{0xc00a, 4, 8, "reserve"},
+		{0xc00e, 2, 9, "align"},
+	}
+	if len(doc.Data) != len(expectedData) {
+		t.Fatal(fmt.Sprintf("expected %+v, got %+v", expectedData, doc.Data))
+	}
+	for i, d := range expectedData {
+		if doc.Data[i] != d {
+			t.Error(fmt.Sprintf("expected %+v, got %+v", d, doc.Data[i]))
+		}
+	}
+	if doc.Labels["Table"] != 0xc007 {
+		t.Error(fmt.Sprintf("expected Table at $c007, got %+v", doc.Labels))
+	}
+}
+
+func TestDisassembleSymbols(t *testing.T) {
+	source := ".org $c000\nReset_Routine:\njsr Sub1\njsr Sub2\nLoop:\njmp Loop\n" +
+		"Sub1:\nrts\nSub2:\nrts\nNMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	bin, err := assembleSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := map[int]string{
+		0xc000: "Start",
+		0xc006: "Forever",
+		0xc009: "PlaySound",
+	}
+	program, err := DisassembleWithOptions(bytes.NewReader(bin), DisassembleOptions{Symbols: symbols})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, name := range symbols {
+		labelAddr, ok := program.Labels[name]
+		if !ok || labelAddr != addr {
+			t.Error(fmt.Sprintf("expected label %s at $%04x, got %t $%04x", name, addr, ok, labelAddr))
+		}
+	}
+	i, ok := program.Offsets[0xc000].Value.(*Instruction)
+	if !ok || i.LabelName != "PlaySound" {
+		t.Error(fmt.Sprintf("expected jsr PlaySound at $c000, got %#v", program.Offsets[0xc000].Value))
+	}
+	// not in the symbol map
+	i, ok = program.Offsets[0xc003].Value.(*Instruction)
+	if !ok || i.LabelName != "Label_c00a" {
+		t.Error(fmt.Sprintf("expected jsr Label_c00a at $c003, got %#v", program.Offsets[0xc003].Value))
+	}
+}
+
+func TestDisassembleBranches(t *testing.T) {
+	// bne goes back 3 bytes, and beq forward 1, from the end of the branch
+	source := ".org $c000\nReset_Routine:\nldx #$03\nBack:\ndex\nbne Back\nbeq Forward\nnop\nForward:\nrts\n" +
+		"NMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	bin, err := assembleSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin[4] != 0xfd || bin[6] != 0x01 {
+		t.Fatal(fmt.Sprintf("unexpected branch operands: % x", bin[:9]))
+	}
+	program, err := Disassemble(bytes.NewReader(bin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	branches := []struct {
+		addr   int
+		target int
+	}{
+		{0xc003, 0xc002},
+		{0xc005, 0xc008},
+	}
+	for _, b := range branches {
+		i, ok := program.Offsets[b.addr].Value.(*Instruction)
+		if !ok || i.Value != b.target {
+			t.Error(fmt.Sprintf("expected a branch to $%04x at $%04x, got %#v", b.target, b.addr, program.Offsets[b.addr].Value))
+			continue
+		}
+		labelAddr, ok := program.Labels[i.LabelName]
+		if !ok || labelAddr != b.target {
+			t.Error(fmt.Sprintf("expected label %s at $%04x, got %t $%04x", i.LabelName, b.target, ok, labelAddr))
+		}
+	}
+}
+
+func TestDisassembleEntryPoints(t *testing.T) {
+	// Table looks like lda #$01, rts but is never run, and Handler is
+	// only reached through the indirect jump
+	source := ".org $c000\nReset_Routine:\njmp ($0200)\n" +
+		"Table:\ndc.b $a9, $01, $60\nHandler:\nlda #$02\nrts\n" +
+		"NMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	bin, err := assembleSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isInstruction := func(program *Program, addr int) bool {
+		elem, ok := program.Offsets[addr]
+		if !ok {
+			return false
+		}
+		_, ok = elem.Value.(*Instruction)
+		return ok
+	}
+
+	program, err := Disassemble(bytes.NewReader(bin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isInstruction(program, 0xc003) || isInstruction(program, 0xc006) {
+		t.Error("expected the code after an indirect jump to be left as data")
+	}
+
+	program, err = DisassembleWithOptions(bytes.NewReader(bin), DisassembleOptions{EntryPoints: []int{0xc006}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isInstruction(program, 0xc003) {
+		t.Error("expected the table at $c003 to be data")
+	}
+	if !isInstruction(program, 0xc006) || !isInstruction(program, 0xc008) {
+		t.Error("expected the entry point at $c006 to be disassembled")
+	}
+	if program.Labels["Label_c006"] != 0xc006 {
+		t.Error("expected a label at the entry point")
+	}
+
+	_, err = DisassembleWithOptions(bytes.NewReader(bin), DisassembleOptions{EntryPoints: []int{0x0200}})
+	if err == nil {
+		t.Error("expected an error for an entry point outside of PRG ROM")
+	}
+}
+
+func TestProgramClone(t *testing.T) {
+	source := "WIDTH = 8\n.org $c000\nStart:\nlda #WIDTH\ndc.w Start\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	expected := new(bytes.Buffer)
+	err = program.Assemble(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := program.Clone()
+	clone.Variables["WIDTH"] = 16
+	clone.Labels["Start"] = 0x8000
+	for e := clone.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok {
+			i.Value = 16
+			i.Payload[1] = 16
+		}
+	}
+	if clone.Offsets[0xc000].Value == program.Offsets[0xc000].Value {
+		t.Error("clone shares its statements with the original")
+	}
+
+	if program.Variables["WIDTH"] != 8 || program.Labels["Start"] != 0xc000 {
+		t.Error(fmt.Sprintf("original changed: %v %v", program.Variables, program.Labels))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+		t.Error(fmt.Sprintf("original assembles to % x, expected % x", buf.Bytes(), expected.Bytes()))
+	}
+	buf.Reset()
+	err = clone.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0xa9, 0x10, 0x00, 0x80}) {
+		t.Error(fmt.Sprintf("clone assembles to % x", buf.Bytes()))
+	}
+}
@@ -18,9 +18,18 @@ type Program struct {
 	ChrRom    [][]byte
 	PrgRom    [][]byte
 	Mirroring Mirroring
+	Mapper    byte
 	// maps memory offset to element in Ast
 	Offsets    map[int]*list.Element
 	Variables map[string]int
+	Warnings  []string
+	// the number of bytes from each label to the next label, or to the
+	// next org statement. filled in by Resolve.
+	LabelSizes map[string]int
+	// the value of the last .fillvalue, which pads the ROM as well
+	FillValue byte
+	// ProgramAst.Files
+	files map[interface{}]string
 }
 
 type Assembler interface {
@@ -36,6 +45,16 @@ type symbolGetter interface {
 	getSymbol(string, int) (int, bool)
 }
 
+// a symbolGetter which can also evaluate sizeof
+type sizeGetter interface {
+	getSize(string) (int, bool)
+}
+
+func (p *Program) getSize(name string) (int, bool) {
+	size, ok := p.LabelSizes[name]
+	return size, ok
+}
+
 func (i *Instruction) GetPayload() []byte {
 	return i.Payload
 }
@@ -52,6 +71,11 @@ func (i *Instruction) SetOffset(offset int) {
 	i.Offset = offset
 }
 
+// base cycle count of the instruction. must be called after Resolve.
+func (i *Instruction) Cycles() int {
+	return opCodeCycles[i.OpCode]
+}
+
 func (s *DataStatement) GetPayload() []byte {
 	return s.Payload
 }
@@ -68,6 +92,63 @@ func (s *DataStatement) SetOffset(offset int) {
 	s.Offset = offset
 }
 
+func (s *AlignStatement) GetPayload() []byte {
+	return s.Payload
+}
+
+func (s *AlignStatement) GetLine() int {
+	return s.Line
+}
+
+func (s *AlignStatement) GetOffset() int {
+	return s.Offset
+}
+
+func (s *AlignStatement) SetOffset(offset int) {
+	s.Offset = offset
+}
+
+func (s *AlignStatement) Resolve() error {
+	size := -s.Offset & (s.Value - 1)
+	s.Payload = make([]byte, size)
+	for i := range s.Payload {
+		s.Payload[i] = s.Fill
+	}
+	return nil
+}
+
+func (s *AlignStatement) Assemble(sg symbolGetter) error {
+	return nil
+}
+
+func (s *ReserveStatement) GetPayload() []byte {
+	return s.Payload
+}
+
+func (s *ReserveStatement) GetLine() int {
+	return s.Line
+}
+
+func (s *ReserveStatement) GetOffset() int {
+	return s.Offset
+}
+
+func (s *ReserveStatement) SetOffset(offset int) {
+	s.Offset = offset
+}
+
+func (s *ReserveStatement) Resolve() error {
+	s.Payload = make([]byte, s.Size)
+	for i := range s.Payload {
+		s.Payload[i] = s.Fill
+	}
+	return nil
+}
+
+func (s *ReserveStatement) Assemble(sg symbolGetter) error {
+	return nil
+}
+
 func (p *Program) getSymbol(name string, offset int) (int, bool) {
 	if name == "." {
 		return offset, true
@@ -81,8 +162,150 @@ func (p *Program) getSymbol(name string, offset int) (int, bool) {
 	return value, ok
 }
 
-// computes OpCode, Payload, and Size
+func (b *ByteExpr) apply(value int) int {
+	if b.High {
+		return (value >> 8) & 0xff
+	}
+	return value & 0xff
+}
+
+func (op ExprOperator) apply(left int, right int) int {
+	switch op {
+	default: panic("unexpected ExprOperator")
+	case AddOperator:
+		return left + right
+	case SubOperator:
+		return left - right
+	case MulOperator:
+		return left * right
+	case DivOperator:
+		return left / right
+	}
+}
+
+// evaluates an operand expression, looking up any symbols it references
+func evalExpr(node interface{}, sg symbolGetter, offset int, line int) (int, error) {
+	switch t := node.(type) {
+	case *IntegerDataItem:
+		return int(*t), nil
+	case *LabelCall:
+		value, ok := sg.getSymbol(t.LabelName, offset)
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("Line %d: Undefined symbol: %s", line, t.LabelName))
+		}
+		return value, nil
+	case *BinaryExpr:
+		left, err := evalExpr(t.Left, sg, offset, line)
+		if err != nil {
+			return 0, err
+		}
+		right, err := evalExpr(t.Right, sg, offset, line)
+		if err != nil {
+			return 0, err
+		}
+		if t.Op == DivOperator && right == 0 {
+			return 0, errors.New(fmt.Sprintf("Line %d: Division by zero.", line))
+		}
+		return t.Op.apply(left, right), nil
+	case *ByteExpr:
+		value, err := evalExpr(t.Expr, sg, offset, line)
+		if err != nil {
+			return 0, err
+		}
+		return t.apply(value), nil
+	case *SizeofExpr:
+		sizes, ok := sg.(sizeGetter)
+		if ok {
+			size, ok := sizes.getSize(t.LabelName)
+			if ok {
+				return size, nil
+			}
+		}
+		return 0, errors.New(fmt.Sprintf("Line %d: Unknown size of %s", line, t.LabelName))
+	}
+	panic("unexpected expression node")
+}
+
+// symbolGetter which only knows about variables defined so far
+type variableGetter map[string]int
+
+func (vars variableGetter) getSymbol(name string, offset int) (int, bool) {
+	value, ok := vars[name]
+	return value, ok
+}
+
+// replaces an operand which only refers to variables with its value,
+// so that the instruction can be sized correctly
+func (i *Instruction) substituteVariables(vars variableGetter) {
+	expr := i.Expr
+	if i.LabelName != "" {
+		expr = &LabelCall{i.LabelName}
+	}
+	if expr == nil {
+		return
+	}
+	value, err := evalExpr(expr, vars, i.Offset, i.Line)
+	if err != nil {
+		// refers to a label; wait until labels have addresses
+		return
+	}
+	_, isBranch := opNameToOpCode[relativeAddr][strings.ToLower(i.OpName)]
+	if isBranch {
+		return
+	}
+	i.Value = value
+	i.Expr = nil
+	i.LabelName = ""
+	switch i.Type {
+	case DirectWithLabelInstruction:
+		i.Type = DirectInstruction
+	case DirectWithLabelIndexedInstruction:
+		i.Type = DirectIndexedInstruction
+	}
+}
+
+func (s *DataStatement) substituteVariables(vars variableGetter) {
+	for e := s.dataList.Front(); e != nil; e = e.Next() {
+		switch e.Value.(type) {
+		case *LabelCall, *BinaryExpr, *SizeofExpr, *ByteExpr:
+			value, err := evalExpr(e.Value, vars, s.Offset, s.Line)
+			if err == nil {
+				tmp := IntegerDataItem(value)
+				e.Value = &tmp
+			}
+		}
+	}
+}
+
+// computes OpCode, AddressingMode, Payload, and Size
 func (i *Instruction) Resolve() error {
+	err := i.resolveOpCode()
+	if err != nil {
+		return err
+	}
+	i.AddressingMode = AddressingMode(opCodeTable[i.OpCode].addrMode)
+	return nil
+}
+
+// immediates may be written as signed or unsigned bytes
+func isImmediateValue(value int) bool {
+	return -0x80 <= value && value <= 0xff
+}
+
+func isZeroPage(addr int) bool {
+	return 0 <= addr && addr <= 0xff
+}
+
+// the instructions with an accumulator form, such as asl a
+func hasAccumulatorMode(opName string) bool {
+	switch strings.ToLower(opName) {
+	case "asl", "lsr", "rol", "ror":
+		return true
+	}
+	return false
+}
+
+func (i *Instruction) resolveOpCode() error {
 	var ok bool
 	lowerOpName := strings.ToLower(i.OpName)
 	switch i.Type {
@@ -92,7 +315,7 @@ func (i *Instruction) Resolve() error {
 		if !ok {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized immediate instruction: %s", i.Line, i.OpName))
 		}
-		if i.Value > 0xff {
+		if i.Expr == nil && !isImmediateValue(i.Value) {
 			return errors.New(fmt.Sprintf("Line %d: Immediate instruction argument must be a 1 byte integer.", i.Line))
 		}
 		i.Payload = []byte{i.OpCode, byte(i.Value)}
@@ -102,18 +325,19 @@ func (i *Instruction) Resolve() error {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized implied instruction: %s", i.Line, i.OpName))
 		}
 		i.Payload = []byte{i.OpCode}
+	case AccumulatorInstruction:
+		// the op code table calls this mode implied
+		i.OpCode, ok = opNameToOpCode[impliedAddr][lowerOpName]
+		if !ok || !hasAccumulatorMode(i.OpName) {
+			return errors.New(fmt.Sprintf("Line %d: Unrecognized accumulator instruction: %s", i.Line, i.OpName))
+		}
+		i.Payload = []byte{i.OpCode}
 	case DirectInstruction:
-		// try indirect
-		i.OpCode, ok = opNameToOpCode[indirectAddr][lowerOpName]
-		if ok {
-			if i.Value > 0xff {
-				return errors.New(fmt.Sprintf("Line %d: Relative memory address is limited to 1 byte.", i.Line))
-			}
-			i.Payload = []byte{i.OpCode, byte(i.Value)}
-			return nil
+		if i.Value < 0 {
+			return errors.New(fmt.Sprintf("Line %d: Memory address %d is negative.", i.Line, i.Value))
 		}
 		// try zero page
-		if i.Value <= 0xff {
+		if i.Value <= 0xff && !i.ForceAbsolute {
 			i.OpCode, ok = opNameToOpCode[zeroPageAddr][lowerOpName]
 			if ok {
 				i.Payload = []byte{i.OpCode, byte(i.Value)}
@@ -146,9 +370,12 @@ func (i *Instruction) Resolve() error {
 		}
 		return errors.New(fmt.Sprintf("Line %d: Unrecognized direct instruction: %s", i.Line, i.OpName))
 	case DirectIndexedInstruction:
+		if i.Value < 0 {
+			return errors.New(fmt.Sprintf("Line %d: Memory address %d is negative.", i.Line, i.Value))
+		}
 		lowerRegName := strings.ToLower(i.RegisterName)
 		if lowerRegName == "x" {
-			if i.Value <= 0xff {
+			if i.Value <= 0xff && !i.ForceAbsolute {
 				i.OpCode, ok = opNameToOpCode[zeroXIndexAddr][lowerOpName]
 				if ok {
 					i.Payload = []byte{i.OpCode, byte(i.Value)}
@@ -163,9 +390,13 @@ func (i *Instruction) Resolve() error {
 				binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 				return nil
 			}
+			_, ok = opNameToOpCode[zeroXIndexAddr][lowerOpName]
+			if ok {
+				return errors.New(fmt.Sprintf("Line %d: Zero page address is limited to 1 byte, and %s has no absolute, X mode.", i.Line, i.OpName))
+			}
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized absolute, X instruction: %s", i.Line, i.OpName))
 		} else if lowerRegName == "y" {
-			if i.Value <= 0xff {
+			if i.Value <= 0xff && !i.ForceAbsolute {
 				i.OpCode, ok = opNameToOpCode[zeroYIndexAddr][lowerOpName]
 				if ok {
 					i.Payload = []byte{i.OpCode, byte(i.Value)}
@@ -175,11 +406,15 @@ func (i *Instruction) Resolve() error {
 				return errors.New(fmt.Sprintf("Line %d: Absolute memory address is limited to 2 bytes.", i.Line))
 			}
 			i.OpCode, ok = opNameToOpCode[absYAddr][lowerOpName]
-			if !ok {
+			if ok {
 				i.Payload = []byte{i.OpCode, 0, 0}
 				binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 				return nil
 			}
+			_, ok = opNameToOpCode[zeroYIndexAddr][lowerOpName]
+			if ok {
+				return errors.New(fmt.Sprintf("Line %d: Zero page address is limited to 1 byte, and %s has no absolute, Y mode.", i.Line, i.OpName))
+			}
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized absolute, Y instruction: %s", i.Line, i.OpName))
 		}
 		return errors.New(fmt.Sprintf("Line %d: Register argument must be X or Y", i.Line))
@@ -195,7 +430,7 @@ func (i *Instruction) Resolve() error {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized direct, X instruction: %s", i.Line, i.OpName))
 		} else if lowerRegName == "y" {
 			i.OpCode, ok = opNameToOpCode[absYAddr][lowerOpName]
-			if !ok {
+			if ok {
 				// 0s are placeholder until we resolve labels
 				i.Payload = []byte{i.OpCode, 0, 0}
 				return nil
@@ -208,7 +443,7 @@ func (i *Instruction) Resolve() error {
 		if !ok {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized indirect x indexed instruction: %s", i.Line, i.OpName))
 		}
-		if i.Value > 0xff {
+		if i.Expr == nil && !isZeroPage(i.Value) {
 			return errors.New(fmt.Sprintf("Line %d: Indirect X memory address is limited to 1 byte.", i.Line))
 		}
 		i.Payload = []byte{i.OpCode, byte(i.Value)}
@@ -217,16 +452,17 @@ func (i *Instruction) Resolve() error {
 		if !ok {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized indirect y indexed instruction: %s", i.Line, i.OpName))
 		}
-		if i.Value > 0xff {
+		if i.Expr == nil && !isZeroPage(i.Value) {
 			return errors.New(fmt.Sprintf("Line %d: Indirect Y memory address is limited to 1 byte.", i.Line))
 		}
 		i.Payload = []byte{i.OpCode, byte(i.Value)}
 	case IndirectInstruction:
-		if lowerOpName != "jmp" {
+		i.OpCode, ok = opNameToOpCode[indirectAddr][lowerOpName]
+		if !ok {
 			return errors.New(fmt.Sprintf("Line %d: Unrecognized indirect instruction: %s", i.Line, i.OpName))
 		}
-		i.Payload = []byte{0x6c, 0, 0}
-		if i.Value > 0xffff {
+		i.Payload = []byte{i.OpCode, 0, 0}
+		if i.Expr == nil && i.Value > 0xffff {
 			return errors.New(fmt.Sprintf("Line %d: Memory address is limited to 2 bytes.", i.Line))
 		}
 		binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
@@ -234,28 +470,85 @@ func (i *Instruction) Resolve() error {
 	return nil
 }
 
+// symbols for encoding a single instruction, where . is its address
+type symbolMap map[string]int
+
+func (symbols symbolMap) getSymbol(name string, offset int) (int, bool) {
+	if name == "." {
+		return offset, true
+	}
+	value, ok := symbols[name]
+	return value, ok
+}
+
+// encodes the instruction on its own as if it were at pc, looking up the
+// labels in its operand in symbols. a label always gets an absolute or
+// relative mode, as it does in a program. i is not changed.
+func (i *Instruction) Bytes(symbols map[string]int, pc int) ([]byte, error) {
+	copied := *i
+	copied.Offset = pc
+	err := copied.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	err = copied.Assemble(symbolMap(symbols))
+	if err != nil {
+		return nil, err
+	}
+	return copied.Payload, nil
+}
+
 func (i *Instruction) Assemble(sg symbolGetter) error {
 	// fill in the rest of the payload
 	var ok bool
+	symbolName := i.LabelName
+	if i.Expr != nil {
+		var err error
+		i.Value, err = evalExpr(i.Expr, sg, i.Offset, i.Line)
+		if err != nil {
+			return err
+		}
+		symbolName = renderExpr(i.Expr)
+	}
 	switch i.Type {
 	default: panic("unexpected instruction type")
-	case ImmediateInstruction, ImpliedInstruction, DirectInstruction,
-		DirectIndexedInstruction, IndirectXInstruction, IndirectYInstruction,
-		IndirectInstruction:
+	case ImpliedInstruction, AccumulatorInstruction, DirectInstruction, DirectIndexedInstruction:
 		// nothing to do
+	case ImmediateInstruction:
+		if !isImmediateValue(i.Value) {
+			return errors.New(fmt.Sprintf("Line %d: Immediate instruction argument must be a 1 byte integer.", i.Line))
+		}
+		i.Payload[1] = byte(i.Value)
+	case IndirectXInstruction:
+		if !isZeroPage(i.Value) {
+			return errors.New(fmt.Sprintf("Line %d: Indirect X memory address is limited to 1 byte.", i.Line))
+		}
+		i.Payload[1] = byte(i.Value)
+	case IndirectYInstruction:
+		if !isZeroPage(i.Value) {
+			return errors.New(fmt.Sprintf("Line %d: Indirect Y memory address is limited to 1 byte.", i.Line))
+		}
+		i.Payload[1] = byte(i.Value)
+	case IndirectInstruction:
+		if i.Value < 0 || i.Value > 0xffff {
+			return errors.New(fmt.Sprintf("Line %d: Memory address is limited to 2 bytes.", i.Line))
+		}
+		binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 	case DirectWithLabelInstruction:
-		i.Value, ok = sg.getSymbol(i.LabelName, i.Offset)
-		if !ok {
-			return errors.New(fmt.Sprintf("Line %d: Undefined label: %s", i.Line, i.LabelName))
+		if i.Expr == nil {
+			i.Value, ok = sg.getSymbol(i.LabelName, i.Offset)
+			if !ok {
+				return errors.New(fmt.Sprintf("Line %d: Undefined label: %s", i.Line, i.LabelName))
+			}
 		}
 		if i.Value > 0xffff {
-			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, i.LabelName))
+			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, symbolName))
 		}
 		if len(i.Payload) == 2 {
 			// relative address
 			delta := i.Value - (i.Offset + len(i.Payload))
 			if delta > 127 || delta < -128 {
-				return errors.New(fmt.Sprintf("Line %d: Label address must be within 127 bytes of instruction address.", i.Line))
+				return errors.New(fmt.Sprintf("Line %d: Branch to %s is %d bytes away, but branches can only reach -128 to +127 bytes. Try branching to a nearby jmp %s instead.", i.Line, symbolName, delta, symbolName))
 			}
 			i.Payload[1] = byte(delta)
 			return nil
@@ -263,12 +556,14 @@ func (i *Instruction) Assemble(sg symbolGetter) error {
 		// absolute address
 		binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 	case DirectWithLabelIndexedInstruction:
-		i.Value, ok = sg.getSymbol(i.LabelName, i.Offset)
-		if !ok {
-			return errors.New(fmt.Sprintf("Line %d: Undefined symbol: %s", i.Line, i.LabelName))
+		if i.Expr == nil {
+			i.Value, ok = sg.getSymbol(i.LabelName, i.Offset)
+			if !ok {
+				return errors.New(fmt.Sprintf("Line %d: Undefined symbol: %s", i.Line, i.LabelName))
+			}
 		}
 		if i.Value > 0xffff {
-			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, i.LabelName))
+			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, symbolName))
 		}
 		binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 	}
@@ -291,21 +586,21 @@ func (s *DataStatement) Resolve() error {
 			switch s.Type {
 			default: panic("unknown DataStatement Type")
 			case ByteDataStmt:
-				if *t > 0xff {
+				if *t < 0 || *t > 0xff {
 					return errors.New(fmt.Sprintf("Line %d: Integer byte data item limited to 1 byte.", s.Line))
 				}
 				size += 1
 			case WordDataStmt:
-				if *t > 0xffff {
+				if *t < 0 || *t > 0xffff {
 					return errors.New(fmt.Sprintf("Line %d: Integer word data item limited to 2 bytes.", s.Line))
 				}
 				size += 2
 			}
-		case *LabelCall:
+		case *LabelCall, *BinaryExpr, *SizeofExpr, *ByteExpr:
 			switch s.Type {
 			default: panic("unknown DataStatement Type")
 			case ByteDataStmt:
-				return errors.New(fmt.Sprintf("Line %d: label invalid in byte data statement.", s.Line))
+				size += 1
 			case WordDataStmt:
 				size += 2
 			}
@@ -325,10 +620,7 @@ func (s *DataStatement) Assemble(sg symbolGetter) error {
 			if s.Type != ByteDataStmt {
 				panic("expected ByteDataStmt")
 			}
-			for _, c := range string(*t) {
-				s.Payload[offset] = byte(c)
-				offset += 1
-			}
+			offset += copy(s.Payload[offset:], *t)
 		case *IntegerDataItem:
 			switch s.Type {
 			default: panic("unknown DataStatement Type")
@@ -336,22 +628,32 @@ func (s *DataStatement) Assemble(sg symbolGetter) error {
 				s.Payload[offset] = byte(*t)
 				offset += 1
 			case WordDataStmt:
-				binary.LittleEndian.PutUint16(s.Payload[offset:], uint16(*t))
+				s.putWord(offset, *t)
 				offset += 2
 			}
-		case *LabelCall:
-			if s.Type != WordDataStmt {
-				panic("expected WordDataStmt")
-			}
-			symbolValue, ok := sg.getSymbol(t.LabelName, offset)
-			if !ok {
-				return errors.New(fmt.Sprintf("Line %d: Undefined symbol: %s", s.Line, t.LabelName))
+		case *LabelCall, *BinaryExpr, *SizeofExpr, *ByteExpr:
+			value, err := evalExpr(t, sg, s.Offset+offset, s.Line)
+			if err != nil {
+				return err
 			}
-			if symbolValue > 0xffff {
-				return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", s.Line, t.LabelName))
+			switch s.Type {
+			default: panic("unknown DataStatement Type")
+			case ByteDataStmt:
+				if value < 0 {
+					return errors.New(fmt.Sprintf("Line %d: Byte data item %s is %d, which is negative.", s.Line, renderExpr(t), value))
+				}
+				if value > 0xff {
+					return errors.New(fmt.Sprintf("Line %d: Byte data item %s is $%04x, which doesn't fit in 1 byte.", s.Line, renderExpr(t), value))
+				}
+				s.Payload[offset] = byte(value)
+				offset += 1
+			case WordDataStmt:
+				if value < 0 || value > 0xffff {
+					return errors.New(fmt.Sprintf("Line %d: Integer word data item limited to 2 bytes.", s.Line))
+				}
+				s.putWord(offset, IntegerDataItem(value))
+				offset += 2
 			}
-			binary.LittleEndian.PutUint16(s.Payload[offset:], uint16(symbolValue))
-			offset += 2
 		default:
 			panic("unknown data item type")
 		}
@@ -359,49 +661,69 @@ func (s *DataStatement) Assemble(sg symbolGetter) error {
 	return nil
 }
 
+func (s *DataStatement) putWord(offset int, value IntegerDataItem) {
+	if s.BigEndian {
+		binary.BigEndian.PutUint16(s.Payload[offset:], uint16(value))
+	} else {
+		binary.LittleEndian.PutUint16(s.Payload[offset:], uint16(value))
+	}
+}
+
 func (p *Program) Assemble(w io.Writer) error {
-	writer := bufio.NewWriter(w)
+	iw := &imageWriter{writer: bufio.NewWriter(w), firstOrg: true}
+	err := iw.write(p, p.List.Front(), nil)
+	if err != nil {
+		return err
+	}
+	iw.writer.Flush()
+	return nil
+}
 
-	offset := 0
-	expectedOffset := 0
-	firstOrg := true
-	orgFillValue := byte(0)
+// where an image being assembled is up to
+type imageWriter struct {
+	writer         *bufio.Writer
+	offset         int
+	expectedOffset int
+	firstOrg       bool
+	orgFillValue   byte
+}
 
-	for e := p.List.Front(); e != nil; e = e.Next() {
+// writes the statements from first up to stop, or to the end of the
+// program if stop is nil, filling the gaps between them
+func (iw *imageWriter) write(p *Program, first *list.Element, stop *list.Element) error {
+	for e := first; e != stop; e = e.Next() {
 		switch t := e.Value.(type) {
 		default: panic("unexpected node")
-		case *LabelStatement:
+		case *LabelStatement, *AssignStatement:
 			// nothing to do
 		case *OrgPseudoOp:
-			offset = t.Value
-			orgFillValue = t.Fill
-			if firstOrg {
-				firstOrg = false
-				expectedOffset = offset
+			iw.offset = t.Value
+			iw.orgFillValue = t.Fill
+			if iw.firstOrg {
+				iw.firstOrg = false
+				iw.expectedOffset = iw.offset
 			}
 		case Assembler:
-			for t.GetOffset() > expectedOffset {
+			for t.GetOffset() > iw.expectedOffset {
 				// org fill
-				err := writer.WriteByte(orgFillValue)
+				err := iw.writer.WriteByte(iw.orgFillValue)
 				if err != nil {
 					return err
 				}
-				expectedOffset += 1
+				iw.expectedOffset += 1
 			}
 			err := t.Assemble(p)
 			if err != nil {
 				return err
 			}
-			_, err = writer.Write(t.GetPayload())
+			_, err = iw.writer.Write(t.GetPayload())
 			if err != nil {
 				return err
 			}
-			offset += len(t.GetPayload())
-			expectedOffset = offset
+			iw.offset += len(t.GetPayload())
+			iw.expectedOffset = iw.offset
 		}
 	}
-
-	writer.Flush()
 	return nil
 }
 
@@ -423,10 +745,144 @@ func (p *Program) AssembleToFile(filename string) error {
 	return nil
 }
 
+// the lowest and highest addresses which the program puts bytes at,
+// whatever order its org sections are in. both are -1 if it has none.
+func (p *Program) AddressRange() (lo, hi int) {
+	lo, hi = -1, -1
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		t, ok := e.Value.(Assembler)
+		if !ok {
+			continue
+		}
+		size := len(t.GetPayload())
+		if size == 0 {
+			continue
+		}
+		if lo < 0 || t.GetOffset() < lo {
+			lo = t.GetOffset()
+		}
+		if t.GetOffset()+size-1 > hi {
+			hi = t.GetOffset() + size - 1
+		}
+	}
+	return lo, hi
+}
+
+// assembles the program into a single image spanning the lowest to the
+// highest address written. unlike Assemble, the org statements may be in
+// any order, and every gap is set to fill.
+func (p *Program) WriteBinary(w io.Writer, fill byte) error {
+	start, end := p.AddressRange()
+	if start < 0 {
+		return nil
+	}
+
+	image := make([]byte, end-start+1)
+	for i := range image {
+		image[i] = fill
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		t, ok := e.Value.(Assembler)
+		if !ok {
+			continue
+		}
+		err := t.Assemble(p)
+		if err != nil {
+			return err
+		}
+		copy(image[t.GetOffset()-start:], t.GetPayload())
+	}
+	_, err := w.Write(image)
+	return err
+}
+
+// straight line estimate of the cycles taken to run every instruction
+// in the program once, assuming no page boundaries are crossed and no
+// branches are taken.
+func (p *Program) TotalCycles() int {
+	return p.EstimateCycles(0)
+}
+
+// like TotalCycles, but adds pageCrossCycles for every indexed read and
+// branch, which may take longer depending on the addresses involved.
+func (p *Program) EstimateCycles(pageCrossCycles int) int {
+	total := 0
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			continue
+		}
+		total += i.Cycles()
+		if opCodeMayCrossPage(i.OpCode) {
+			total += pageCrossCycles
+		}
+	}
+	return total
+}
+
+// stands in for the target of an indirect jmp in CallGraph, since jump
+// tables are how 6502 code calls through a pointer
+const IndirectCallTarget = "(indirect)"
+
+// maps each label to the subroutines which the code following it calls
+// with jsr, in the order they are first called. local labels belong to
+// the label they are scoped to, and code before the first label is left
+// out. calls to an address with no label are named by the address.
+func (p *Program) CallGraph() map[string][]string {
+	addrLabels := make(map[int]string)
+	for name, addr := range p.Labels {
+		existing, ok := addrLabels[addr]
+		if !ok || name < existing {
+			addrLabels[addr] = name
+		}
+	}
+	graph := make(map[string][]string)
+	addEdge := func(from string, to string) {
+		for _, existing := range graph[from] {
+			if existing == to {
+				return
+			}
+		}
+		graph[from] = append(graph[from], to)
+	}
+
+	caller := ""
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement:
+			if !strings.Contains(t.LabelName, "@") && !strings.HasPrefix(t.LabelName, ".") {
+				caller = t.LabelName
+			}
+		case *Instruction:
+			if caller == "" {
+				continue
+			}
+			switch {
+			case opNameIs(t, "jsr") && t.LabelName != "":
+				addEdge(caller, t.LabelName)
+			case opNameIs(t, "jsr"):
+				target, ok := addrLabels[t.Value]
+				if !ok {
+					target = fmt.Sprintf("$%04x", t.Value)
+				}
+				addEdge(caller, target)
+			case opNameIs(t, "jmp") && t.Type == IndirectInstruction:
+				addEdge(caller, IndirectCallTarget)
+			}
+		}
+	}
+	return graph
+}
+
 func (ast ProgramAst) ExpandLabeledStatements() {
 	for e := ast.List.Front(); e != nil; e = e.Next() {
 		s, ok := e.Value.(*LabeledStatement)
 		if ok {
+			file, included := ast.Files[s]
+			if included {
+				ast.Files[s.Label] = file
+				ast.Files[s.Stmt] = file
+			}
 			elemToDel := e
 			e = ast.List.InsertAfter(s.Label, e)
 			e = ast.List.InsertAfter(s.Stmt, e)
@@ -435,39 +891,392 @@ func (ast ProgramAst) ExpandLabeledStatements() {
 	}
 }
 
+func isLocalLabel(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+func qualifyLabel(scope string, name string) string {
+	if isLocalLabel(name) {
+		return scope + name
+	}
+	return name
+}
+
+func qualifyExpr(scope string, node interface{}) {
+	switch t := node.(type) {
+	case *LabelCall:
+		t.LabelName = qualifyLabel(scope, t.LabelName)
+	case *SizeofExpr:
+		t.LabelName = qualifyLabel(scope, t.LabelName)
+	case *BinaryExpr:
+		qualifyExpr(scope, t.Left)
+		qualifyExpr(scope, t.Right)
+	case *ByteExpr:
+		qualifyExpr(scope, t.Expr)
+	}
+}
+
+// prefixes local labels such as @loop with the most recent global label,
+// so that each routine can reuse the same local names
+func (ast ProgramAst) QualifyLocalLabels() {
+	scope := ""
+	for e := ast.List.Front(); e != nil; e = e.Next() {
+		scope = qualifyStatement(scope, e.Value)
+	}
+}
+
+// qualifies the local labels in one statement, returning the scope for
+// the statements after it
+func qualifyStatement(scope string, stmt interface{}) string {
+	switch t := stmt.(type) {
+	case *LabelStatement:
+		if isLocalLabel(t.LabelName) {
+			t.LabelName = scope + t.LabelName
+		} else {
+			scope = t.LabelName
+		}
+	case *Instruction:
+		t.LabelName = qualifyLabel(scope, t.LabelName)
+		qualifyExpr(scope, t.Expr)
+	case *DataStatement:
+		for de := t.dataList.Front(); de != nil; de = de.Next() {
+			qualifyExpr(scope, de.Value)
+		}
+	case *AssignStatement:
+		qualifyExpr(scope, t.Expr)
+	}
+	return scope
+}
+
+// evaluates assignments such as SCREEN_END = SCREEN + 256, following
+// the variables they refer to so that definition order doesn't matter.
+// a variable which is redefined, as in COUNT = COUNT + 1, refers to its
+// latest definition before the statement using it.
+// unless labels are known, assignments which need one are left alone.
+type assignResolver struct {
+	p      *Program
+	labels bool
+	// every definition of each name, in program order
+	defs  map[string][]*AssignStatement
+	order map[*AssignStatement]int
+	// definitions being evaluated, to detect circular definitions
+	stack []*AssignStatement
+}
+
+func (p *Program) resolveAssignments(labels bool) error {
+	r := &assignResolver{
+		p:      p,
+		labels: labels,
+		defs:   map[string][]*AssignStatement{},
+		order:  map[*AssignStatement]int{},
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		s, ok := e.Value.(*AssignStatement)
+		if ok {
+			r.order[s] = len(r.order)
+			r.defs[s.VarName] = append(r.defs[s.VarName], s)
+		}
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		s, ok := e.Value.(*AssignStatement)
+		if ok {
+			err := r.resolve(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the definition of name seen by the assignment being evaluated: the
+// latest one before it, or else the first one after it
+func (r *assignResolver) def(name string) (*AssignStatement, bool) {
+	defs := r.defs[name]
+	if len(defs) == 0 {
+		return nil, false
+	}
+	if len(r.stack) == 0 {
+		return defs[len(defs)-1], true
+	}
+	from := r.order[r.stack[len(r.stack)-1]]
+	def := defs[0]
+	for _, d := range defs {
+		if r.order[d] < from {
+			def = d
+		}
+	}
+	return def, true
+}
+
+func (r *assignResolver) resolve(s *AssignStatement) error {
+	if s.Expr == nil {
+		return nil
+	}
+	for i, d := range r.stack {
+		if d == s {
+			names := []string{}
+			for _, d := range r.stack[i:] {
+				names = append(names, d.VarName)
+			}
+			cycle := strings.Join(append(names, s.VarName), " -> ")
+			return errors.New(r.p.errorIn(s, fmt.Sprintf("Line %d: Circular definition: %s", s.Line, cycle)))
+		}
+	}
+	r.stack = append(r.stack, s)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+	err := r.resolveExpr(s.Expr)
+	if err != nil {
+		return err
+	}
+	value, err := evalExpr(s.Expr, r, 0, s.Line)
+	if err != nil {
+		if r.labels {
+			return errors.New(r.p.errorIn(s, err.Error()))
+		}
+		// needs a label
+		return nil
+	}
+	s.Value = value
+	s.Expr = nil
+	return nil
+}
+
+func (r *assignResolver) resolveExpr(node interface{}) error {
+	switch t := node.(type) {
+	case *LabelCall:
+		def, ok := r.def(t.LabelName)
+		if ok {
+			return r.resolve(def)
+		}
+	case *BinaryExpr:
+		err := r.resolveExpr(t.Left)
+		if err != nil {
+			return err
+		}
+		return r.resolveExpr(t.Right)
+	case *ByteExpr:
+		return r.resolveExpr(t.Expr)
+	}
+	return nil
+}
+
+func (r *assignResolver) getSize(name string) (int, bool) {
+	if !r.labels {
+		return 0, false
+	}
+	return r.p.getSize(name)
+}
+
+func (r *assignResolver) getSymbol(name string, offset int) (int, bool) {
+	def, ok := r.def(name)
+	if ok {
+		return def.Value, def.Expr == nil
+	}
+	if r.labels && name != "." {
+		value, ok := r.p.Labels[name]
+		return value, ok
+	}
+	return 0, false
+}
+
+type conditional struct {
+	Line int
+	// the .if statement
+	stmt interface{}
+	// whether the enclosing block is assembled
+	parentIncluded bool
+	// whether the current branch is assembled
+	included bool
+	sawElse bool
+}
+
+// the .if blocks enclosing the current statement
+type conditionalStack []*conditional
+
+// whether stmt is assembled. .if, .else and .endif never are; they update
+// the stack instead, evaluating conditions with sg.
+func (stack *conditionalStack) include(stmt interface{}, sg symbolGetter) (bool, error) {
+	s := *stack
+	included := len(s) == 0 || s[len(s)-1].included
+	switch t := stmt.(type) {
+	case *IfStatement:
+		c := &conditional{Line: t.Line, stmt: t, parentIncluded: included}
+		if included {
+			value, err := evalExpr(t.Cond, sg, 0, t.Line)
+			if err != nil {
+				return false, err
+			}
+			c.included = value != 0
+		}
+		*stack = append(s, c)
+		return false, nil
+	case *ElseStatement:
+		if len(s) == 0 {
+			return false, errors.New(fmt.Sprintf("Line %d: .else without .if", t.Line))
+		}
+		c := s[len(s)-1]
+		if c.sawElse {
+			return false, errors.New(fmt.Sprintf("Line %d: Second .else for the .if on line %d", t.Line, c.Line))
+		}
+		c.sawElse = true
+		c.included = c.parentIncluded && !c.included
+		return false, nil
+	case *EndIfStatement:
+		if len(s) == 0 {
+			return false, errors.New(fmt.Sprintf("Line %d: .endif without .if", t.Line))
+		}
+		*stack = s[:len(s)-1]
+		return false, nil
+	}
+	return included, nil
+}
+
+func (stack conditionalStack) close() error {
+	if len(stack) > 0 {
+		return errors.New(fmt.Sprintf("Line %d: .if without .endif", stack[len(stack)-1].Line))
+	}
+	return nil
+}
+
+// removes the .if, .else and .endif statements along with the blocks
+// they exclude. conditions may only use variables assigned earlier, and
+// only assignments in included blocks count.
+func (p *Program) resolveConditionals() error {
+	vars := variableGetter{}
+	var stack conditionalStack
+	for e := p.List.Front(); e != nil; {
+		next := e.Next()
+		included, err := stack.include(e.Value, vars)
+		if err != nil {
+			return errors.New(p.errorIn(e.Value, err.Error()))
+		}
+		if !included {
+			p.List.Remove(e)
+		} else if t, ok := e.Value.(*AssignStatement); ok {
+			if t.Expr == nil {
+				vars[t.VarName] = t.Value
+			} else if value, err := evalExpr(t.Expr, vars, 0, t.Line); err == nil {
+				vars[t.VarName] = value
+			}
+		}
+		e = next
+	}
+	err := stack.close()
+	if err != nil {
+		return errors.New(p.errorIn(stack[len(stack)-1].stmt, err.Error()))
+	}
+	return nil
+}
+
+// removes the .fillvalue statements, giving their fill byte to the org,
+// align and reserve statements after them which don't have their own
+func (p *Program) resolveFillValues() {
+	var fill *FillValueStatement
+	for e := p.List.Front(); e != nil; {
+		next := e.Next()
+		switch t := e.Value.(type) {
+		case *FillValueStatement:
+			fill = t
+			p.FillValue = t.Value
+			p.List.Remove(e)
+		case *OrgPseudoOp:
+			if fill != nil && t.DefaultFill {
+				t.Fill = fill.Value
+			}
+		case *AlignStatement:
+			if fill != nil && t.DefaultFill {
+				t.Fill = fill.Value
+			}
+		case *ReserveStatement:
+			if fill != nil && t.DefaultFill {
+				t.Fill = fill.Value
+			}
+		}
+		e = next
+	}
+}
+
 func (p *Program) Resolve() {
+	err := p.resolveConditionals()
+	if err != nil {
+		p.Errors = append(p.Errors, err.Error())
+		return
+	}
+	p.resolveFillValues()
+	err = p.resolveAssignments(false)
+	if err != nil {
+		p.Errors = append(p.Errors, err.Error())
+		return
+	}
 	offset := 0
+	p.LabelSizes = make(map[string]int)
+	// labels at sizingStart, waiting for the next label or org to find
+	// out how many bytes follow them
+	sizing := []string{}
+	sizingStart := 0
+	endSizing := func() {
+		for _, name := range sizing {
+			p.LabelSizes[name] = offset - sizingStart
+		}
+		sizing = sizing[:0]
+	}
+	defer endSizing()
 	for e := p.List.Front(); e != nil; e = e.Next() {
 		switch t := e.Value.(type) {
 		default: panic("unexpected node")
 		case *AssignStatement:
+			_, exists := p.Variables[t.VarName]
+			if exists {
+				warn := fmt.Sprintf("Line %d: Variable %s redefined.", t.Line, t.VarName)
+				p.Warnings = append(p.Warnings, p.errorIn(t, warn))
+			}
+			if t.Expr != nil {
+				// refers to a label; filled in by resolveSymbols
+				delete(p.Variables, t.VarName)
+				continue
+			}
 			p.Variables[t.VarName] = t.Value
 		case *OrgPseudoOp:
+			endSizing()
 			offset = t.Value
 		case *LabelStatement:
 			if offset >= 0xffff {
 				err := fmt.Sprintf("Line %d: Label memory address must fit in 2 bytes.", t.Line)
-				p.Errors = append(p.Errors, err)
+				p.Errors = append(p.Errors, p.errorIn(t, err))
 				return
 			}
 			_, exists := p.Labels[t.LabelName]
 			if exists {
 				err := fmt.Sprintf("Line %d: Label %s already defined.", t.Line, t.LabelName)
-				p.Errors = append(p.Errors, err)
+				p.Errors = append(p.Errors, p.errorIn(t, err))
 				return
 			}
 			p.Labels[t.LabelName] = offset
+			if len(sizing) > 0 && offset > sizingStart {
+				endSizing()
+			}
+			if len(sizing) == 0 {
+				sizingStart = offset
+			}
+			sizing = append(sizing, t.LabelName)
 		case Assembler:
 			if offset >= 0xffff {
 				err := fmt.Sprintf("Line %d: Instruction is at offset $%04x which is greater than 2 bytes.", t.GetLine(), offset)
-				p.Errors = append(p.Errors, err)
+				p.Errors = append(p.Errors, p.errorIn(t, err))
 				return
 			}
 			p.Offsets[offset] = e
 			t.SetOffset(offset)
+			switch a := t.(type) {
+			case *Instruction:
+				a.substituteVariables(p.Variables)
+			case *DataStatement:
+				a.substituteVariables(p.Variables)
+			}
 			err := t.Resolve()
 			if err != nil {
-				p.Errors = append(p.Errors, err.Error())
+				p.Errors = append(p.Errors, p.errorIn(t, err.Error()))
 				return
 			}
 			offset += len(t.GetPayload())
@@ -475,14 +1284,133 @@ func (p *Program) Resolve() {
 	}
 }
 
+// fills in operands which refer to symbols, now that every label has an address
+func (p *Program) resolveSymbols() {
+	err := p.resolveAssignments(true)
+	if err != nil {
+		p.Errors = append(p.Errors, err.Error())
+		return
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		s, ok := e.Value.(*AssignStatement)
+		if ok {
+			p.Variables[s.VarName] = s.Value
+		}
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		t, ok := e.Value.(Assembler)
+		if !ok {
+			continue
+		}
+		err := t.Assemble(p)
+		if err != nil {
+			p.Errors = append(p.Errors, p.errorIn(t, err.Error()))
+			return
+		}
+	}
+}
+
+// prefixes msg, which is about stmt, with the file stmt was included
+// from
+func (p *Program) errorIn(stmt interface{}, msg string) string {
+	file, included := p.files[stmt]
+	if !included {
+		return msg
+	}
+	return file + ": " + msg
+}
+
 func (ast ProgramAst) ToProgram() (p *Program) {
 	ast.ExpandLabeledStatements()
+	ast.QualifyLocalLabels()
 	p = &Program{
 		List: ast.List,
 		Labels: make(map[string]int),
 		Offsets: make(map[int]*list.Element),
 		Variables: make(map[string]int),
+		files: ast.Files,
 	}
 	p.Resolve()
+	if len(p.Errors) == 0 {
+		p.resolveSymbols()
+	}
 	return
 }
+
+// a deep copy of the program, so that the copy can be changed and
+// compiled without affecting p. the ROM banks are shared.
+func (p *Program) Clone() *Program {
+	c := &Program{
+		List:      list.New(),
+		Labels:    make(map[string]int),
+		Errors:    append([]string(nil), p.Errors...),
+		ChrRom:    p.ChrRom,
+		PrgRom:    p.PrgRom,
+		Mirroring: p.Mirroring,
+		Mapper:    p.Mapper,
+		FillValue: p.FillValue,
+		Offsets:   make(map[int]*list.Element),
+		Variables: make(map[string]int),
+		Warnings:  append([]string(nil), p.Warnings...),
+	}
+	for name, value := range p.Labels {
+		c.Labels[name] = value
+	}
+	for name, value := range p.Variables {
+		c.Variables[name] = value
+	}
+	if p.LabelSizes != nil {
+		c.LabelSizes = make(map[string]int)
+		for name, size := range p.LabelSizes {
+			c.LabelSizes[name] = size
+		}
+	}
+	elems := make(map[*list.Element]*list.Element)
+	c.files = make(map[interface{}]string)
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		elems[e] = c.List.PushBack(cloneStatement(e.Value))
+		file, included := p.files[e.Value]
+		if included {
+			c.files[elems[e].Value] = file
+		}
+	}
+	for offset, e := range p.Offsets {
+		c.Offsets[offset] = elems[e]
+	}
+	return c
+}
+
+// expressions are replaced rather than changed in place, so they are
+// shared with the original
+func cloneStatement(stmt interface{}) interface{} {
+	switch t := stmt.(type) {
+	case *Instruction:
+		copied := *t
+		copied.Payload = append([]byte(nil), t.Payload...)
+		return &copied
+	case *DataStatement:
+		copied := *t
+		copied.dataList = list.New()
+		copied.dataList.PushBackList(t.dataList)
+		copied.Payload = append([]byte(nil), t.Payload...)
+		return &copied
+	case *ReserveStatement:
+		copied := *t
+		copied.Payload = append([]byte(nil), t.Payload...)
+		return &copied
+	case *AlignStatement:
+		copied := *t
+		copied.Payload = append([]byte(nil), t.Payload...)
+		return &copied
+	case *LabelStatement:
+		copied := *t
+		return &copied
+	case *AssignStatement:
+		copied := *t
+		return &copied
+	case *OrgPseudoOp:
+		copied := *t
+		return &copied
+	}
+	return stmt
+}
@@ -1,9 +1,20 @@
 package jamulator
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"strings"
 )
+
+// long data statements are split into several lines of at most this many
+// items each
+const astDataItemsPerLine = 8
+
 func astPrint(indent int, n interface{}) {
 	for i := 0; i < indent; i++ {
 		fmt.Print(" ")
@@ -25,3 +36,205 @@ func (ast ProgramAst) Print() {
 		}
 	}
 }
+
+// writes the AST as a tree of node types, indented by depth, along with
+// the line, label and operand of the nodes which have them. unlike
+// WriteSource this shows how the parser saw the program.
+func (ast ProgramAst) Dump(w io.Writer) error {
+	d := &astDumper{w: bufio.NewWriter(w)}
+	ast.Accept(d)
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
+
+type astDumper struct {
+	w     *bufio.Writer
+	depth int
+	err   error
+}
+
+func (d *astDumper) Visit(node interface{}) bool {
+	if d.err == nil {
+		indent := strings.Repeat("  ", d.depth)
+		_, d.err = fmt.Fprintf(d.w, "%s%T%s\n", indent, node, astNodeFields(node))
+	}
+	d.depth += 1
+	return true
+}
+
+func (d *astDumper) VisitEnd(node interface{}) {
+	d.depth -= 1
+}
+
+// the fields of a node worth showing in a dump, each with a leading space
+func astNodeFields(node interface{}) string {
+	fields := ""
+	v := reflect.ValueOf(node)
+	if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+		line := v.Elem().FieldByName("Line")
+		if line.IsValid() && line.Kind() == reflect.Int {
+			fields += fmt.Sprintf(" line=%d", line.Int())
+		}
+	}
+	switch t := node.(type) {
+	case *Instruction:
+		fields += " op=" + t.OpName
+		switch {
+		case t.LabelName != "":
+			fields += " label=" + t.LabelName
+		case t.Expr != nil:
+			fields += " operand=" + renderExpr(t.Expr)
+		case t.Type != ImpliedInstruction && t.Type != AccumulatorInstruction:
+			fields += fmt.Sprintf(" operand=$%02x", t.Value)
+		}
+		if t.RegisterName != "" {
+			fields += " register=" + t.RegisterName
+		}
+	case *LabelStatement:
+		fields += " label=" + t.LabelName
+	case *AssignStatement:
+		fields += " name=" + t.VarName
+		if t.Expr != nil {
+			fields += " operand=" + renderExpr(t.Expr)
+		} else {
+			fields += fmt.Sprintf(" operand=$%02x", t.Value)
+		}
+	case *OrgPseudoOp:
+		fields += fmt.Sprintf(" operand=$%04x", t.Value)
+	case *AlignStatement:
+		fields += fmt.Sprintf(" operand=%d", t.Value)
+	case *ReserveStatement:
+		fields += fmt.Sprintf(" operand=%d", t.Size)
+	case *FillValueStatement:
+		fields += fmt.Sprintf(" operand=$%02x", t.Value)
+	case *IncludeStatement:
+		fields += fmt.Sprintf(" file=%q", t.Filename)
+	case *MacroStatement:
+		fields += " name=" + t.Name
+	case *MacroCall:
+		fields += " name=" + t.Name
+	case *IfStatement:
+		fields += " operand=" + renderExpr(t.Cond)
+	case *StringDataItem:
+		fields += fmt.Sprintf(" %q", string(*t))
+	case *ByteExpr:
+		if t.High {
+			fields += " byte=high"
+		} else {
+			fields += " byte=low"
+		}
+		fields += " operand=" + renderExpr(t.Expr)
+	case *IntegerDataItem, *LabelCall, *SizeofExpr, *BinaryExpr:
+		fields += " " + renderExpr(t)
+	}
+	return fields
+}
+
+// the lines of source for a statement, not including any label
+func renderAstStatement(n interface{}) ([]string, error) {
+	switch t := n.(type) {
+	case *Instruction:
+		lower := *t
+		lower.OpName = strings.ToLower(t.OpName)
+		return []string{lower.Render()}, nil
+	case *DataStatement:
+		lines := []string{}
+		chunk := &DataStatement{Type: t.Type, dataList: list.New(), BigEndian: t.BigEndian}
+		for e := t.dataList.Front(); e != nil; e = e.Next() {
+			chunk.dataList.PushBack(e.Value)
+			if chunk.dataList.Len() == astDataItemsPerLine || e.Next() == nil {
+				lines = append(lines, chunk.Render())
+				chunk.dataList.Init()
+			}
+		}
+		return lines, nil
+	case *OrgPseudoOp:
+		return []string{t.Render()}, nil
+	case *AlignStatement:
+		return []string{t.Render()}, nil
+	case *ReserveStatement:
+		return []string{t.Render()}, nil
+	case *FillValueStatement:
+		return []string{fmt.Sprintf(".fillvalue $%02x", t.Value)}, nil
+	case *AssignStatement:
+		return []string{t.Render()}, nil
+	case *IncludeStatement:
+		return []string{fmt.Sprintf(".include \"%s\"", t.Filename)}, nil
+	case *IfStatement:
+		return []string{".if " + renderExpr(t.Cond)}, nil
+	case *ElseStatement:
+		return []string{".else"}, nil
+	case *EndIfStatement:
+		return []string{".endif"}, nil
+	}
+	// macros are expanded by Parse, so there's no source to write them as
+	return nil, errors.New(fmt.Sprintf("Can't write %T as source", n))
+}
+
+func renderLabel(name string) string {
+	// local labels are written without a colon
+	if strings.HasPrefix(name, ".") {
+		return name
+	}
+	return name + ":"
+}
+
+// writes the AST back out as assembly source. instructions and data are
+// indented past the longest label, and labels share a line with the
+// statement they label.
+func (ast ProgramAst) WriteSource(writer io.Writer) error {
+	indent := 4
+	for e := ast.List.Front(); e != nil; e = e.Next() {
+		s, ok := e.Value.(*LabeledStatement)
+		if ok && len(renderLabel(s.Label.LabelName))+1 > indent {
+			indent = len(renderLabel(s.Label.LabelName)) + 1
+		}
+	}
+
+	w := bufio.NewWriter(writer)
+	for e := ast.List.Front(); e != nil; e = e.Next() {
+		label := ""
+		stmt := e.Value
+		switch t := e.Value.(type) {
+		case nil:
+			continue
+		case *LabelStatement:
+			_, err := fmt.Fprintln(w, renderLabel(t.LabelName))
+			if err != nil {
+				return err
+			}
+			continue
+		case *LabeledStatement:
+			label = renderLabel(t.Label.LabelName)
+			stmt = t.Stmt
+		}
+		column := indent
+		switch stmt.(type) {
+		case *Instruction, *DataStatement:
+		default:
+			if label == "" {
+				column = 0
+			}
+		}
+		lines, err := renderAstStatement(stmt)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			_, err = fmt.Fprintf(w, "%-*s%s\n", column, label, line)
+			if err != nil {
+				return err
+			}
+			label = ""
+		}
+	}
+	return w.Flush()
+}
+
+func (ast ProgramAst) String() string {
+	buf := new(bytes.Buffer)
+	ast.WriteSource(buf)
+	return buf.String()
+}
@@ -0,0 +1,102 @@
+package jamulator
+
+import (
+	"strings"
+)
+
+// calls fn for each statement in the AST, in order. labeled statements
+// are followed by their label and the statement they label, and data
+// statements by each of their items. returning false from fn stops the
+// walk. returns whether the walk reached the end.
+func (ast ProgramAst) Walk(fn func(node interface{}) bool) bool {
+	w := &walker{fn: fn}
+	ast.Accept(w)
+	return !w.stopped
+}
+
+// the Visitor behind Walk, which skips every node after fn returns false
+type walker struct {
+	fn      func(node interface{}) bool
+	stopped bool
+}
+
+func (w *walker) Visit(node interface{}) bool {
+	if w.stopped {
+		return false
+	}
+	w.stopped = !w.fn(node)
+	return !w.stopped
+}
+
+func (w *walker) VisitEnd(node interface{}) {}
+
+// visits AST nodes with Accept. Visit is called before a node's children
+// and returns whether to visit them, so that whole data statements can be
+// skipped. VisitEnd is called after them, even if they were skipped.
+type Visitor interface {
+	Visit(node interface{}) bool
+	VisitEnd(node interface{})
+}
+
+// adapts a function to a Visitor which visits every node
+type VisitorFunc func(node interface{})
+
+func (fn VisitorFunc) Visit(node interface{}) bool {
+	fn(node)
+	return true
+}
+
+func (fn VisitorFunc) VisitEnd(node interface{}) {}
+
+// visits each statement in the AST in order, along with the children
+// which Walk would visit
+func (ast ProgramAst) Accept(v Visitor) {
+	for e := ast.List.Front(); e != nil; e = e.Next() {
+		acceptNode(e.Value, v)
+	}
+}
+
+func acceptNode(node interface{}, v Visitor) {
+	if v.Visit(node) {
+		switch t := node.(type) {
+		case *LabeledStatement:
+			acceptNode(t.Label, v)
+			acceptNode(t.Stmt, v)
+		case *DataStatement:
+			for e := t.dataList.Front(); e != nil; e = e.Next() {
+				acceptNode(e.Value, v)
+			}
+		}
+	}
+	v.VisitEnd(node)
+}
+
+// counts the instructions in the AST by lower case mnemonic, to show
+// which op codes a program depends on
+func (ast ProgramAst) OpcodeHistogram() map[string]int {
+	counts := make(map[string]int)
+	ast.Walk(func(node interface{}) bool {
+		i, ok := node.(*Instruction)
+		if ok {
+			counts[strings.ToLower(i.OpName)] += 1
+		}
+		return true
+	})
+	return counts
+}
+
+// like ProgramAst.OpcodeHistogram, but the program's instructions have
+// op codes, so they are counted by mnemonic and addressing mode, as in
+// "lda absolute,x"
+func (p *Program) OpcodeHistogram() map[string]int {
+	counts := make(map[string]int)
+	ProgramAst{List: p.List}.Walk(func(node interface{}) bool {
+		i, ok := node.(*Instruction)
+		if ok {
+			info := opCodeTable[i.OpCode]
+			counts[info.opName+" "+AddressingMode(info.addrMode).String()] += 1
+		}
+		return true
+	})
+	return counts
+}
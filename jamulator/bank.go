@@ -0,0 +1,113 @@
+package jamulator
+
+// assembles a program with several PRG banks, which usually share
+// addresses, into a separate image for each bank
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+type BankDef struct {
+	// the file AssembleBanksToDir writes the bank to
+	Name string
+	// the label the bank starts at. the bank runs up to the label of the
+	// next bank in the program, or to the end of the program.
+	Start string
+	// the image is padded with the org fill value to this many bytes.
+	// 0 means it isn't padded.
+	Size int
+}
+
+// assembles each bank into an image of its own, in the order of banks
+func (p *Program) AssembleBanks(banks []BankDef) ([][]byte, error) {
+	starts := make(map[string]*list.Element)
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		label, ok := e.Value.(*LabelStatement)
+		if ok {
+			starts[label.LabelName] = e
+		}
+	}
+	isStart := make(map[*list.Element]bool)
+	for _, bank := range banks {
+		e, ok := starts[bank.Start]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("bank %s: undefined label %s", bank.Name, bank.Start))
+		}
+		if isStart[e] {
+			return nil, errors.New(fmt.Sprintf("bank %s: another bank already starts at %s", bank.Name, bank.Start))
+		}
+		isStart[e] = true
+	}
+
+	images := make([][]byte, 0, len(banks))
+	for _, bank := range banks {
+		first := starts[bank.Start]
+		stop := first.Next()
+		for stop != nil && !isStart[stop] {
+			stop = stop.Next()
+		}
+		if stop != nil {
+			// the org before the next bank belongs to it
+			for stop.Prev() != first {
+				_, ok := stop.Prev().Value.(*OrgPseudoOp)
+				if !ok {
+					break
+				}
+				stop = stop.Prev()
+			}
+		}
+
+		// carry on from the org which the bank is in
+		start := p.Labels[bank.Start]
+		buf := new(bytes.Buffer)
+		iw := &imageWriter{writer: bufio.NewWriter(buf), offset: start, expectedOffset: start}
+		for e := first.Prev(); e != nil; e = e.Prev() {
+			org, ok := e.Value.(*OrgPseudoOp)
+			if ok {
+				iw.orgFillValue = org.Fill
+				break
+			}
+		}
+		err := iw.write(p, first, stop)
+		if err != nil {
+			return nil, err
+		}
+		size := iw.expectedOffset - start
+		if bank.Size > 0 && size > bank.Size {
+			return nil, errors.New(fmt.Sprintf("bank %s is $%x bytes, more than its size of $%x", bank.Name, size, bank.Size))
+		}
+		for ; size < bank.Size; size++ {
+			err = iw.writer.WriteByte(iw.orgFillValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = iw.writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, buf.Bytes())
+	}
+	return images, nil
+}
+
+// writes each bank to the file in dir which it names
+func (p *Program) AssembleBanksToDir(dir string, banks []BankDef) error {
+	images, err := p.AssembleBanks(banks)
+	if err != nil {
+		return err
+	}
+	for i, bank := range banks {
+		err = ioutil.WriteFile(path.Join(dir, bank.Name), images[i], 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,6 +6,10 @@ import (
 )
 
 func (i *Instruction) ResolveRender() string {
+	// render the resolved value instead of the expression
+	expr := i.Expr
+	i.Expr = nil
+	defer func() { i.Expr = expr }()
 	switch i.Type {
 	case DirectWithLabelInstruction:
 		i.Type = DirectInstruction
@@ -15,7 +19,7 @@ func (i *Instruction) ResolveRender() string {
 	case DirectWithLabelIndexedInstruction:
 		i.Type = DirectIndexedInstruction
 		v := i.Render()
-		i.Type = DirectWithLabelInstruction
+		i.Type = DirectWithLabelIndexedInstruction
 		return v
 	}
 	return i.Render()
@@ -39,6 +43,12 @@ func (i *Instruction) Compile(c *Compilation) {
 
 	var addrNext = i.Offset+len(i.Payload)
 
+	if opCodeTable[i.OpCode].undocumented && !c.Options.AllowIllegal {
+		c.Errors = append(c.Errors, fmt.Sprintf("$%04x: undocumented instruction %s is only compiled with AllowIllegal", i.Offset, i.Render()))
+		return
+	}
+	c.trace(i)
+
 	switch i.OpCode {
 	default:
 		c.Errors = append(c.Errors, fmt.Sprintf("unrecognized instruction: %s", i.Render()))
@@ -137,7 +147,11 @@ func (i *Instruction) Compile(c *Compilation) {
 		c.dynTestAndSetZero(v)
 		c.dynTestAndSetNeg(v)
 		c.cycle(4, addrNext)
-	//case 0x08: // php implied
+	case 0x08: // php implied
+		// the copy pushed has the B and unused bits set
+		bits := llvm.ConstInt(llvm.Int8Type(), statusBrk|statusUnused, false)
+		c.pushToStack(c.builder.CreateOr(c.getStatusByte(), bits, ""))
+		c.cycle(3, addrNext)
 	case 0x28: // plp implied
 		c.pullStatusReg()
 		c.cycle(4, addrNext)
@@ -203,7 +217,7 @@ func (i *Instruction) Compile(c *Compilation) {
 		reg := c.builder.CreateLoad(c.rA, "")
 		mem := c.dynLoadIndexed(i.Value, c.rY)
 		c.performCmp(reg, mem)
-		c.cyclesForAbsoluteIndexedPtr(i.Value, c.rX, addrNext)
+		c.cyclesForAbsoluteIndexedPtr(i.Value, c.rY, addrNext)
 	case 0xdd: // cmp abs x
 		reg := c.builder.CreateLoad(c.rA, "")
 		mem := c.dynLoadIndexed(i.Value, c.rX)
@@ -352,21 +366,29 @@ func (i *Instruction) Compile(c *Compilation) {
 		v := c.dynLoadZpgIndexed(i.Value, c.rX)
 		c.performOra(v)
 		c.cycle(4, addrNext)
-	//case 0x5e: // lsr abs x
+	case 0x5e: // lsr abs x
+		oldValue := c.dynLoadIndexed(i.Value, c.rX)
+		newValue := c.performLsr(oldValue)
+		c.dynStoreIndexed(i.Value, c.rX, newValue)
+		c.cycle(7, addrNext)
 	//case 0x56: // lsr zpg x
 	//case 0x36: // rol zpg x
 	//case 0x76: // ror zpg x
 
 	case 0x6c: // jmp indirect
-		newPc := c.loadWord(i.Value)
+		newPc := c.loadBytePair(i.Value, jmpIndirectHighAddr(i.Value, c.Options.FixJmpBug))
 		c.builder.CreateStore(newPc, c.rPC)
 		c.cycle(5, -1)
 		c.builder.CreateBr(c.dynJumpBlock)
 		c.currentBlock = nil
 	case 0x4c: // jmp
+		if labelAddr == i.Offset {
+			// legitimate, e.g. waiting for NMI forever, but worth pointing out
+			c.Warnings = append(c.Warnings, fmt.Sprintf("infinite loop at $%04x: jmp %s jumps to itself", i.Offset, i.LabelName))
+		}
 		// branch instruction - cycle before execution
 		c.cycle(3, labelAddr)
-		destBlock, ok := c.labeledBlocks[i.LabelName]
+		destBlock, ok := c.localBlock(i.LabelName)
 		if ok {
 			// cool, we're jumping into statically compiled code
 			c.builder.CreateBr(destBlock)
@@ -382,7 +404,13 @@ func (i *Instruction) Compile(c *Compilation) {
 
 		c.pushWordToStack(pc)
 		c.cycle(6, i.Value)
-		destBlock, ok := c.labeledBlocks[i.LabelName]
+		routine, ok := c.subroutines[i.LabelName]
+		if ok {
+			// carry on after the call, as long as it returned here
+			c.callSubroutine(routine, addrNext)
+			break
+		}
+		destBlock, ok := c.localBlock(i.LabelName)
 		if ok {
 			// cool, we're jumping into statically compiled code
 			c.builder.CreateBr(destBlock)
@@ -413,8 +441,13 @@ func (i *Instruction) Compile(c *Compilation) {
 		isNeg := c.builder.CreateLoad(c.rSNeg, "")
 		notNeg := c.builder.CreateNot(isNeg, "")
 		c.createBranch(notNeg, i.LabelName, i.Offset)
-	//case 0x50: // bvc
-	//case 0x70: // bvs
+	case 0x50: // bvc
+		isOver := c.builder.CreateLoad(c.rSOver, "")
+		notOver := c.builder.CreateNot(isOver, "")
+		c.createBranch(notOver, i.LabelName, i.Offset)
+	case 0x70: // bvs
+		isOver := c.builder.CreateLoad(c.rSOver, "")
+		c.createBranch(isOver, i.LabelName, i.Offset)
 
 	case 0xa5:
 		c.performLda(c.load(i.Value))
@@ -568,24 +601,43 @@ func (i *Instruction) Compile(c *Compilation) {
 		c.cycle(4, addrNext)
 
 	case 0xa1: // lda indirect x
-		index := c.builder.CreateLoad(c.rX, "")
-		base := llvm.ConstInt(llvm.Int8Type(), uint64(i.Value), false)
-		addr := c.builder.CreateAdd(base, index, "")
-		v := c.dynLoad(addr, 0, 0xff)
+		addr := c.dynIndirectXAddr(i.Value)
+		v := c.dynLoad(addr, 0, 0xffff)
 		c.performLda(v)
 		c.cycle(6, addrNext)
 	//case 0x61: // adc indirect x
 	//case 0x21: // and indirect x
-	//case 0xc1: // cmp indirect x
+	case 0xc1: // cmp indirect x
+		addr := c.dynIndirectXAddr(i.Value)
+		v := c.dynLoad(addr, 0, 0xffff)
+		reg := c.builder.CreateLoad(c.rA, "")
+		c.performCmp(reg, v)
+		c.cycle(6, addrNext)
 	//case 0x41: // eor indirect x
 	//case 0x01: // ora indirect x
-	//case 0xe1: // sbc indirect x
-	//case 0x81: // sta indirect x
+	case 0xe1: // sbc indirect x
+		addr := c.dynIndirectXAddr(i.Value)
+		v := c.dynLoad(addr, 0, 0xffff)
+		c.performSbc(v)
+		c.cycle(6, addrNext)
+	case 0x81: // sta indirect x
+		addr := c.dynIndirectXAddr(i.Value)
+		rA := c.builder.CreateLoad(c.rA, "")
+		c.dynStore(addr, 0, 0xffff, rA)
+		c.cycle(6, addrNext)
 
 
 	//case 0x71: // adc indirect y
 	//case 0x31: // and indirect y
-	//case 0xd1: // cmp indirect y
+	case 0xd1: // cmp indirect y
+		baseAddr := c.loadWord(i.Value)
+		rY := c.builder.CreateLoad(c.rY, "")
+		rYw := c.builder.CreateZExt(rY, llvm.Int16Type(), "")
+		addr := c.builder.CreateAdd(baseAddr, rYw, "")
+		val := c.dynLoad(addr, 0, 0xffff)
+		reg := c.builder.CreateLoad(c.rA, "")
+		c.performCmp(reg, val)
+		c.cyclesForIndirectY(baseAddr, addr, addrNext)
 	//case 0x51: // eor indirect y
 	case 0xb1: // lda indirect y
 		baseAddr := c.loadWord(i.Value)
@@ -596,7 +648,14 @@ func (i *Instruction) Compile(c *Compilation) {
 		c.performLda(val)
 		c.cyclesForIndirectY(baseAddr, addr, addrNext)
 	//case 0x11: // ora indirect y
-	//case 0xf1: // sbc indirect y
+	case 0xf1: // sbc indirect y
+		baseAddr := c.loadWord(i.Value)
+		rY := c.builder.CreateLoad(c.rY, "")
+		rYw := c.builder.CreateZExt(rY, llvm.Int16Type(), "")
+		addr := c.builder.CreateAdd(baseAddr, rYw, "")
+		val := c.dynLoad(addr, 0, 0xffff)
+		c.performSbc(val)
+		c.cyclesForIndirectY(baseAddr, addr, addrNext)
 	case 0x91: // sta indirect y
 		baseAddr := c.loadWord(i.Value)
 		rY := c.builder.CreateLoad(c.rY, "")
@@ -605,5 +664,44 @@ func (i *Instruction) Compile(c *Compilation) {
 		rA := c.builder.CreateLoad(c.rA, "")
 		c.dynStore(addr, 0, 0xffff, rA)
 		c.cycle(6, addrNext)
+
+	// undocumented. page crossing penalties are only counted for nop.
+	case 0xa7, 0xb7, 0xaf, 0xbf, 0xa3, 0xb3: // lax
+		load, _ := c.undocumentedOperand(i)
+		v := load()
+		c.performLda(v)
+		c.builder.CreateStore(v, c.rX)
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0x87, 0x97, 0x8f, 0x83: // sax
+		_, store := c.undocumentedOperand(i)
+		a := c.builder.CreateLoad(c.rA, "")
+		x := c.builder.CreateLoad(c.rX, "")
+		store(c.builder.CreateAnd(a, x, ""))
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0xc7, 0xd7, 0xcf, 0xdf, 0xdb, 0xc3, 0xd3: // dcp
+		load, store := c.undocumentedOperand(i)
+		newValue := c.incrementVal(load(), -1)
+		store(newValue)
+		reg := c.builder.CreateLoad(c.rA, "")
+		c.performCmp(reg, newValue)
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0xe7, 0xf7, 0xef, 0xff, 0xfb, 0xe3, 0xf3: // isc
+		load, store := c.undocumentedOperand(i)
+		newValue := c.incrementVal(load(), 1)
+		store(newValue)
+		c.performSbc(newValue)
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0x1a, 0x3a, 0x5a, 0x7a, 0xda, 0xfa, 0x80, 0x82, 0x89, 0xc2, 0xe2: // nop
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0x04, 0x44, 0x64, 0x14, 0x34, 0x54, 0x74, 0xd4, 0xf4, 0x0c: // nop
+		// the operand is read and thrown away, which PPU and APU
+		// registers notice
+		load, _ := c.undocumentedOperand(i)
+		load()
+		c.cycle(opCodeCycles[i.OpCode], addrNext)
+	case 0x1c, 0x3c, 0x5c, 0x7c, 0xdc, 0xfc: // nop abs x
+		load, _ := c.undocumentedOperand(i)
+		load()
+		c.cyclesForAbsoluteIndexedPtr(i.Value, c.rX, addrNext)
 	}
 }
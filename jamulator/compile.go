@@ -3,21 +3,29 @@ package jamulator
 // generates a module compatible with runtime/rom.h
 
 import (
+	"container/list"
 	"fmt"
 	"github.com/axw/gollvm/llvm"
 	"os"
+	"sort"
+	"strings"
 )
 
 type Compilation struct {
 	Warnings []string
 	Errors   []string
-	Flags    CompileFlags
+	Options  CompileOptions
 
 	program         *Program
 	mod             llvm.Module
 	builder         llvm.Builder
-	wram            llvm.Value // 2KB WRAM
+	wram            llvm.Value // 2KB WRAM, including zero page
 	prgRom          llvm.Value // 32KB PRG ROM
+	// the registers are the fields of a CpuState. rom_start uses the
+	// global one, and functions the one they are passed.
+	cpuStateType    llvm.Type
+	cpuState        llvm.Value // the global CpuState
+	cpuStatePtr     llvm.Value // the CpuState the registers point into
 	rX              llvm.Value // X index register
 	rY              llvm.Value // Y index register
 	rA              llvm.Value // accumulator
@@ -40,10 +48,20 @@ type Compilation struct {
 	labeledBlocks map[string]llvm.BasicBlock
 	labeledData   map[string]bool
 	stringTable   map[string]llvm.Value
-	// used for RTS, BRK, RTI
+	// used for RTS, BRK, RTI and indirect JMP
 	dynJumpAddrs        map[int]llvm.BasicBlock
 	dynJumpBlock llvm.BasicBlock
 	interpretBlock llvm.BasicBlock
+	// the blocks above are the function's return block while a
+	// subroutine is compiled
+	mainDynJumpBlock   llvm.BasicBlock
+	mainInterpretBlock llvm.BasicBlock
+
+	// routines compiled as functions, by label. see findSubroutines
+	subroutines      map[string]*subroutine
+	labelRoutines    map[string]*subroutine
+	subroutineStarts map[*list.Element]*subroutine
+	currentRoutine   *subroutine
 
 	currentBlock *llvm.BasicBlock
 	currentInstr *Instruction
@@ -62,7 +80,12 @@ type Compilation struct {
 	putCharFn llvm.Value
 	memcpyFn  llvm.Value
 	exitFn    llvm.Value
+	// CompileOptions.Syscalls, by address
+	syscallFns map[int]llvm.Value
 	cycleFn   llvm.Value
+	frameFn   llvm.Value
+	// uint32_t rom_page_crossings, with CountPageCrossings
+	pageCrossings llvm.Value
 	// PPU
 	ppuReadStatusFn  llvm.Value
 	ppuReadOamDataFn llvm.Value
@@ -100,6 +123,19 @@ type Compilation struct {
 	// pads
 	padWriteFn llvm.Value
 	padReadFn  llvm.Value
+	// mapper
+	bankSwitchFn llvm.Value
+	// rom_illegal_opcode, for op codes the interpreter doesn't have
+	illegalOpcodeFn llvm.Value
+	// where each of Errors and Warnings came from. see sortDiagnostics
+	errorPos   []diagnosticPos
+	warningPos []diagnosticPos
+
+	// rom_watch, only declared when there are CompileOptions.Watchpoints
+	watchFn    llvm.Value
+	watchAddrs map[int]bool
+	// rom_trace, only declared with CompileOptions.Trace
+	traceFn llvm.Value
 }
 
 type CompileFlags int
@@ -109,8 +145,109 @@ const (
 	DumpModuleFlag
 	DumpModulePreFlag
 	IncludeDebugFlag
+	// warn about labels whose blocks nothing branches to
+	LintBlocksFlag
 )
 
+type CompileOptions struct {
+	Flags CompileFlags
+	// when nonzero, the generated code keeps its own cycle count and
+	// calls rom_frame followed by the NMI routine every NmiCycles cpu
+	// cycles, instead of waiting for the runtime to request an NMI.
+	// 29781 is one NTSC frame.
+	NmiCycles int
+	// the 2A03 in the NES ignores the D flag, so BCD arithmetic for adc
+	// and sbc is only generated when this is set.
+	DecimalMode bool
+	// register values set by the reset routine. nil means PowerOnState.
+	ResetState *RegisterState
+	// code generation stops after this many errors. 0 means
+	// DefaultMaxErrors, and a negative value means no limit.
+	MaxErrors int
+	// jmp ($xxff) reads the high byte of its target from $xx00, as on
+	// the 6502, unless this is set.
+	FixJmpBug bool
+	// compile the stable undocumented op codes, such as lax, instead of
+	// reporting them as errors
+	AllowIllegal bool
+	// report every warning as an error instead, so that the compile
+	// fails
+	WarningsAsErrors bool
+	// for programs without interrupt vectors at $fffa: a missing reset
+	// vector starts at the first label of code, and a missing NMI or
+	// IRQ handler returns straight away, like rti.
+	AutoVectors bool
+	// for programs which don't run on an NES: the number of bytes of
+	// flat RAM from $0000, without mirrors or PPU and APU registers. the
+	// putchar, exit and Syscalls addresses still take stores to them.
+	// between $200, for the zero page and the stack, and MaxRamSize. 0
+	// means the NES memory map, with 2KB of work RAM.
+	RamSize int
+	// export a rom_page_crossings counter which is incremented each time
+	// an indexed read crosses a page boundary and takes an extra cycle
+	CountPageCrossings bool
+	// when set, such as "armv7-unknown-linux-gnueabihf", an object file
+	// for that target is written instead of bitcode
+	TargetTriple string
+	// write a native object file instead of bitcode. this is implied by
+	// TargetTriple, and without it the host's triple is used.
+	ObjectFile bool
+	// the C compiler which CompileExecutable links with. "" means
+	// DefaultLinker.
+	Linker string
+	// host functions which the program calls by storing a byte at an
+	// address, like putchar at $2008. maps the address to the name of a
+	// void function taking a uint8_t, which the runtime must provide.
+	// in the NES memory map, only stores to a constant address are
+	// recognized; with RamSize, indexed stores are too.
+	Syscalls map[int]string
+	// addresses which call rom_watch(addr, value) in the runtime before
+	// every store to them, to find the code which writes to a variable.
+	// without any, no code is generated for them.
+	Watchpoints []int
+	// call rom_trace(pc, opcode) in the runtime before each instruction,
+	// for a log of the run to compare with another emulator's
+	Trace bool
+	// fill in CompileResult.SourceMap
+	SourceMap bool
+	// compile only the code which these labels can reach, for working
+	// on a few routines of a large program. reset calls the first one as
+	// if by jsr, and rom_start returns when it does. NMI and IRQ vectors
+	// whose code is left out do nothing, as with AutoVectors, and
+	// anything else runs in the interpreter.
+	OnlyLabels []string
+}
+
+const DefaultMaxErrors = 20
+
+// PRG ROM starts where RAM has to end
+const MaxRamSize = 0x8000
+
+type RegisterState struct {
+	A      byte
+	X      byte
+	Y      byte
+	SP     byte
+	// processor status, laid out as pushed by php
+	Status byte
+}
+
+// the 2A03 after power on: interrupts disabled, and the stack pointer
+// left at $fd by the reset sequence's three phantom pushes.
+var PowerOnState = RegisterState{SP: 0xfd, Status: 0x34}
+
+func (opts CompileOptions) resetState() RegisterState {
+	if opts.ResetState == nil {
+		return PowerOnState
+	}
+	return *opts.ResetState
+}
+
+// whether missing interrupt vectors get handlers which do nothing
+func (opts CompileOptions) stubsVectors() bool {
+	return opts.AutoVectors || len(opts.OnlyLabels) > 0
+}
+
 const (
 	cfExpectNone = iota
 	cfExpectData
@@ -125,7 +262,7 @@ func (c *Compilation) visitForControlFlow() {
 		switch t := e.Value.(type) {
 		default:
 			panic(fmt.Sprintf("unrecognized node: %T", e.Value))
-		case *OrgPseudoOp:
+		case *OrgPseudoOp, *AlignStatement, *ReserveStatement:
 			// do nothing
 		case *LabelStatement:
 			currentLabel = t.LabelName
@@ -160,14 +297,145 @@ func (c *Compilation) visitForBasicBlocks() {
 	}
 }
 
+// the instruction a diagnostic is about. Offset is -1 for diagnostics
+// about the whole program.
+type diagnosticPos struct {
+	Offset int
+	Line   int
+}
+
+// sorts after every instruction
+const giveUpOffset = 0x10000
+
+// attributes the errors and warnings added since the last call to the
+// instruction at offset
+func (c *Compilation) attributeDiagnostics(offset int, line int) {
+	for len(c.errorPos) < len(c.Errors) {
+		c.errorPos = append(c.errorPos, diagnosticPos{offset, line})
+	}
+	for len(c.warningPos) < len(c.Warnings) {
+		c.warningPos = append(c.warningPos, diagnosticPos{offset, line})
+	}
+}
+
+type diagnosticSorter struct {
+	messages []string
+	pos      []diagnosticPos
+}
+
+func (d diagnosticSorter) Len() int {
+	return len(d.messages)
+}
+
+func (d diagnosticSorter) Less(i, j int) bool {
+	if d.pos[i].Offset != d.pos[j].Offset {
+		return d.pos[i].Offset < d.pos[j].Offset
+	}
+	if d.pos[i].Line != d.pos[j].Line {
+		return d.pos[i].Line < d.pos[j].Line
+	}
+	return d.messages[i] < d.messages[j]
+}
+
+func (d diagnosticSorter) Swap(i, j int) {
+	d.messages[i], d.messages[j] = d.messages[j], d.messages[i]
+	d.pos[i], d.pos[j] = d.pos[j], d.pos[i]
+}
+
+// orders Errors and Warnings by offset, line and then message, so that
+// they come out the same however the passes found them. with
+// WarningsAsErrors, the warnings are moved to Errors first.
+func (c *Compilation) sortDiagnostics() {
+	c.attributeDiagnostics(-1, 0)
+	if c.Options.WarningsAsErrors {
+		c.Errors = append(c.Errors, c.Warnings...)
+		c.errorPos = append(c.errorPos, c.warningPos...)
+		c.Warnings = nil
+		c.warningPos = nil
+	}
+	sort.Stable(diagnosticSorter{c.Errors, c.errorPos})
+	sort.Stable(diagnosticSorter{c.Warnings, c.warningPos})
+}
+
+type LabelKind int
+
+const (
+	CodeLabel LabelKind = iota
+	DataLabel
+)
+
+func (k LabelKind) String() string {
+	if k == DataLabel {
+		return "data"
+	}
+	return "code"
+}
+
+type CompiledLabel struct {
+	Name string
+	Addr int
+	Kind LabelKind
+}
+
+type compiledLabelSorter []CompiledLabel
+
+func (s compiledLabelSorter) Len() int {
+	return len(s)
+}
+
+func (s compiledLabelSorter) Less(i, j int) bool {
+	if s[i].Addr != s[j].Addr {
+		return s[i].Addr < s[j].Addr
+	}
+	return s[i].Name < s[j].Name
+}
+
+func (s compiledLabelSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// every label in the program, by address and then name, so that output
+// which lists them comes out the same each time. labels followed by data
+// rather than code have no block.
+func (c *Compilation) SortedLabels() []CompiledLabel {
+	labels := make([]CompiledLabel, 0, len(c.program.Labels))
+	for name, addr := range c.program.Labels {
+		kind := CodeLabel
+		if c.labeledData[name] {
+			kind = DataLabel
+		}
+		labels = append(labels, CompiledLabel{name, addr, kind})
+	}
+	sort.Sort(compiledLabelSorter(labels))
+	return labels
+}
+
+func (c *Compilation) tooManyErrors() bool {
+	max := c.Options.MaxErrors
+	if max == 0 {
+		max = DefaultMaxErrors
+	}
+	return max > 0 && len(c.Errors) >= max
+}
+
 func (c *Compilation) visitForCompile() {
 	c.currentBlock = nil
 	for e := c.program.List.Front(); e != nil; e = e.Next() {
+		if c.tooManyErrors() {
+			c.Errors = append(c.Errors, "too many errors; giving up.")
+			c.attributeDiagnostics(giveUpOffset, 0)
+			return
+		}
+		r, ok := c.subroutineStarts[e]
+		if ok {
+			c.enterSubroutine(r)
+		}
 		switch t := e.Value.(type) {
 		default: panic("unrecognized node")
 		case *Instruction:
 			c.currentInstr = t
 			t.Compile(c)
+			c.attributeDiagnostics(t.Offset, t.Line)
 		case *LabelStatement:
 			t.Compile(c)
 		case *DataStatement:
@@ -177,8 +445,23 @@ func (c *Compilation) visitForCompile() {
 				c.builder.CreateBr(c.interpretBlock)
 				c.currentBlock = nil
 			}
+		case *AlignStatement:
+			if c.currentBlock != nil && len(t.Payload) > 0 {
+				// execution runs into the padding
+				c.builder.CreateBr(c.interpretBlock)
+				c.currentBlock = nil
+			}
+		case *ReserveStatement:
+			if c.currentBlock != nil && len(t.Payload) > 0 {
+				// execution runs into the reserved space
+				c.builder.CreateBr(c.interpretBlock)
+				c.currentBlock = nil
+			}
 		case *OrgPseudoOp:
 		}
+		if c.currentRoutine != nil && e == c.currentRoutine.last {
+			c.leaveSubroutine()
+		}
 	}
 }
 
@@ -328,6 +611,8 @@ func (c *Compilation) performLdx(v llvm.Value) {
 	c.dynTestAndSetNeg(v)
 }
 
+// compares as lval - rval without storing the result. carry is the
+// unsigned comparison lval >= rval, not the sign of the difference.
 func (c *Compilation) performCmp(lval llvm.Value, rval llvm.Value) {
 	diff := c.builder.CreateSub(lval, rval, "")
 	c.dynTestAndSetZero(diff)
@@ -382,6 +667,41 @@ func (c *Compilation) performAdc(val llvm.Value) {
 	c.dynTestAndSetZero(newA)
 	c.dynTestAndSetOverflowAddition(a, val, newA)
 	c.dynTestAndSetCarryAddition(a, val, carry)
+	if c.Options.DecimalMode {
+		c.applyDecimalAdc(a, val, carry, newA)
+	}
+}
+
+// when the D flag is set, replaces the result of adc with its BCD
+// equivalent. as on the NMOS 6502, N, V and Z keep their binary mode
+// values; only A and carry change.
+func (c *Compilation) applyDecimalAdc(a, val, carry, binaryA llvm.Value) {
+	i32 := llvm.Int32Type()
+	c4 := llvm.ConstInt(i32, 4, false)
+	c6 := llvm.ConstInt(i32, 6, false)
+	c9 := llvm.ConstInt(i32, 9, false)
+	x0f := llvm.ConstInt(i32, 0x0f, false)
+	a32 := c.builder.CreateZExt(a, i32, "")
+	v32 := c.builder.CreateZExt(val, i32, "")
+	carry32 := c.builder.CreateZExt(carry, i32, "")
+
+	// add the low digits, skipping past $a-$f
+	lo := c.builder.CreateAdd(c.builder.CreateAnd(a32, x0f, ""), c.builder.CreateAnd(v32, x0f, ""), "")
+	lo = c.builder.CreateAdd(lo, carry32, "")
+	loOver := c.builder.CreateICmp(llvm.IntUGT, lo, c9, "")
+	lo = c.builder.CreateSelect(loOver, c.builder.CreateAdd(lo, c6, ""), lo, "")
+	// add the high digits plus the carry out of the low digit
+	hi := c.builder.CreateAdd(c.builder.CreateLShr(a32, c4, ""), c.builder.CreateLShr(v32, c4, ""), "")
+	hi = c.builder.CreateAdd(hi, c.builder.CreateZExt(loOver, i32, ""), "")
+	hiOver := c.builder.CreateICmp(llvm.IntUGT, hi, c9, "")
+	hi = c.builder.CreateSelect(hiOver, c.builder.CreateAdd(hi, c6, ""), hi, "")
+	bcd := c.builder.CreateOr(c.builder.CreateShl(hi, c4, ""), c.builder.CreateAnd(lo, x0f, ""), "")
+	bcdA := c.builder.CreateTrunc(bcd, llvm.Int8Type(), "")
+
+	dec := c.builder.CreateLoad(c.rSDec, "")
+	c.builder.CreateStore(c.builder.CreateSelect(dec, bcdA, binaryA, ""), c.rA)
+	binaryCarry := c.builder.CreateLoad(c.rSCarry, "")
+	c.builder.CreateStore(c.builder.CreateSelect(dec, hiOver, binaryCarry, ""), c.rSCarry)
 }
 
 func (c *Compilation) performSbc(val llvm.Value) {
@@ -405,8 +725,45 @@ func (c *Compilation) performSbc(val llvm.Value) {
 	c.dynTestAndSetZero(newA)
 	c.dynTestAndSetOverflowSubtraction(a, val, carry)
 	c.dynTestAndSetCarrySubtraction3(a, val, carry)
+	if c.Options.DecimalMode {
+		c.applyDecimalSbc(a, val, carry, newA)
+	}
 }
 
+// when the D flag is set, replaces the result of sbc with its BCD
+// equivalent. all flags keep their binary mode values.
+func (c *Compilation) applyDecimalSbc(a, val, carry, binaryA llvm.Value) {
+	i32 := llvm.Int32Type()
+	c0 := llvm.ConstInt(i32, 0, false)
+	c1 := llvm.ConstInt(i32, 1, false)
+	c6 := llvm.ConstInt(i32, 6, false)
+	x0f := llvm.ConstInt(i32, 0x0f, false)
+	x10 := llvm.ConstInt(i32, 0x10, false)
+	x60 := llvm.ConstInt(i32, 0x60, false)
+	xf0 := llvm.ConstInt(i32, 0xf0, false)
+	a32 := c.builder.CreateZExt(a, i32, "")
+	v32 := c.builder.CreateZExt(val, i32, "")
+	carry32 := c.builder.CreateZExt(carry, i32, "")
+
+	// subtract the low digits, borrowing from the high digit if needed
+	lo := c.builder.CreateSub(c.builder.CreateAnd(a32, x0f, ""), c.builder.CreateAnd(v32, x0f, ""), "")
+	lo = c.builder.CreateSub(c.builder.CreateAdd(lo, carry32, ""), c1, "")
+	loBorrow := c.builder.CreateICmp(llvm.IntSLT, lo, c0, "")
+	loAdjusted := c.builder.CreateSub(c.builder.CreateAnd(c.builder.CreateSub(lo, c6, ""), x0f, ""), x10, "")
+	lo = c.builder.CreateSelect(loBorrow, loAdjusted, lo, "")
+	// subtract the high digits
+	hi := c.builder.CreateSub(c.builder.CreateAnd(a32, xf0, ""), c.builder.CreateAnd(v32, xf0, ""), "")
+	hi = c.builder.CreateAdd(hi, lo, "")
+	hiBorrow := c.builder.CreateICmp(llvm.IntSLT, hi, c0, "")
+	hi = c.builder.CreateSelect(hiBorrow, c.builder.CreateSub(hi, x60, ""), hi, "")
+	bcdA := c.builder.CreateTrunc(hi, llvm.Int8Type(), "")
+
+	dec := c.builder.CreateLoad(c.rSDec, "")
+	c.builder.CreateStore(c.builder.CreateSelect(dec, bcdA, binaryA, ""), c.rA)
+}
+
+// Z comes from A & val, but N and V are copied straight from bits 7
+// and 6 of val. A is left alone.
 func (c *Compilation) performBit(val llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	c0 := llvm.ConstInt(llvm.Int8Type(), 0, false)
@@ -444,6 +801,11 @@ func (c *Compilation) performEor(v llvm.Value) {
 
 func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val llvm.Value) {
 	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{val, addr})
+	c.dynWatch(addr, minAddr, maxAddr, val)
+	if c.Options.RamSize != 0 {
+		c.dynStoreFlat(addr, minAddr, maxAddr, val)
+		return
+	}
 	if maxAddr < 0x800 {
 		// wram. we don't even have to mask it
 		indexes := []llvm.Value{
@@ -501,6 +863,9 @@ func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val ll
 	c.builder.CreateCall(c.ppuMaskFn, []llvm.Value{val}, "")
 	c.builder.CreateBr(storeDoneBlock)
 
+	// ppustatus is read only. the hardware ignores the write
+	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 2, false), storeDoneBlock)
+
 	oamAddrBlock := c.createBlock("oamaddr")
 	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 3, false), oamAddrBlock)
 	c.selectBlock(oamAddrBlock)
@@ -610,6 +975,10 @@ func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val ll
 	c.builder.CreateCall(c.apuWriteTriangleCtrlFn, []llvm.Value{val}, "")
 	c.builder.CreateBr(storeDoneBlock)
 
+	// $4009 and $400d are unused. the hardware ignores the write
+	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4009, false), storeDoneBlock)
+	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400d, false), storeDoneBlock)
+
 	apuTriLowBlock := c.createBlock("rom_apu_write_trianglelow")
 	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400a, false), apuTriLowBlock)
 	c.selectBlock(apuTriLowBlock)
@@ -703,26 +1072,105 @@ func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val ll
 	c.builder.CreateCall(c.apuWriteCtrlFlags2Fn, []llvm.Value{val}, "")
 	c.builder.CreateBr(storeDoneBlock)
 
-	// if not in any known writable range
+	// this generated code runs if the write is > APU RAM range
 	c.selectBlock(notInApuRamBlock)
+	x8000 := llvm.ConstInt(llvm.Int16Type(), 0x8000, false)
+	inPrgRom := c.builder.CreateICmp(llvm.IntUGE, addr, x8000, "")
+	notInPrgRomBlock := c.createIf(inPrgRom)
+	// PRG ROM is read only; mappers use these writes to switch banks
+	c.debugPrint("rom_bankswitch\n")
+	c.builder.CreateCall(c.bankSwitchFn, []llvm.Value{addr, val}, "")
+	c.builder.CreateBr(storeDoneBlock)
+
+	// if not in any known writable range
+	c.selectBlock(notInPrgRomBlock)
 	c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
 
 	// done. X_X
 	c.selectBlock(storeDoneBlock)
 }
 
-func (c *Compilation) store(addr int, i8 llvm.Value) {
-	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{i8, llvm.ConstInt(llvm.Int16Type(), uint64(addr), false)})
+// calls rom_watch if the store is to one of the watchpoints
+func (c *Compilation) watch(addr int, i8 llvm.Value) {
+	if !c.watchAddrs[addr] {
+		return
+	}
+	addr16 := llvm.ConstInt(llvm.Int16Type(), uint64(addr), false)
+	c.builder.CreateCall(c.watchFn, []llvm.Value{addr16, i8}, "")
+}
+
+// calls rom_trace with the address and op code of the instruction about
+// to run
+func (c *Compilation) trace(i *Instruction) {
+	if !c.Options.Trace {
+		return
+	}
+	pc := llvm.ConstInt(llvm.Int16Type(), uint64(i.Offset), false)
+	opCode := llvm.ConstInt(llvm.Int8Type(), uint64(i.OpCode), false)
+	c.builder.CreateCall(c.traceFn, []llvm.Value{pc, opCode}, "")
+}
+
+// like watch, but compares addr with each watchpoint it could be at
+// runtime
+func (c *Compilation) dynWatch(addr llvm.Value, minAddr int, maxAddr int, i8 llvm.Value) {
+	for _, watchAddr := range c.Options.Watchpoints {
+		if watchAddr < minAddr || watchAddr > maxAddr {
+			continue
+		}
+		watchAddr16 := llvm.ConstInt(llvm.Int16Type(), uint64(watchAddr), false)
+		isWatched := c.builder.CreateICmp(llvm.IntEQ, addr, watchAddr16, "")
+		notWatchedBlock := c.createIf(isWatched)
+		c.builder.CreateCall(c.watchFn, []llvm.Value{addr, i8}, "")
+		c.builder.CreateBr(notWatchedBlock)
+		c.selectBlock(notWatchedBlock)
+	}
+}
+
+// calls the syscall, putchar or exit for stores to their addresses, and
+// returns whether addr was one of them
+func (c *Compilation) storeIo(addr int, i8 llvm.Value) bool {
+	syscallFn, ok := c.syscallFns[addr]
+	if ok {
+		c.builder.CreateCall(syscallFn, []llvm.Value{i8}, "")
+		return true
+	}
 
 	// homebrew ABI
 	switch addr {
 	case 0x2008: // putchar
 		i32 := c.builder.CreateZExt(i8, llvm.Int32Type(), "")
 		c.builder.CreateCall(c.putCharFn, []llvm.Value{i32}, "")
-		return
+		return true
 	case 0x2009: // exit
 		i32 := c.builder.CreateZExt(i8, llvm.Int32Type(), "")
 		c.builder.CreateCall(c.exitFn, []llvm.Value{i32}, "")
+		return true
+	}
+	return false
+}
+
+// the addresses storeIo handles, in order
+func (c *Compilation) ioAddrs() []int {
+	addrs := []int{0x2008, 0x2009}
+	for addr := range c.syscallFns {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	return addrs
+}
+
+func (c *Compilation) store(addr int, i8 llvm.Value) {
+	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{i8, llvm.ConstInt(llvm.Int16Type(), uint64(addr), false)})
+	c.watch(addr, i8)
+	if c.storeIo(addr, i8) {
+		return
+	}
+	if c.Options.RamSize != 0 && addr < 0x8000 {
+		if addr >= c.Options.RamSize {
+			c.Errors = append(c.Errors, fmt.Sprintf("writing to $%04x, which is past the end of ram", addr))
+			return
+		}
+		c.builder.CreateStore(i8, c.wramPtr(addr))
 		return
 	}
 	switch {
@@ -740,6 +1188,9 @@ func (c *Compilation) store(addr int, i8 llvm.Value) {
 		case 1: // ppumask
 			c.debugPrint("ppu_write_mask\n")
 			c.builder.CreateCall(c.ppuMaskFn, []llvm.Value{i8}, "")
+		case 2: // ppustatus
+			// read only. the hardware ignores the write
+			c.Warnings = append(c.Warnings, fmt.Sprintf("writing to read only PPU status register $%04x has no effect", addr))
 		case 3: // oamaddr
 			c.debugPrint("ppu_write_oamaddr\n")
 			c.builder.CreateCall(c.oamAddrFn, []llvm.Value{i8}, "")
@@ -789,6 +1240,9 @@ func (c *Compilation) store(addr int, i8 llvm.Value) {
 		case 0x4008:
 			c.debugPrint("rom_apu_write_trianglecontrol\n")
 			c.builder.CreateCall(c.apuWriteTriangleCtrlFn, []llvm.Value{i8}, "")
+		case 0x4009, 0x400d:
+			// unused. the hardware ignores the write
+			c.Warnings = append(c.Warnings, fmt.Sprintf("writing to unused APU register $%04x has no effect", addr))
 		case 0x400a:
 			c.debugPrint("rom_apu_write_trianglelow\n")
 			c.builder.CreateCall(c.apuWriteTriangleLowFn, []llvm.Value{i8}, "")
@@ -831,6 +1285,14 @@ func (c *Compilation) store(addr int, i8 llvm.Value) {
 			c.debugPrint("rom_apu_write_controlflags2\n")
 			c.builder.CreateCall(c.apuWriteCtrlFlags2Fn, []llvm.Value{i8}, "")
 		}
+	case 0x8000 <= addr && addr <= 0xffff:
+		// PRG ROM is read only; mappers use these writes to switch banks
+		if c.program.Mapper == 0 {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("writing to PRG ROM $%04x but mapper 0 does not switch banks", addr))
+		}
+		c.debugPrint("rom_bankswitch\n")
+		addr16 := llvm.ConstInt(llvm.Int16Type(), uint64(addr), false)
+		c.builder.CreateCall(c.bankSwitchFn, []llvm.Value{addr16, i8}, "")
 	}
 
 }
@@ -838,6 +1300,9 @@ func (c *Compilation) store(addr int, i8 llvm.Value) {
 func (c *Compilation) dynLoad(addr llvm.Value, minAddr int, maxAddr int) llvm.Value {
 	// returns the byte at addr, with runtime checks for the range between minAddr and maxAddr
 	// currently only can do WRAM stuff
+	if c.Options.RamSize != 0 {
+		return c.dynLoadFlat(addr, minAddr, maxAddr)
+	}
 	if maxAddr < 0x0800 {
 		// no runtime checks needed.
 		indexes := []llvm.Value{
@@ -977,7 +1442,111 @@ func (c *Compilation) dynLoad(addr llvm.Value, minAddr int, maxAddr int) llvm.Va
 	return c.builder.CreateLoad(result, "")
 }
 
+// dynLoad for RamSize, where there is only RAM and PRG ROM
+func (c *Compilation) dynLoadFlat(addr llvm.Value, minAddr int, maxAddr int) llvm.Value {
+	ramSize := llvm.ConstInt(llvm.Int16Type(), uint64(c.Options.RamSize), false)
+	x8000 := llvm.ConstInt(llvm.Int16Type(), 0x8000, false)
+	ramPtr := func() llvm.Value {
+		indexes := []llvm.Value{
+			llvm.ConstInt(llvm.Int16Type(), 0, false),
+			addr,
+		}
+		return c.builder.CreateGEP(c.wram, indexes, "")
+	}
+	prgRomPtr := func() llvm.Value {
+		indexes := []llvm.Value{
+			llvm.ConstInt(llvm.Int16Type(), 0, false),
+			c.builder.CreateSub(addr, x8000, ""),
+		}
+		return c.builder.CreateGEP(c.prgRom, indexes, "")
+	}
+	if maxAddr < c.Options.RamSize {
+		return c.builder.CreateLoad(ramPtr(), "")
+	}
+	if minAddr >= 0x8000 {
+		return c.builder.CreateLoad(prgRomPtr(), "")
+	}
+
+	result := c.builder.CreateAlloca(llvm.Int8Type(), "load_result")
+	loadDoneBlock := c.createBlock("LoadDone")
+	inRam := c.builder.CreateICmp(llvm.IntULT, addr, ramSize, "")
+	notInRamBlock := c.createIf(inRam)
+	c.builder.CreateStore(c.builder.CreateLoad(ramPtr(), ""), result)
+	c.builder.CreateBr(loadDoneBlock)
+
+	c.selectBlock(notInRamBlock)
+	inPrgRom := c.builder.CreateICmp(llvm.IntUGE, addr, x8000, "")
+	notInPrgRomBlock := c.createIf(inPrgRom)
+	c.builder.CreateStore(c.builder.CreateLoad(prgRomPtr(), ""), result)
+	c.builder.CreateBr(loadDoneBlock)
+
+	c.selectBlock(notInPrgRomBlock)
+	c.createPanic("invalid load address: $%04x\n", []llvm.Value{addr})
+
+	c.selectBlock(loadDoneBlock)
+	return c.builder.CreateLoad(result, "")
+}
+
+// dynStore for RamSize. stores to PRG ROM go to the mapper, as they do
+// on the NES.
+func (c *Compilation) dynStoreFlat(addr llvm.Value, minAddr int, maxAddr int, val llvm.Value) {
+	ramSize := llvm.ConstInt(llvm.Int16Type(), uint64(c.Options.RamSize), false)
+	x8000 := llvm.ConstInt(llvm.Int16Type(), 0x8000, false)
+	ramPtr := func() llvm.Value {
+		indexes := []llvm.Value{
+			llvm.ConstInt(llvm.Int16Type(), 0, false),
+			addr,
+		}
+		return c.builder.CreateGEP(c.wram, indexes, "")
+	}
+	storeDoneBlock := c.createBlock("StoreDone")
+	// the putchar, exit and syscall addresses aren't memory, even inside
+	// RamSize
+	for _, ioAddr := range c.ioAddrs() {
+		if ioAddr < minAddr || ioAddr > maxAddr {
+			continue
+		}
+		ioAddr16 := llvm.ConstInt(llvm.Int16Type(), uint64(ioAddr), false)
+		isIo := c.builder.CreateICmp(llvm.IntEQ, addr, ioAddr16, "")
+		notIoBlock := c.createIf(isIo)
+		c.storeIo(ioAddr, val)
+		c.builder.CreateBr(storeDoneBlock)
+		c.selectBlock(notIoBlock)
+	}
+	if maxAddr < c.Options.RamSize {
+		c.builder.CreateStore(val, ramPtr())
+		c.builder.CreateBr(storeDoneBlock)
+		c.selectBlock(storeDoneBlock)
+		return
+	}
+	inRam := c.builder.CreateICmp(llvm.IntULT, addr, ramSize, "")
+	notInRamBlock := c.createIf(inRam)
+	c.builder.CreateStore(val, ramPtr())
+	c.builder.CreateBr(storeDoneBlock)
+
+	c.selectBlock(notInRamBlock)
+	inPrgRom := c.builder.CreateICmp(llvm.IntUGE, addr, x8000, "")
+	notInPrgRomBlock := c.createIf(inPrgRom)
+	c.builder.CreateCall(c.bankSwitchFn, []llvm.Value{addr, val}, "")
+	c.builder.CreateBr(storeDoneBlock)
+
+	c.selectBlock(notInPrgRomBlock)
+	c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
+
+	c.selectBlock(storeDoneBlock)
+}
+
 func (c *Compilation) wramPtr(addr int) llvm.Value {
+	if c.Options.RamSize != 0 {
+		if addr < 0 || addr >= c.Options.RamSize {
+			c.Errors = append(c.Errors, fmt.Sprintf("$%04x is not in ram", addr))
+		}
+		indexes := []llvm.Value{
+			llvm.ConstInt(llvm.Int16Type(), 0, false),
+			llvm.ConstInt(llvm.Int16Type(), uint64(addr), false),
+		}
+		return c.builder.CreateGEP(c.wram, indexes, "")
+	}
 	// 2KB working RAM. mask because mirrored
 	if addr < 0 || addr >= 0x2000 {
 		c.Errors = append(c.Errors, fmt.Sprintf("$%04x is not in wram", addr))
@@ -991,6 +1560,13 @@ func (c *Compilation) wramPtr(addr int) llvm.Value {
 }
 
 func (c *Compilation) load(addr int) llvm.Value {
+	if c.Options.RamSize != 0 && addr < c.Options.RamSize {
+		return c.builder.CreateLoad(c.wramPtr(addr), "")
+	}
+	if c.Options.RamSize != 0 && addr < 0x8000 {
+		c.Errors = append(c.Errors, fmt.Sprintf("reading from $%04x, which is past the end of ram", addr))
+		return llvm.ConstNull(llvm.Int8Type())
+	}
 	switch {
 	default:
 		c.Errors = append(c.Errors, fmt.Sprintf("reading from $%04x not implemented", addr))
@@ -1041,8 +1617,37 @@ func (c *Compilation) load(addr int) llvm.Value {
 
 // loads a little endian word
 func (c *Compilation) loadWord(addr int) llvm.Value {
-	ptrByte1 := c.load(addr)
-	ptrByte2 := c.load(addr + 1)
+	return c.loadBytePair(addr, addr+1)
+}
+
+// the address of the high byte of the pointer read by jmp (addr)
+func jmpIndirectHighAddr(addr int, fixBug bool) int {
+	if addr&0xff == 0xff && !fixBug {
+		// the 6502 doesn't carry into the high byte of the address
+		return addr & 0xff00
+	}
+	return addr + 1
+}
+
+func (c *Compilation) loadBytePair(lowAddr int, highAddr int) llvm.Value {
+	ptrByte1 := c.load(lowAddr)
+	ptrByte2 := c.load(highAddr)
+	ptrByte1w := c.builder.CreateZExt(ptrByte1, llvm.Int16Type(), "")
+	ptrByte2w := c.builder.CreateZExt(ptrByte2, llvm.Int16Type(), "")
+	shiftAmt := llvm.ConstInt(llvm.Int16Type(), 8, false)
+	word := c.builder.CreateShl(ptrByte2w, shiftAmt, "")
+	return c.builder.CreateOr(word, ptrByte1w, "")
+}
+
+// returns the pointer stored in the zero page at base + X. neither the
+// sum nor the high byte of the pointer leaves the zero page.
+func (c *Compilation) dynIndirectXAddr(base int) llvm.Value {
+	index := c.builder.CreateLoad(c.rX, "")
+	baseValue := llvm.ConstInt(llvm.Int8Type(), uint64(base), false)
+	ptrAddr := c.builder.CreateAdd(baseValue, index, "")
+	ptrAddrPlusOne := c.builder.CreateAdd(ptrAddr, llvm.ConstInt(llvm.Int8Type(), 1, false), "")
+	ptrByte1 := c.dynLoad(c.builder.CreateZExt(ptrAddr, llvm.Int16Type(), ""), 0, 0xff)
+	ptrByte2 := c.dynLoad(c.builder.CreateZExt(ptrAddrPlusOne, llvm.Int16Type(), ""), 0, 0xff)
 	ptrByte1w := c.builder.CreateZExt(ptrByte1, llvm.Int16Type(), "")
 	ptrByte2w := c.builder.CreateZExt(ptrByte2, llvm.Int16Type(), "")
 	shiftAmt := llvm.ConstInt(llvm.Int16Type(), 8, false)
@@ -1061,6 +1666,59 @@ func (c *Compilation) dynLoadWord(addr llvm.Value) llvm.Value {
 	return c.builder.CreateOr(word, ptrByte1w, "")
 }
 
+// the memory operand of an undocumented instruction, as a load and a
+// store which both use the same address. the address is only computed
+// once, so read-modify-write instructions don't read pointers twice.
+func (c *Compilation) undocumentedOperand(i *Instruction) (load func() llvm.Value, store func(llvm.Value)) {
+	addrMode := opCodeTable[i.OpCode].addrMode
+	switch addrMode {
+	case zeroPageAddr, absAddr:
+		load = func() llvm.Value { return c.load(i.Value) }
+		store = func(v llvm.Value) { c.store(i.Value, v) }
+		return
+	case zeroXIndexAddr, zeroYIndexAddr:
+		indexPtr := c.rX
+		if addrMode == zeroYIndexAddr {
+			indexPtr = c.rY
+		}
+		index := c.builder.CreateLoad(indexPtr, "")
+		base := llvm.ConstInt(llvm.Int8Type(), uint64(i.Value), false)
+		addr8 := c.builder.CreateAdd(base, index, "")
+		addr := c.builder.CreateZExt(addr8, llvm.Int16Type(), "")
+		load = func() llvm.Value { return c.dynLoad(addr, 0, 0xff) }
+		store = func(v llvm.Value) { c.dynStore(addr, 0, 0xff, v) }
+		return
+	case absXAddr, absYAddr:
+		indexPtr := c.rX
+		if addrMode == absYAddr {
+			indexPtr = c.rY
+		}
+		index := c.builder.CreateLoad(indexPtr, "")
+		index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
+		base := llvm.ConstInt(llvm.Int16Type(), uint64(i.Value), false)
+		addr := c.builder.CreateAdd(base, index16, "")
+		minAddr, maxAddr := absoluteIndexedRange(i.Value)
+		load = func() llvm.Value { return c.dynLoad(addr, minAddr, maxAddr) }
+		store = func(v llvm.Value) { c.dynStore(addr, minAddr, maxAddr, v) }
+		return
+	}
+	var addr llvm.Value
+	switch addrMode {
+	case xIndexIndirectAddr:
+		addr = c.dynIndirectXAddr(i.Value)
+	case indirectYIndexAddr:
+		baseAddr := c.loadWord(i.Value)
+		rY := c.builder.CreateLoad(c.rY, "")
+		rYw := c.builder.CreateZExt(rY, llvm.Int16Type(), "")
+		addr = c.builder.CreateAdd(baseAddr, rYw, "")
+	default:
+		panic("unexpected addressing mode for undocumented instruction")
+	}
+	load = func() llvm.Value { return c.dynLoad(addr, 0, 0xffff) }
+	store = func(v llvm.Value) { c.dynStore(addr, 0, 0xffff, v) }
+	return
+}
+
 func (c *Compilation) incrementVal(v llvm.Value, delta int) llvm.Value {
 	if delta < 0 {
 		c1 := llvm.ConstInt(llvm.Int8Type(), uint64(-delta), false)
@@ -1145,9 +1803,15 @@ func (c *Compilation) pullFromStack() llvm.Value {
 	spPlusOne := c.builder.CreateAdd(sp, llvm.ConstInt(llvm.Int8Type(), 1, false), "")
 	c.builder.CreateStore(spPlusOne, c.rSP)
 	// read the value at stack pointer
-	spZExt := c.builder.CreateZExt(spPlusOne, llvm.Int16Type(), "")
-	addr := c.builder.CreateAdd(spZExt, llvm.ConstInt(llvm.Int16Type(), 0x100, false), "")
-	return c.dynLoad(addr, 0x100, 0x1ff)
+	return c.dynLoad(c.stackAddr(spPlusOne), 0x100, 0x1ff)
+}
+
+// the address in page 1 which the i8 stack pointer sp points at. sp is
+// only ever added to as a byte, so it wraps around within the page: a
+// push with SP at $00 writes $0100 and leaves SP at $ff.
+func (c *Compilation) stackAddr(sp llvm.Value) llvm.Value {
+	spZExt := c.builder.CreateZExt(sp, llvm.Int16Type(), "")
+	return c.builder.CreateOr(spZExt, llvm.ConstInt(llvm.Int16Type(), 0x100, false), "")
 }
 
 func (c *Compilation) pullWordFromStack() llvm.Value {
@@ -1162,9 +1826,7 @@ func (c *Compilation) pullWordFromStack() llvm.Value {
 func (c *Compilation) pushToStack(v llvm.Value) {
 	// write the value to the address at current stack pointer
 	sp := c.builder.CreateLoad(c.rSP, "")
-	spZExt := c.builder.CreateZExt(sp, llvm.Int16Type(), "")
-	addr := c.builder.CreateAdd(spZExt, llvm.ConstInt(llvm.Int16Type(), 0x100, false), "")
-	c.dynStore(addr, 0x100, 0x1ff, v)
+	c.dynStore(c.stackAddr(sp), 0x100, 0x1ff, v)
 	// stack pointer = stack pointer - 1
 	spMinusOne := c.builder.CreateSub(sp, llvm.ConstInt(llvm.Int8Type(), 1, false), "")
 	c.builder.CreateStore(spMinusOne, c.rSP)
@@ -1275,14 +1937,14 @@ func (c *Compilation) printf(str string, values []llvm.Value) {
 }
 
 func (c *Compilation) debugPrintf(str string, values []llvm.Value) {
-	if c.Flags&IncludeDebugFlag == 0 {
+	if c.Options.Flags&IncludeDebugFlag == 0 {
 		return
 	}
 	c.printf(str, values)
 }
 
 func (c *Compilation) debugPrintStatus() {
-	if c.Flags&IncludeDebugFlag != 0 {
+	if c.Options.Flags&IncludeDebugFlag != 0 {
 		c.printf("A $%02x  X $%02x  Y $%02x  P $%02x  PC $%04x  SP $%02x\n", []llvm.Value{
 			c.builder.CreateLoad(c.rA, ""),
 			c.builder.CreateLoad(c.rX, ""),
@@ -1295,7 +1957,10 @@ func (c *Compilation) debugPrintStatus() {
 
 }
 func (c *Compilation) createBranch(cond llvm.Value, labelName string, instrAddr int) {
-	branchBlock := c.labeledBlocks[labelName]
+	branchBlock, ok := c.localBlock(labelName)
+	if !ok {
+		branchBlock = c.interpretBlock
+	}
 	thenBlock := c.createBlock("then")
 	elseBlock := c.createBlock("else")
 	c.builder.CreateCondBr(cond, thenBlock, elseBlock)
@@ -1318,13 +1983,23 @@ func (c *Compilation) createBranch(cond llvm.Value, labelName string, instrAddr
 	c.cycle(2, instrAddr+2) // branch instructions are 2 bytes
 }
 
+// the addresses an absolute indexed operand can reach. past $ffff the
+// address wraps around to the zero page.
+func absoluteIndexedRange(baseAddr int) (int, int) {
+	if baseAddr+0xff > 0xffff {
+		return 0, 0xffff
+	}
+	return baseAddr, baseAddr + 0xff
+}
+
 func (c *Compilation) absoluteIndexedStore(valPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
 	index := c.builder.CreateLoad(indexPtr, "")
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
 	val := c.builder.CreateLoad(valPtr, "")
-	c.dynStore(addr, baseAddr, baseAddr+0xff, val)
+	minAddr, maxAddr := absoluteIndexedRange(baseAddr)
+	c.dynStore(addr, minAddr, maxAddr, val)
 	c.cycle(5, pc)
 }
 
@@ -1341,7 +2016,8 @@ func (c *Compilation) dynLoadIndexed(baseAddr int, indexPtr llvm.Value) llvm.Val
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
-	return c.dynLoad(addr, baseAddr, baseAddr+0xff)
+	minAddr, maxAddr := absoluteIndexedRange(baseAddr)
+	return c.dynLoad(addr, minAddr, maxAddr)
 }
 
 func (c *Compilation) dynStoreZpgIndexed(baseAddr int, indexPtr llvm.Value, val llvm.Value) {
@@ -1357,7 +2033,8 @@ func (c *Compilation) dynStoreIndexed(baseAddr int, indexPtr llvm.Value, val llv
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
-	c.dynStore(addr, baseAddr, baseAddr+0xff, val)
+	minAddr, maxAddr := absoluteIndexedRange(baseAddr)
+	c.dynStore(addr, minAddr, maxAddr, val)
 }
 
 func (c *Compilation) absoluteIndexedLoad(destPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
@@ -1365,13 +2042,23 @@ func (c *Compilation) absoluteIndexedLoad(destPtr llvm.Value, baseAddr int, inde
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
-	v := c.dynLoad(addr, baseAddr, baseAddr+0xff)
+	minAddr, maxAddr := absoluteIndexedRange(baseAddr)
+	v := c.dynLoad(addr, minAddr, maxAddr)
 	c.builder.CreateStore(v, destPtr)
 	c.dynTestAndSetZero(v)
 	c.dynTestAndSetNeg(v)
 	c.cyclesForAbsoluteIndexed(baseAddr, index16, pc)
 }
 
+func (c *Compilation) countPageCrossing() {
+	if !c.Options.CountPageCrossings {
+		return
+	}
+	count := c.builder.CreateLoad(c.pageCrossings, "")
+	count = c.builder.CreateAdd(count, llvm.ConstInt(llvm.Int32Type(), 1, false), "")
+	c.builder.CreateStore(count, c.pageCrossings)
+}
+
 func (c *Compilation) cyclesForIndirectY(baseAddr, addr llvm.Value, pc int) {
 	// if address & 0xff00 != (address + y) & 0xff00
 	xff00 := llvm.ConstInt(llvm.Int16Type(), uint64(0xff00), false)
@@ -1385,6 +2072,7 @@ func (c *Compilation) cyclesForIndirectY(baseAddr, addr llvm.Value, pc int) {
 	c.builder.CreateBr(loadDoneBlock)
 	// executed if page boundary crossed
 	c.selectBlock(pageBoundaryCrossedBlock)
+	c.countPageCrossing()
 	c.cycle(6, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// done
@@ -1415,6 +2103,7 @@ func (c *Compilation) cyclesForAbsoluteIndexed(baseAddr int, index16 llvm.Value,
 	c.builder.CreateBr(loadDoneBlock)
 	// executed if page boundary crossed
 	c.selectBlock(pageBoundaryCrossedBlock)
+	c.countPageCrossing()
 	c.cycle(5, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// done
@@ -1485,6 +2174,12 @@ func (c *Compilation) compileLabels(s *LabelStatement) {
 		return
 	}
 
+	r, inRoutine := c.labelRoutines[s.LabelName]
+	if inRoutine {
+		// only reachable from within the function
+		c.labeledBlocks[s.LabelName] = llvm.AddBasicBlock(r.fn, s.LabelName)
+		return
+	}
 	bb := llvm.AddBasicBlock(c.mainFn, s.LabelName)
 	c.labeledBlocks[s.LabelName] = bb
 	c.dynJumpAddrs[c.program.Labels[s.LabelName]] = bb
@@ -1502,7 +2197,9 @@ func (c *Compilation) compileLabels(s *LabelStatement) {
 func (c *Compilation) setUpEntryPoint(p *Program, addr int, s *string) {
 	e, ok := p.Offsets[addr]
 	if !ok {
-		c.Warnings = append(c.Warnings, fmt.Sprintf("Missing 0x%04x entry point", addr))
+		if !c.Options.stubsVectors() {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("Missing 0x%04x entry point", addr))
+		}
 		return
 	}
 	stmt, ok := e.Value.(*DataStatement)
@@ -1510,7 +2207,7 @@ func (c *Compilation) setUpEntryPoint(p *Program, addr int, s *string) {
 		c.Warnings = append(c.Warnings, fmt.Sprintf("Entry point at 0x%04x must be a data statement", addr))
 		return
 	}
-	if stmt.Type != WordDataStmt {
+	if stmt.Type != WordDataStmt || stmt.BigEndian {
 		c.Warnings = append(c.Warnings, fmt.Sprintf("Entry point at 0x%04x must be a word data statement", addr))
 		return
 	}
@@ -1522,6 +2219,138 @@ func (c *Compilation) setUpEntryPoint(p *Program, addr int, s *string) {
 	*s = call.LabelName
 }
 
+// the first label which isn't data, for AutoVectors
+func (c *Compilation) firstCodeLabel() string {
+	for e := c.program.List.Front(); e != nil; e = e.Next() {
+		label, ok := e.Value.(*LabelStatement)
+		if ok && !c.labeledData[label.LabelName] {
+			return label.LabelName
+		}
+	}
+	return ""
+}
+
+// for OnlyLabels, removes the code which the labels can't reach by
+// running on, branching, jumping or calling. returns the labels whose
+// code is left.
+func (c *Compilation) keepOnlyLabels() map[string]bool {
+	p := c.program
+	labelElems := map[string]*list.Element{}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		label, ok := e.Value.(*LabelStatement)
+		if ok {
+			labelElems[label.LabelName] = e
+		}
+	}
+	// jmp and jsr in disassembled code may not name their targets
+	addrLabels := map[int][]string{}
+	for name, addr := range p.Labels {
+		addrLabels[addr] = append(addrLabels[addr], name)
+	}
+
+	kept := map[string]bool{}
+	var queue []string
+	reach := func(name string) {
+		_, ok := labelElems[name]
+		if ok && !kept[name] && !c.labeledData[name] {
+			kept[name] = true
+			queue = append(queue, name)
+		}
+	}
+	for _, name := range c.Options.OnlyLabels {
+		_, ok := labelElems[name]
+		if !ok || c.labeledData[name] {
+			c.Errors = append(c.Errors, fmt.Sprintf("OnlyLabels: %s is not a label of code", name))
+			continue
+		}
+		reach(name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+	scan:
+		for e := labelElems[name].Next(); e != nil; e = e.Next() {
+			switch t := e.Value.(type) {
+			case *LabelStatement:
+				// runs on into the next label
+				reach(t.LabelName)
+				break scan
+			case *DataStatement:
+				break scan
+			case *Instruction:
+				refs := map[string]bool{}
+				if t.LabelName != "" {
+					refs[t.LabelName] = true
+				}
+				addReferencedLabels(refs, t.Expr)
+				if t.Type == DirectInstruction && opNameIs(t, "jmp", "jsr") {
+					for _, target := range addrLabels[t.Value] {
+						refs[target] = true
+					}
+				}
+				for ref := range refs {
+					reach(ref)
+				}
+				switch t.OpCode {
+				case 0x4c, 0x6c, 0x60, 0x40: // jmp, rts, rti
+					break scan
+				}
+			}
+		}
+	}
+
+	keep := false
+	for e := p.List.Front(); e != nil; {
+		next := e.Next()
+		switch t := e.Value.(type) {
+		case *LabelStatement:
+			keep = kept[t.LabelName] || c.labeledData[t.LabelName]
+			if !keep {
+				p.List.Remove(e)
+			}
+		case *Instruction:
+			if !keep {
+				if p.Offsets[t.Offset] == e {
+					delete(p.Offsets, t.Offset)
+				}
+				p.List.Remove(e)
+			}
+		}
+		e = next
+	}
+	return kept
+}
+
+// the reset routine for OnlyLabels, which calls the first label. its rts
+// returns to $0000, where rom_start returns.
+func (c *Compilation) createOnlyLabelsEntry() {
+	returnBlock := llvm.AddBasicBlock(c.mainFn, "Only_Return")
+	c.builder.SetInsertPointAtEnd(returnBlock)
+	c.builder.CreateRetVoid()
+	c.dynJumpAddrs[0] = returnBlock
+
+	entry := llvm.AddBasicBlock(c.mainFn, "Only_Entry")
+	c.selectBlock(entry)
+	c.pushWordToStack(llvm.ConstInt(llvm.Int16Type(), 0xffff, false))
+	c.builder.CreateBr(*c.resetBlock)
+	c.resetBlock = &entry
+	c.currentBlock = nil
+}
+
+// a handler for AutoVectors which does nothing. an NMI pushes the PC and
+// status first, so that handler pulls them again.
+func (c *Compilation) createAutoInterruptBlock(name string, isNmi bool) *llvm.BasicBlock {
+	bb := llvm.AddBasicBlock(c.mainFn, name)
+	c.selectBlock(bb)
+	if isNmi {
+		c.pullStatusReg()
+		pc := c.pullWordFromStack()
+		c.builder.CreateStore(pc, c.rPC)
+	}
+	c.builder.CreateRetVoid()
+	return &bb
+}
+
 func (c *Compilation) createPrgRomGlobal(prgRom [][]byte) {
 	if len(prgRom) > 2 {
 		panic("only 1-2 prg rom banks are supported")
@@ -1581,24 +2410,71 @@ func (c *Compilation) createReadChrFn(chrRom [][]byte) {
 	c.builder.CreateRetVoid()
 }
 
-func (c *Compilation) createNamedGlobal(intType llvm.Type, name string) llvm.Value {
-	val := llvm.ConstInt(intType, 0, false)
-	glob := llvm.AddGlobal(c.mod, val.Type(), name)
-	glob.SetLinkage(llvm.PrivateLinkage)
-	glob.SetInitializer(val)
-	return glob
-}
-
-func (c *Compilation) createByteRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int8Type(), name)
-}
-
-func (c *Compilation) createWordRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int16Type(), name)
-}
+// the fields of CpuState
+const (
+	cpuA = iota
+	cpuX
+	cpuY
+	cpuSP
+	cpuPC
+	cpuNeg
+	cpuOver
+	cpuBrk
+	cpuDec
+	cpuInt
+	cpuZero
+	cpuCarry
+	cpuFieldCount
+)
 
-func (c *Compilation) createBitRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int1Type(), name)
+func (c *Compilation) createCpuStateType() {
+	// named types belong to the context rather than the module, so an
+	// earlier compile's is reused instead of getting CpuState.1
+	c.cpuStateType = c.mod.GetTypeByName("CpuState")
+	if !c.cpuStateType.IsNil() {
+		return
+	}
+	i8 := llvm.Int8Type()
+	i1 := llvm.Int1Type()
+	c.cpuStateType = c.mod.Context().StructCreateNamed("CpuState")
+	c.cpuStateType.StructSetBody([]llvm.Type{
+		i8, i8, i8, i8, // A, X, Y, SP
+		llvm.Int16Type(), // PC
+		i1, i1, i1, i1, i1, i1, i1, // N, V, B, D, I, Z, C
+	}, false)
+}
+
+// a pointer to a register in the CpuState which ptr points to
+func (c *Compilation) cpuStateField(ptr llvm.Value, field int) llvm.Value {
+	i32 := llvm.Int32Type()
+	indexes := []llvm.Value{
+		llvm.ConstInt(i32, 0, false),
+		llvm.ConstInt(i32, uint64(field), false),
+	}
+	if ptr == c.cpuState {
+		// a constant, so that it can be used in any function
+		return llvm.ConstGEP(ptr, indexes)
+	}
+	return c.builder.CreateStructGEP(ptr, field, "")
+}
+
+// points the registers at the fields of the CpuState which ptr points
+// to. unless it is the global one, the pointers are computed at the
+// builder's insert point.
+func (c *Compilation) useCpuState(ptr llvm.Value) {
+	c.cpuStatePtr = ptr
+	c.rA = c.cpuStateField(ptr, cpuA)
+	c.rX = c.cpuStateField(ptr, cpuX)
+	c.rY = c.cpuStateField(ptr, cpuY)
+	c.rSP = c.cpuStateField(ptr, cpuSP)
+	c.rPC = c.cpuStateField(ptr, cpuPC)
+	c.rSNeg = c.cpuStateField(ptr, cpuNeg)
+	c.rSOver = c.cpuStateField(ptr, cpuOver)
+	c.rSBrk = c.cpuStateField(ptr, cpuBrk)
+	c.rSDec = c.cpuStateField(ptr, cpuDec)
+	c.rSInt = c.cpuStateField(ptr, cpuInt)
+	c.rSZero = c.cpuStateField(ptr, cpuZero)
+	c.rSCarry = c.cpuStateField(ptr, cpuCarry)
 }
 
 func (c *Compilation) declareReadFn(name string) llvm.Value {
@@ -1678,21 +2554,71 @@ func (c *Compilation) createFunctionDeclares() {
 	c.apuWriteDmcSampleLengthFn = c.declareWriteFn("rom_apu_write_dmcsamplelength")
 	c.apuWriteCtrlFlags1Fn = c.declareWriteFn("rom_apu_write_controlflags1")
 	c.apuWriteCtrlFlags2Fn = c.declareWriteFn("rom_apu_write_controlflags2")
+
+	// mapper
+	// declare void @rom_bankswitch(i16 addr, i8 value)
+	bankSwitchType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{llvm.Int16Type(), llvm.Int8Type()}, false)
+	c.bankSwitchFn = llvm.AddFunction(c.mod, "rom_bankswitch", bankSwitchType)
+	c.bankSwitchFn.SetLinkage(llvm.ExternalLinkage)
+
+	// declare void @rom_illegal_opcode(i16 pc, i8 opcode)
+	c.illegalOpcodeFn = llvm.AddFunction(c.mod, "rom_illegal_opcode", bankSwitchType)
+	c.illegalOpcodeFn.SetLinkage(llvm.ExternalLinkage)
+
+	// declare void @name(i8) for each syscall
+	c.syscallFns = map[int]llvm.Value{}
+	syscallType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{llvm.Int8Type()}, false)
+	for addr, name := range c.Options.Syscalls {
+		if !c.mod.NamedFunction(name).IsNil() {
+			c.Errors = append(c.Errors, fmt.Sprintf("syscall %s at $%04x has the same name as a runtime function", name, addr))
+			continue
+		}
+		fn := llvm.AddFunction(c.mod, name, syscallType)
+		fn.SetLinkage(llvm.ExternalLinkage)
+		c.syscallFns[addr] = fn
+	}
+
+	// declare void @rom_watch(i16 addr, i8 value)
+	c.watchAddrs = map[int]bool{}
+	if len(c.Options.Watchpoints) > 0 {
+		c.watchFn = llvm.AddFunction(c.mod, "rom_watch", bankSwitchType)
+		c.watchFn.SetLinkage(llvm.ExternalLinkage)
+	}
+	for _, addr := range c.Options.Watchpoints {
+		if addr < 0 || addr > 0xffff {
+			c.Errors = append(c.Errors, fmt.Sprintf("watchpoint $%x is not a memory address", addr))
+			continue
+		}
+		c.watchAddrs[addr] = true
+	}
+
+	// declare void @rom_trace(i16 pc, i8 opcode)
+	if c.Options.Trace {
+		c.traceFn = llvm.AddFunction(c.mod, "rom_trace", bankSwitchType)
+		c.traceFn.SetLinkage(llvm.ExternalLinkage)
+	}
 }
 
 func (c *Compilation) createRegisters() {
-	c.rX = c.createByteRegister("X")
-	c.rY = c.createByteRegister("Y")
-	c.rA = c.createByteRegister("A")
-	c.rSP = c.createByteRegister("SP")
-	c.rPC = c.createWordRegister("PC")
-	c.rSNeg = c.createBitRegister("S_neg")
-	c.rSOver = c.createBitRegister("S_over")
-	c.rSBrk = c.createBitRegister("S_brk")
-	c.rSDec = c.createBitRegister("S_dec")
-	c.rSInt = c.createBitRegister("S_int")
-	c.rSZero = c.createBitRegister("S_zero")
-	c.rSCarry = c.createBitRegister("S_carry")
+	c.createCpuStateType()
+
+	// start out in the reset state too, in case the runtime enters
+	// through another interrupt first
+	state := c.Options.resetState()
+	fields := make([]llvm.Value, cpuFieldCount)
+	fields[cpuA] = llvm.ConstInt(llvm.Int8Type(), uint64(state.A), false)
+	fields[cpuX] = llvm.ConstInt(llvm.Int8Type(), uint64(state.X), false)
+	fields[cpuY] = llvm.ConstInt(llvm.Int8Type(), uint64(state.Y), false)
+	fields[cpuSP] = llvm.ConstInt(llvm.Int8Type(), uint64(state.SP), false)
+	fields[cpuPC] = llvm.ConstInt(llvm.Int16Type(), 0, false)
+	for _, flag := range c.statusFlags() {
+		fields[flag.field] = boolToConstBit(state.Status&flag.mask != 0)
+	}
+
+	c.cpuState = llvm.AddGlobal(c.mod, c.cpuStateType, "Cpu")
+	c.cpuState.SetLinkage(llvm.PrivateLinkage)
+	c.cpuState.SetInitializer(llvm.ConstNamedStruct(c.cpuStateType, fields))
+	c.useCpuState(c.cpuState)
 }
 
 func (c *Compilation) addNmiInterruptCode() {
@@ -1704,31 +2630,103 @@ func (c *Compilation) addNmiInterruptCode() {
 	c.pushToStack(c.getStatusByte())
 }
 
+// replaces cycleFn with a function that forwards to rom_cycle and then
+// services an NMI every nmiCycles cycles.
+func (c *Compilation) createNmiDriver(nmiCycles int) {
+	c.frameFn = llvm.AddFunction(c.mod, "rom_frame", llvm.FunctionType(llvm.VoidType(), []llvm.Type{}, false))
+	c.frameFn.SetLinkage(llvm.ExternalLinkage)
+
+	counter := llvm.AddGlobal(c.mod, llvm.Int32Type(), "NmiCycleCounter")
+	counter.SetLinkage(llvm.PrivateLinkage)
+	counter.SetInitializer(llvm.ConstInt(llvm.Int32Type(), 0, false))
+
+	romCycleFn := c.cycleFn
+	c.cycleFn = llvm.AddFunction(c.mod, "NmiDriverCycle", romCycleFn.Type().ElementType())
+	c.cycleFn.SetLinkage(llvm.PrivateLinkage)
+	entry := llvm.AddBasicBlock(c.cycleFn, "Entry")
+	nmiBlock := llvm.AddBasicBlock(c.cycleFn, "Nmi")
+	doneBlock := llvm.AddBasicBlock(c.cycleFn, "Done")
+
+	c.builder.SetInsertPointAtEnd(entry)
+	count := c.cycleFn.Param(0)
+	c.builder.CreateCall(romCycleFn, []llvm.Value{count}, "")
+	count32 := c.builder.CreateZExt(count, llvm.Int32Type(), "")
+	total := c.builder.CreateAdd(c.builder.CreateLoad(counter, ""), count32, "")
+	cadence := llvm.ConstInt(llvm.Int32Type(), uint64(nmiCycles), false)
+	isFrame := c.builder.CreateICmp(llvm.IntUGE, total, cadence, "")
+	c.builder.CreateStore(total, counter)
+	c.builder.CreateCondBr(isFrame, nmiBlock, doneBlock)
+
+	// the counter is reset before calling the NMI routine, which
+	// itself calls back into this function
+	c.builder.SetInsertPointAtEnd(nmiBlock)
+	c.builder.CreateStore(c.builder.CreateSub(total, cadence, ""), counter)
+	c.builder.CreateCall(c.frameFn, []llvm.Value{}, "")
+	nmi := llvm.ConstInt(llvm.Int8Type(), 1, false)
+	c.builder.CreateCall(c.mainFn, []llvm.Value{nmi}, "")
+	c.builder.CreateBr(doneBlock)
+
+	c.builder.SetInsertPointAtEnd(doneBlock)
+	c.builder.CreateRetVoid()
+}
+
+// the bits of the status byte
+const (
+	statusCarry    = 0x01
+	statusZero     = 0x02
+	statusInt      = 0x04
+	statusDec      = 0x08
+	statusBrk      = 0x10
+	statusUnused   = 0x20
+	statusOverflow = 0x40
+	statusNeg      = 0x80
+)
+
+type statusFlag struct {
+	reg   llvm.Value
+	mask  byte
+	field int
+}
+
+// the register for each bit of the status byte
+func (c *Compilation) statusFlags() []statusFlag {
+	return []statusFlag{
+		{c.rSNeg, statusNeg, cpuNeg},
+		{c.rSOver, statusOverflow, cpuOver},
+		{c.rSBrk, statusBrk, cpuBrk},
+		{c.rSDec, statusDec, cpuDec},
+		{c.rSInt, statusInt, cpuInt},
+		{c.rSZero, statusZero, cpuZero},
+		{c.rSCarry, statusCarry, cpuCarry},
+	}
+}
+
+func boolToConstBit(b bool) llvm.Value {
+	if b {
+		return llvm.ConstInt(llvm.Int1Type(), 1, false)
+	}
+	return llvm.ConstInt(llvm.Int1Type(), 0, false)
+}
+
 func (c *Compilation) addResetInterruptCode() {
 	// TODO: move this reset initialization to a separate block
 	c.builder.SetInsertPointBefore(c.resetBlock.FirstInstruction())
 	// set registers
-	c0 := llvm.ConstInt(llvm.Int8Type(), 0, false)
-	xfd := llvm.ConstInt(llvm.Int8Type(), 0xfd, false)
-	bit0 := llvm.ConstInt(llvm.Int1Type(), 0, false)
-	bit1 := llvm.ConstInt(llvm.Int1Type(), 1, false)
-	c.builder.CreateStore(c0, c.rX)
-	c.builder.CreateStore(c0, c.rY)
-	c.builder.CreateStore(c0, c.rA)
-	c.builder.CreateStore(xfd, c.rSP)
-
-	c.builder.CreateStore(bit0, c.rSNeg)
-	c.builder.CreateStore(bit0, c.rSOver)
-	c.builder.CreateStore(bit1, c.rSBrk)
-	c.builder.CreateStore(bit0, c.rSDec)
-	c.builder.CreateStore(bit1, c.rSInt)
-	c.builder.CreateStore(bit0, c.rSZero)
-	c.builder.CreateStore(bit0, c.rSCarry)
+	state := c.Options.resetState()
+	c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), uint64(state.X), false), c.rX)
+	c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), uint64(state.Y), false), c.rY)
+	c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), uint64(state.A), false), c.rA)
+	c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), uint64(state.SP), false), c.rSP)
+	for _, flag := range c.statusFlags() {
+		c.builder.CreateStore(boolToConstBit(state.Status&flag.mask != 0), flag.reg)
+	}
 }
 
 func (c *Compilation) addDynJumpTable() {
 	// here we create a basic block that we jump to for instructions such as
-	// BRK, RTS, and RTI.
+	// BRK, RTS, RTI and indirect JMP, whose target is only known at run
+	// time. it switches on the PC to the labeled block at that address;
+	// anything else is interpreted.
 	c.builder.SetInsertPointAtEnd(c.dynJumpBlock)
 	pc := c.builder.CreateLoad(c.rPC, "")
 	sw := c.builder.CreateSwitch(pc, c.interpretBlock, len(c.dynJumpAddrs))
@@ -1897,6 +2895,169 @@ func (c *Compilation) createReadMemFn() {
 	c.builder.CreateRet(v)
 }
 
+const (
+	regA = 1 << iota
+	regX
+	regY
+)
+
+var regNames = map[int]string{regA: "A", regX: "X", regY: "Y"}
+
+// returns which of A, X and Y the instruction reads and writes
+func registerUsage(opName string, addrMode AddrMode) (reads int, writes int) {
+	switch addrMode {
+	case absXAddr, zeroXIndexAddr, xIndexIndirectAddr:
+		reads |= regX
+	case absYAddr, zeroYIndexAddr, indirectYIndexAddr:
+		reads |= regY
+	}
+	switch opName {
+	case "lda", "pla":
+		writes |= regA
+	case "ldx", "tsx":
+		writes |= regX
+	case "ldy":
+		writes |= regY
+	case "sta", "pha", "cmp", "bit":
+		reads |= regA
+	case "stx", "txs", "cpx":
+		reads |= regX
+	case "sty", "cpy":
+		reads |= regY
+	case "tax":
+		reads |= regA
+		writes |= regX
+	case "tay":
+		reads |= regA
+		writes |= regY
+	case "txa":
+		reads |= regX
+		writes |= regA
+	case "tya":
+		reads |= regY
+		writes |= regA
+	case "inx", "dex":
+		reads |= regX
+		writes |= regX
+	case "iny", "dey":
+		reads |= regY
+		writes |= regY
+	case "adc", "sbc", "and", "ora", "eor", "isc":
+		reads |= regA
+		writes |= regA
+	case "lax":
+		writes |= regA | regX
+	case "sax":
+		reads |= regA | regX
+	case "dcp":
+		reads |= regA
+	case "asl", "lsr", "rol", "ror":
+		if addrMode == impliedAddr {
+			reads |= regA
+			writes |= regA
+		}
+	}
+	return
+}
+
+// the mappers the generated code works with. the PRG ROM banks are fixed
+// when the program is compiled, so mappers which switch them can't be
+// supported, and rom_bankswitch is left to switch anything else.
+var supportedMappers = map[byte]string{
+	0: "NROM",
+}
+
+func (c *Compilation) checkMapper() {
+	_, ok := supportedMappers[c.program.Mapper]
+	if !ok {
+		c.Warnings = append(c.Warnings, fmt.Sprintf("mapper %d is not supported, so bank switching won't work", c.program.Mapper))
+	}
+}
+
+// warns about the blocks of labels with no predecessors. code at a label
+// nothing jumps to is dead, or codegen left out a branch to it.
+func (c *Compilation) checkOrphanBlocks() {
+	names := make([]string, 0, len(c.labeledBlocks))
+	for name := range c.labeledBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case c.nmiLabelName, c.resetLabelName, c.irqLabelName:
+			continue
+		}
+		if c.hasPredecessors(c.labeledBlocks[name]) {
+			continue
+		}
+		c.Warnings = append(c.Warnings, fmt.Sprintf("$%04x: block %s has no predecessors", c.program.Labels[name], name))
+		c.attributeDiagnostics(c.program.Labels[name], 0)
+	}
+}
+
+// the dynamic jump table has a case for every label, so its switch
+// doesn't count
+func (c *Compilation) hasPredecessors(bb llvm.BasicBlock) bool {
+	for use := bb.AsValue().FirstUse(); !use.IsNil(); use = use.NextUse() {
+		if use.User().InstructionParent() != c.dynJumpBlock {
+			return true
+		}
+	}
+	return false
+}
+
+// warns about instructions after reset which read A, X or Y before
+// anything is written to them. to avoid false positives this only
+// follows the straight line code at the reset label, stopping at the
+// first label, data, or jump.
+func (c *Compilation) checkUninitializedRegisters() {
+	e := c.program.List.Front()
+	for ; e != nil; e = e.Next() {
+		label, ok := e.Value.(*LabelStatement)
+		if ok && label.LabelName == c.resetLabelName {
+			break
+		}
+	}
+	if e == nil {
+		return
+	}
+	written := 0
+	for e = e.Next(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			return
+		}
+		info := opCodeTable[i.OpCode]
+		reads, writes := registerUsage(info.opName, info.addrMode)
+		for _, reg := range []int{regA, regX, regY} {
+			if reads&reg != 0 && written&reg == 0 {
+				c.Warnings = append(c.Warnings, fmt.Sprintf("$%04x: %s reads register %s before it is written", i.Offset, info.opName, regNames[reg]))
+				c.attributeDiagnostics(i.Offset, i.Line)
+				// only warn once per register
+				written |= reg
+			}
+		}
+		written |= writes
+		switch i.OpCode {
+		case 0x4c, 0x6c, 0x20, 0x60, 0x40, 0x00: // jmp, jsr, rts, rti, brk
+			return
+		}
+	}
+}
+
+// warns about stores which may overwrite instructions. the basic blocks
+// are fixed at compile time, so a store into the code has no effect on
+// what runs. with a mapper, stores to PRG ROM switch banks instead.
+func (c *Compilation) checkCodeWrites() {
+	for _, w := range c.program.CodeWrites() {
+		if w.TargetOffset >= 0x8000 && c.program.Mapper != 0 {
+			continue
+		}
+		c.Warnings = append(c.Warnings, fmt.Sprintf("$%04x: %s $%04x may overwrite the instruction at $%04x (line %d). self-modifying code can't be recompiled; this routine needs the interpreter", w.Offset, w.OpName, w.Address, w.TargetOffset, w.TargetLine))
+		c.attributeDiagnostics(w.Offset, w.Line)
+	}
+}
+
 func (c *Compilation) addLabelsAfterJsrs() {
 	for e := c.program.List.Front(); e != nil; e = e.Next() {
 		i, ok := e.Value.(*Instruction)
@@ -1906,11 +3067,15 @@ func (c *Compilation) addLabelsAfterJsrs() {
 	}
 }
 
-func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation, error) {
-	llvm.InitializeNativeTarget()
-
+// runs every pass and verifies the resulting module. problems end up in
+// c.Errors rather than being returned.
+func (p *Program) buildModule(opts CompileOptions) *Compilation {
+	if len(opts.OnlyLabels) > 0 {
+		// the code left out is removed from the copy
+		p = p.Clone()
+	}
 	c := new(Compilation)
-	c.Flags = flags
+	c.Options = opts
 	c.program = p
 	c.mod = llvm.NewModule("asm_module")
 	c.builder = llvm.NewBuilder()
@@ -1919,13 +3084,25 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	c.labeledBlocks = map[string]llvm.BasicBlock{}
 	c.stringTable = map[string]llvm.Value{}
 	c.dynJumpAddrs = map[int]llvm.BasicBlock{}
+	defer c.sortDiagnostics()
 
 	c.addLabelsAfterJsrs()
 
-	// 2KB memory
-	memType := llvm.ArrayType(llvm.Int8Type(), 0x800)
-	c.wram = llvm.AddGlobal(c.mod, memType, "wram")
-	c.wram.SetLinkage(llvm.PrivateLinkage)
+	// 2KB memory, or RamSize. the first 256 bytes are the zero page,
+	// followed by the stack page and the rest of RAM. exported so that
+	// the runtime can address it directly.
+	//uint8_t rom_wram[0x800];
+	ramSize := 0x800
+	if opts.RamSize != 0 {
+		if opts.RamSize < 0x200 || opts.RamSize > MaxRamSize {
+			c.Errors = append(c.Errors, fmt.Sprintf("RamSize $%x must be between $200 and $%x", opts.RamSize, MaxRamSize))
+			return c
+		}
+		ramSize = opts.RamSize
+	}
+	memType := llvm.ArrayType(llvm.Int8Type(), ramSize)
+	c.wram = llvm.AddGlobal(c.mod, memType, "rom_wram")
+	c.wram.SetLinkage(llvm.ExternalLinkage)
 	c.wram.SetInitializer(llvm.ConstNull(memType))
 
 	//uint8_t rom_mirroring;
@@ -1933,6 +3110,7 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	mirroringGlobal := llvm.AddGlobal(c.mod, mirroringConst.Type(), "rom_mirroring")
 	mirroringGlobal.SetLinkage(llvm.ExternalLinkage)
 	mirroringGlobal.SetInitializer(mirroringConst)
+	c.checkMapper()
 
 	c.createFunctionDeclares()
 	c.createReadChrFn(p.ChrRom)
@@ -1941,11 +3119,23 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	// first pass to figure out which blocks are "data" and which are "code"
 	c.visitForControlFlow()
 	if len(c.Errors) > 0 {
-		return c, nil
+		return c
+	}
+	var kept map[string]bool
+	if len(opts.OnlyLabels) > 0 {
+		kept = c.keepOnlyLabels()
+		if len(c.Errors) > 0 {
+			return c
+		}
 	}
 
 	c.setupControllerFramework()
 	c.createRegisters()
+	if opts.CountPageCrossings {
+		c.pageCrossings = llvm.AddGlobal(c.mod, llvm.Int32Type(), "rom_page_crossings")
+		c.pageCrossings.SetLinkage(llvm.ExternalLinkage)
+		c.pageCrossings.SetInitializer(llvm.ConstInt(llvm.Int32Type(), 0, false))
+	}
 
 	// main function / entry point
 	mainType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{llvm.Int8Type()}, false)
@@ -1953,32 +3143,69 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	c.mainFn.SetFunctionCallConv(llvm.CCallConv)
 	entry := llvm.AddBasicBlock(c.mainFn, "Entry")
 
+	if opts.NmiCycles > 0 {
+		c.createNmiDriver(opts.NmiCycles)
+	}
+
 	// set up entry points
 	c.setUpEntryPoint(p, 0xfffa, &c.nmiLabelName)
 	c.setUpEntryPoint(p, 0xfffc, &c.resetLabelName)
 	c.setUpEntryPoint(p, 0xfffe, &c.irqLabelName)
+	if opts.AutoVectors && c.resetLabelName == "" {
+		c.resetLabelName = c.firstCodeLabel()
+	}
+	if len(opts.OnlyLabels) > 0 {
+		c.resetLabelName = opts.OnlyLabels[0]
+		for _, name := range []*string{&c.nmiLabelName, &c.irqLabelName} {
+			if !kept[*name] || *name == c.resetLabelName {
+				*name = ""
+			}
+		}
+	}
+
+	c.attributeDiagnostics(-1, 0)
+	c.checkUninitializedRegisters()
+
+	c.findSubroutines()
 
 	// second pass to build basic blocks
 	c.visitForBasicBlocks()
+	if len(opts.OnlyLabels) > 0 {
+		c.createOnlyLabelsEntry()
+	}
 
 	c.interpretBlock = llvm.AddBasicBlock(c.mainFn, "Interpret")
 	c.dynJumpBlock = llvm.AddBasicBlock(c.mainFn, "DynJumpTable")
+	c.mainInterpretBlock = c.interpretBlock
+	c.mainDynJumpBlock = c.dynJumpBlock
 	c.addInterpretBlock()
 	c.addDynJumpTable()
 
 	// finally, one last pass for codegen
+	c.attributeDiagnostics(-1, 0)
 	c.visitForCompile()
+	if len(c.Errors) > 0 {
+		return c
+	}
+	c.attributeDiagnostics(-1, 0)
+	c.checkCodeWrites()
 
 	c.createReadMemFn()
 
 	// hook up entry points
+	if c.nmiBlock == nil && opts.stubsVectors() {
+		c.nmiBlock = c.createAutoInterruptBlock("Auto_NMI_Routine", true)
+	}
+	if c.irqBlock == nil && opts.stubsVectors() {
+		c.irqBlock = c.createAutoInterruptBlock("Auto_IRQ_Routine", false)
+	}
 	if c.nmiBlock == nil {
 		c.Errors = append(c.Errors, "missing nmi entry point")
-		return c, nil
+		return c
 	}
 	if c.resetBlock == nil {
 		c.Errors = append(c.Errors, "missing reset entry point")
-		return c, nil
+		return c
 	}
 	if c.irqBlock == nil {
 		c.Warnings = append(c.Warnings, "missing irq entry point; inserting dummy.")
@@ -2002,15 +3229,54 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	c.addNmiInterruptCode()
 	c.addResetInterruptCode()
 
-	if flags&DumpModulePreFlag != 0 {
+	if opts.Flags&LintBlocksFlag != 0 {
+		c.attributeDiagnostics(-1, 0)
+		c.checkOrphanBlocks()
+	}
+	if opts.Flags&DumpModulePreFlag != 0 {
 		c.mod.Dump()
 	}
 	err := llvm.VerifyModule(c.mod, llvm.ReturnStatusAction)
 	if err != nil {
 		c.Errors = append(c.Errors, err.Error())
+	}
+	return c
+}
+
+// a variable so that tests can simulate a platform LLVM doesn't support
+var initializeNativeTarget = llvm.InitializeNativeTarget
+
+func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation, error) {
+	return p.CompileToFileWithOptions(file, CompileOptions{Flags: flags})
+}
+
+func (p *Program) CompileToFileWithOptions(file *os.File, opts CompileOptions) (*Compilation, error) {
+	if opts.ObjectFile && opts.TargetTriple == "" {
+		opts.TargetTriple = llvm.DefaultTargetTriple()
+	}
+	if opts.TargetTriple == "" {
+		err := initializeNativeTarget()
+		if err != nil {
+			c := &Compilation{Options: opts, program: p}
+			c.Errors = append(c.Errors, fmt.Sprintf("no native target available; set CompileOptions.TargetTriple for AOT: %s", err.Error()))
+			return c, nil
+		}
+	} else {
+		llvm.InitializeAllTargetInfos()
+		llvm.InitializeAllTargets()
+		llvm.InitializeAllTargetMCs()
+		llvm.InitializeAllAsmPrinters()
+	}
+
+	c := p.buildModule(opts)
+	if len(c.Errors) > 0 {
 		return c, nil
 	}
 
+	if opts.TargetTriple != "" {
+		return c, c.emitObjectFile(file)
+	}
+
 	engine, err := llvm.NewJITCompiler(c.mod, 3)
 	if err != nil {
 		c.Errors = append(c.Errors, err.Error())
@@ -2018,11 +3284,28 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	}
 	defer engine.Dispose()
 
-	if flags&DisableOptFlag == 0 {
+	c.optimize(engine.TargetData())
+
+	if opts.Flags&DumpModuleFlag != 0 {
+		c.mod.Dump()
+	}
+
+	err = llvm.WriteBitcodeToFile(c.mod, file)
+
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+func (c *Compilation) optimize(targetData llvm.TargetData) {
+	if c.Options.Flags&DisableOptFlag == 0 {
 		pass := llvm.NewPassManager()
 		defer pass.Dispose()
 
-		pass.Add(engine.TargetData())
+		pass.Add(targetData)
+		pass.AddFunctionInliningPass()
 		pass.AddConstantPropagationPass()
 		pass.AddInstructionCombiningPass()
 		pass.AddPromoteMemoryToRegisterPass()
@@ -2032,27 +3315,112 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 		pass.AddGlobalDCEPass()
 		pass.Run(c.mod)
 	}
+}
 
-	if flags&DumpModuleFlag != 0 {
-		c.mod.Dump()
+// compiles the module for Options.TargetTriple rather than the host and
+// writes the object code to file. a target which this build of LLVM
+// doesn't support is reported in Errors.
+func (c *Compilation) emitObjectFile(file *os.File) error {
+	triple := c.Options.TargetTriple
+	target, err := llvm.GetTargetFromTriple(triple)
+	if err != nil {
+		c.Errors = append(c.Errors, fmt.Sprintf("target %s is not available: %s", triple, err.Error()))
+		return nil
 	}
+	machine := target.CreateTargetMachine(triple, "", "", llvm.CodeGenLevelDefault, llvm.RelocPIC, llvm.CodeModelDefault)
+	defer machine.Dispose()
+	c.mod.SetTarget(triple)
+	c.mod.SetDataLayout(machine.TargetData().String())
 
-	err = llvm.WriteBitcodeToFile(c.mod, file)
+	c.optimize(machine.TargetData())
+
+	if c.Options.Flags&DumpModuleFlag != 0 {
+		c.mod.Dump()
+	}
 
+	buf, err := machine.EmitToMemoryBuffer(c.mod, llvm.ObjectFile)
 	if err != nil {
-		return c, err
+		c.Errors = append(c.Errors, err.Error())
+		return nil
 	}
+	defer buf.Dispose()
+	_, err = file.Write(buf.Bytes())
+	return err
+}
 
-	return c, nil
+// what Program.Compile produced
+type CompileResult struct {
+	Module   llvm.Module
+	Warnings []string
+	Errors   []string
+	// the bitcode or object file written
+	Filename string
+	// see Compilation.SortedLabels
+	Labels []CompiledLabel
+	// nil unless CompileOptions.SourceMap is set
+	SourceMap *SourceMap
+}
+
+type CompileErrors []string
+
+func (errs CompileErrors) Error() string {
+	return strings.Join(errs, "\n")
+}
+
+// like CompileToFilenameWithOptions, but a failed compilation is reported as a
+// CompileErrors error, and leaves no output file behind.
+func (p *Program) Compile(filename string, opts CompileOptions) (*CompileResult, error) {
+	c, err := p.CompileToFilenameWithOptions(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	result := &CompileResult{
+		Module:   c.mod,
+		Warnings: c.Warnings,
+		Errors:   c.Errors,
+		Filename: filename,
+		Labels:   c.SortedLabels(),
+	}
+	if opts.SourceMap {
+		result.SourceMap = c.SourceMap()
+	}
+	if len(c.Errors) > 0 {
+		os.Remove(filename)
+		return result, CompileErrors(c.Errors)
+	}
+	return result, nil
+}
+
+// compiles and verifies the module like Compile, but stops there. no
+// file is written and no JIT is created, so it only checks the program.
+func (p *Program) Verify(opts CompileOptions) (*CompileResult, error) {
+	c := p.buildModule(opts)
+	result := &CompileResult{
+		Module:   c.mod,
+		Warnings: c.Warnings,
+		Errors:   c.Errors,
+		Labels:   c.SortedLabels(),
+	}
+	if opts.SourceMap {
+		result.SourceMap = c.SourceMap()
+	}
+	if len(c.Errors) > 0 {
+		return result, CompileErrors(c.Errors)
+	}
+	return result, nil
 }
 
 func (p *Program) CompileToFilename(filename string, flags CompileFlags) (*Compilation, error) {
+	return p.CompileToFilenameWithOptions(filename, CompileOptions{Flags: flags})
+}
+
+func (p *Program) CompileToFilenameWithOptions(filename string, opts CompileOptions) (*Compilation, error) {
 	fd, err := os.Create(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := p.CompileToFile(fd, flags)
+	c, err := p.CompileToFileWithOptions(fd, opts)
 	err2 := fd.Close()
 
 	if err != nil {
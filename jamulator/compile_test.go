@@ -0,0 +1,927 @@
+package jamulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// assembles source into a PRG bank with the reset vector pointing at the
+// start of source, then compiles it.
+func compileSource(source string) (*Compilation, error) {
+	return compileSourceWithOptions(source, CompileOptions{})
+}
+
+func compileSourceWithOptions(source string, opts CompileOptions) (*Compilation, error) {
+	program, err := assembleTestProgram(source)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := ioutil.TempFile("", "jamulator")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	return program.CompileToFileWithOptions(fd, opts)
+}
+
+func assembleTestProgram(source string) (*Program, error) {
+	fullSource := ".org $c000\nReset_Routine:\n" + source +
+		"\nNMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	programAst, err := Parse(strings.NewReader(fullSource))
+	if err != nil {
+		return nil, err
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		return nil, errors.New(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		return nil, err
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+	return program, nil
+}
+
+func TestCompileZeroPage(t *testing.T) {
+	c, err := compileSource("lda #$42\nsta $10\nldx $10\nstx $07ff\ninc $10\nsta $00, x\nldy $0810\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if len(c.Warnings) > 0 {
+		t.Error(fmt.Sprintf("unexpected warnings: %s", strings.Join(c.Warnings, "\n")))
+	}
+}
+
+func TestCompileAbsoluteIndexed(t *testing.T) {
+	c, err := compileSource("ldx #$02\nldy #$01\nlda $0300, x\nsta $0400, y\nlsr $0300, x\ncmp $0400, y\n" +
+		"lda $ffff, x\nsta $ff80, y\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	// the effective addresses are checked by TestCompileExecutableAbsoluteIndexed
+	rangeTests := []struct {
+		base, min, max int
+	}{
+		{0x0300, 0x0300, 0x03ff},
+		{0xff00, 0xff00, 0xffff},
+		{0xff01, 0x0000, 0xffff},
+		{0xffff, 0x0000, 0xffff},
+	}
+	for _, rt := range rangeTests {
+		min, max := absoluteIndexedRange(rt.base)
+		if min != rt.min || max != rt.max {
+			t.Error(fmt.Sprintf("$%04x: expected $%04x-$%04x, got $%04x-$%04x", rt.base, rt.min, rt.max, min, max))
+		}
+	}
+}
+
+// writes which do nothing on the NES compile with a warning each
+func TestCompileIgnoredWrites(t *testing.T) {
+	writeTests := []struct {
+		source  string
+		warning string
+	}{
+		{"lda #$80\nsta $2000\nlda $2002\nsta $2002\n", "writing to read only PPU status register $2002 has no effect"},
+		{"lda #$0f\nsta $4015\nsta $4009\n", "writing to unused APU register $4009 has no effect"},
+		{"lda #$01\nsta $8000\n", "writing to PRG ROM $8000 but mapper 0 does not switch banks"},
+	}
+	for _, wt := range writeTests {
+		c, err := compileSource(wt.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Errors) > 0 {
+			t.Error(fmt.Sprintf("%q: unexpected errors: %s", wt.source, strings.Join(c.Errors, "\n")))
+		}
+		if len(c.Warnings) != 1 || c.Warnings[0] != wt.warning {
+			t.Error(fmt.Sprintf("%q: expected warning %q, got %q", wt.source, wt.warning, c.Warnings))
+		}
+	}
+}
+
+func TestCompileNmiDriver(t *testing.T) {
+	// a main loop that never returns, relying on the driver to run the
+	// NMI routine between frames
+	c, err := compileSourceWithOptions("Loop:\njmp Loop\n", CompileOptions{NmiCycles: 29781})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+}
+
+func TestCompileDecimalMode(t *testing.T) {
+	// $09 + $01 is $10 in BCD
+	source := "sed\nlda #$09\nclc\nadc #$01\nsta $00\nsec\nsbc #$01\nsta $01\ncld\n"
+	for _, decimal := range []bool{false, true} {
+		c, err := compileSourceWithOptions(source, CompileOptions{DecimalMode: decimal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Errors) > 0 {
+			t.Error(fmt.Sprintf("decimal mode %t: unexpected errors: %s", decimal, strings.Join(c.Errors, "\n")))
+		}
+	}
+}
+
+// subtracts $10 from $50 with each of the addressing modes sbc has
+const sbcModesSource = "lda #$10\nsta $10\nsta $0300\nlda #$00\nsta $20\nlda #$03\nsta $21\nldx #$00\nldy #$00\n" +
+	"sec\nlda #$50\nsbc #$10\nsec\nlda #$50\nsbc $10\nsec\nlda #$50\nsbc $10, x\n" +
+	"sec\nlda #$50\nsbc $0300\nsec\nlda #$50\nsbc $0300, x\nsec\nlda #$50\nsbc $0300, y\n" +
+	"sec\nlda #$50\nsbc ($20, x)\nsec\nlda #$50\nsbc ($20), y\n"
+
+func TestCompileSbc(t *testing.T) {
+	c, err := compileSource(sbcModesSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+}
+
+func TestCompilePhp(t *testing.T) {
+	c, err := compileSource("sec\nphp\nclc\nplp\nphp\npla\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+}
+
+func TestCompileCompare(t *testing.T) {
+	// equal, greater and less for each register, across addressing modes
+	c, err := compileSource("lda #$40\nldx #$40\nldy #$40\nsta $10\nsta $0300\n" +
+		"cmp #$40\ncmp #$20\ncmp #$80\ncmp $10\ncmp $0300\n" +
+		"cpx #$40\ncpx #$20\ncpx #$80\ncpx $10\ncpx $0300\n" +
+		"cpy #$40\ncpy #$20\ncpy #$80\ncpy $10\ncpy $0300\n" +
+		"lda #$00\nsta $20\nlda #$03\nsta $21\nldy #$00\nldx #$00\ncmp ($20), y\ncmp ($20, x)\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+}
+
+func TestCompileJmpToSelf(t *testing.T) {
+	c, err := compileSource("lda #$80\nsta $2000\nforever:\njmp forever\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if len(c.Warnings) != 1 || !strings.Contains(c.Warnings[0], "jmp forever jumps to itself") {
+		t.Error(fmt.Sprintf("expected infinite loop warning, got: %q", c.Warnings))
+	}
+}
+
+func TestCompileWarningsAsErrors(t *testing.T) {
+	program, err := assembleTestProgram("lda #$80\nsta $2000\nforever:\njmp forever\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := program.Verify(CompileOptions{})
+	if err != nil {
+		t.Error(fmt.Sprintf("unexpected error: %s", err.Error()))
+	}
+	if len(result.Warnings) != 1 {
+		t.Error(fmt.Sprintf("expected 1 warning, got %q", result.Warnings))
+	}
+
+	result, err = program.Verify(CompileOptions{WarningsAsErrors: true})
+	if err == nil {
+		t.Fatal("expected the warning to fail the compile")
+	}
+	if len(result.Warnings) != 0 || len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "jmp forever jumps to itself") {
+		t.Error(fmt.Sprintf("expected the warning as an error, got errors %q, warnings %q", result.Errors, result.Warnings))
+	}
+}
+
+func TestCompileUninitializedRegister(t *testing.T) {
+	c, err := compileSource("tax\nlda #$00\nsta $00, x\ninx\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if len(c.Warnings) != 1 || !strings.Contains(c.Warnings[0], "tax reads register A") {
+		t.Error(fmt.Sprintf("expected warning about reading A, got: %q", c.Warnings))
+	}
+}
+
+func TestCompileResetState(t *testing.T) {
+	state := &RegisterState{A: 0x12, X: 0x34, Y: 0x56, SP: 0xff, Status: 0x01}
+	for _, opts := range []CompileOptions{CompileOptions{}, CompileOptions{ResetState: state}} {
+		c, err := compileSourceWithOptions("sta $00\nstx $01\nsty $02\nbcs Done\nDone:\nrts\n", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Errors) > 0 {
+			t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+		}
+	}
+	if (CompileOptions{}).resetState() != PowerOnState {
+		t.Error("expected the power on state by default")
+	}
+	if (CompileOptions{ResetState: state}).resetState() != *state {
+		t.Error("expected the custom reset state")
+	}
+}
+
+func TestCompileErrorLimit(t *testing.T) {
+	// adc (zp, x) is not supported by the compiler
+	source := strings.Repeat("adc ($10, x)\n", 50)
+	c, err := compileSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != DefaultMaxErrors+1 || !strings.Contains(c.Errors[DefaultMaxErrors], "too many errors") {
+		t.Error(fmt.Sprintf("expected %d errors, got %d", DefaultMaxErrors+1, len(c.Errors)))
+	}
+
+	c, err = compileSourceWithOptions(source, CompileOptions{MaxErrors: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 6 {
+		t.Error(fmt.Sprintf("expected 6 errors, got %d", len(c.Errors)))
+	}
+}
+
+func TestCompileDiagnosticOrder(t *testing.T) {
+	source := "lda #$01\nsta $5003\nlax $10\nsta $5001\n"
+	opts := CompileOptions{Syscalls: map[int]string{
+		0x5010: "rom_cycle",
+		0x5011: "rom_frame",
+		0x5012: "rom_ppu_read_status",
+	}}
+	c, err := compileSourceWithOptions(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// by offset rather than by message
+	expected := []string{
+		"writing to memory address 0x5003 is unsupported",
+		"$c005: undocumented instruction lax $10 is only compiled with AllowIllegal",
+		"writing to memory address 0x5001 is unsupported",
+	}
+	errs := c.Errors[len(c.Errors)-len(expected):]
+	if strings.Join(errs, "\n") != strings.Join(expected, "\n") {
+		t.Error(fmt.Sprintf("expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(c.Errors, "\n")))
+	}
+	for n := 0; n < 10; n++ {
+		again, err := compileSourceWithOptions(source, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(again.Errors, "\n") != strings.Join(c.Errors, "\n") {
+			t.Fatal(fmt.Sprintf("errors changed order:\n%s\nthen:\n%s", strings.Join(c.Errors, "\n"), strings.Join(again.Errors, "\n")))
+		}
+	}
+}
+
+func TestCompileJmpIndirectBug(t *testing.T) {
+	// pointer low byte at $02ff, high byte at $0200 on a real 6502
+	if jmpIndirectHighAddr(0x02ff, false) != 0x0200 {
+		t.Error(fmt.Sprintf("expected high byte from $0200, got $%04x", jmpIndirectHighAddr(0x02ff, false)))
+	}
+	if jmpIndirectHighAddr(0x02ff, true) != 0x0300 {
+		t.Error(fmt.Sprintf("expected high byte from $0300, got $%04x", jmpIndirectHighAddr(0x02ff, true)))
+	}
+	if jmpIndirectHighAddr(0x02fe, false) != 0x02ff {
+		t.Error(fmt.Sprintf("expected high byte from $02ff, got $%04x", jmpIndirectHighAddr(0x02fe, false)))
+	}
+	source := "lda #$00\nsta $02ff\nlda #$c0\nsta $0200\njmp ($02ff)\n"
+	for _, fix := range []bool{false, true} {
+		c, err := compileSourceWithOptions(source, CompileOptions{FixJmpBug: fix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Errors) > 0 {
+			t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+		}
+	}
+}
+
+func TestCompileUndocumented(t *testing.T) {
+	// lax $10, then loop forever
+	source := ".org $c000\nReset_Routine:\ndc.b $a7, $10\nLoop:\njmp Loop\n" +
+		"NMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	bin, err := assembleSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// left as data unless asked for
+	program, err := Disassemble(bytes.NewReader(bin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elem, ok := program.Offsets[0xc000]
+	if ok {
+		if _, isInstr := elem.Value.(*Instruction); isInstr {
+			t.Error("disassembled lax without AllowIllegal")
+		}
+	}
+
+	program, err = DisassembleWithOptions(bytes.NewReader(bin), DisassembleOptions{AllowIllegal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elem, ok = program.Offsets[0xc000]
+	if !ok {
+		t.Fatal("nothing disassembled at $c000")
+	}
+	i, ok := elem.Value.(*Instruction)
+	if !ok || i.OpName != "lax" || i.Value != 0x10 {
+		t.Fatal(fmt.Sprintf("expected lax $10 at $c000, got %#v", elem.Value))
+	}
+
+	// recompile the disassembly, from its source
+	sourceBuf := new(bytes.Buffer)
+	err = program.WriteSource(sourceBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sourceBuf.String(), "lax $10") {
+		t.Error(fmt.Sprintf("expected lax $10 in disassembly:\n%s", sourceBuf.String()))
+	}
+	c, err := compileSourceWithOptions("lax $10\nsax $11\ndcp $12, x\nisc ($14), y\n", CompileOptions{AllowIllegal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	c, err = compileSource("lax $10\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 1 || !strings.Contains(c.Errors[0], "AllowIllegal") {
+		t.Error(fmt.Sprintf("expected an AllowIllegal error, got %q", c.Errors))
+	}
+}
+
+func TestCompileNop(t *testing.T) {
+	c, err := compileSource("nop\nnop\nlda #$01\nnop\nsta $10\nnop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+
+	illegal := "nop #$01\nnop $10\nnop $10, x\nnop $0300\nnop $0300, x\n"
+	bin, err := assembleSource(illegal + "nop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x80, 0x01, 0x04, 0x10, 0x14, 0x10, 0x0c, 0x00, 0x03, 0x1c, 0x00, 0x03, 0xea}
+	if !bytes.Equal(bin, expected) {
+		t.Error(fmt.Sprintf("expected % x, got % x", expected, bin))
+	}
+	c, err = compileSourceWithOptions(illegal, CompileOptions{AllowIllegal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	c, err = compileSource(illegal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 5 {
+		t.Error(fmt.Sprintf("expected 5 AllowIllegal errors, got %q", c.Errors))
+	}
+}
+
+func TestCompileTargetTriple(t *testing.T) {
+	triple := "armv7-unknown-linux-gnueabihf"
+	c, err := compileSourceWithOptions("lda #$01\nLoop:\njmp Loop\n", CompileOptions{TargetTriple: triple})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) == 1 && strings.HasPrefix(c.Errors[0], "target "+triple+" is not available") {
+		t.Skip(c.Errors[0])
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+}
+
+func TestCompileResult(t *testing.T) {
+	source := ".org $c000\nReset_Routine:\nadc ($10, x)\nNMI_Routine:\nrti\nIRQ_Routine:\nrti\n" +
+		".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+	programAst, err := Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/prg.bc"
+	result, err := program.Compile(filename, CompileOptions{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, ok := err.(CompileErrors); !ok {
+		t.Error(fmt.Sprintf("expected CompileErrors, got %T", err))
+	}
+	if result == nil || len(result.Errors) == 0 {
+		t.Error("expected the errors in the result")
+	}
+	if _, err := os.Stat(filename); err == nil {
+		t.Error("output file left behind after a failed compile")
+	}
+}
+
+func TestCompileCountPageCrossings(t *testing.T) {
+	// $10ff + $ff crosses into page $11, and ($20), y crosses if the
+	// pointer is near the end of a page
+	source := "ldx #$ff\nlda $10ff, x\nldy #$10\nlda ($20), y\n"
+	for _, count := range []bool{false, true} {
+		c, err := compileSourceWithOptions(source, CompileOptions{CountPageCrossings: count})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Errors) > 0 {
+			t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		vectors       string
+		expectedError string
+	}{
+		{".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n", ""},
+		{".org $fffa\ndc.w NMI_Routine\n", "missing reset entry point"},
+	}
+	for _, tt := range tests {
+		source := ".org $c000\nReset_Routine:\nlda #$01\nsta $10\nNMI_Routine:\nrti\nIRQ_Routine:\nrti\n" + tt.vectors
+		programAst, err := Parse(strings.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program := programAst.ToProgram()
+		buf := new(bytes.Buffer)
+		err = program.Assemble(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		program.PrgRom = [][]byte{buf.Bytes()}
+
+		result, err := program.Verify(CompileOptions{})
+		if tt.expectedError == "" {
+			if err != nil {
+				t.Error(fmt.Sprintf("unexpected errors: %s", err.Error()))
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+			t.Error(fmt.Sprintf("expected error %q, got %v", tt.expectedError, err))
+		}
+		if result == nil || result.Filename != "" {
+			t.Error("expected a result with no file")
+		}
+	}
+}
+
+func TestCompileSyscall(t *testing.T) {
+	source := "lda #$07\nsta $5000\n"
+	c, err := compileSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) == 0 {
+		t.Error("expected a store to $5000 to be unsupported without a syscall")
+	}
+
+	opts := CompileOptions{Syscalls: map[int]string{0x5000: "host_play_sound"}}
+	c, err = compileSourceWithOptions(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	_, ok := c.syscallFns[0x5000]
+	if !ok {
+		t.Error("expected host_play_sound to be declared for $5000")
+	}
+}
+
+func TestCompileNoNativeTarget(t *testing.T) {
+	defer func(orig func() error) { initializeNativeTarget = orig }(initializeNativeTarget)
+	initializeNativeTarget = func() error {
+		return errors.New("unsupported host")
+	}
+	c, err := compileSource("nop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 1 || !strings.Contains(c.Errors[0], "no native target available; set CompileOptions.TargetTriple for AOT") {
+		t.Error(fmt.Sprintf("expected a native target error, got %q", c.Errors))
+	}
+}
+
+func TestCompileCodeWrites(t *testing.T) {
+	c, err := compileSource("lda #$e8\nsta Patch\nsta $0200\nPatch:\nnop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, w := range c.Warnings {
+		if strings.Contains(w, "self-modifying") {
+			found += 1
+			if !strings.HasPrefix(w, "$c002: sta $c008 may overwrite the instruction at $c008 (line 7)") {
+				t.Error(fmt.Sprintf("unexpected warning: %s", w))
+			}
+		}
+	}
+	if found != 1 {
+		t.Error(fmt.Sprintf("expected one self-modifying code warning, got %q", c.Warnings))
+	}
+}
+
+// picks the second entry of a jump table with an indirect jmp
+const jumpTableSource = "ldx #$02\nlda Table, x\nsta $00\nlda Table+1, x\nsta $01\njmp ($0000)\n" +
+	"First:\nlda #$01\nsta $2009\n" +
+	"Second:\nlda #$02\nsta $2009\n" +
+	"Table:\ndc.w First, Second\n"
+
+func TestCompileJumpTable(t *testing.T) {
+	c, err := compileSource(jumpTableSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Fatal(strings.Join(c.Errors, "\n"))
+	}
+	for _, name := range []string{"First", "Second"} {
+		_, ok := c.dynJumpAddrs[c.program.Labels[name]]
+		if !ok {
+			t.Error(fmt.Sprintf("expected %s in the dispatch block", name))
+		}
+	}
+	_, ok := c.dynJumpAddrs[c.program.Labels["Table"]]
+	if ok {
+		t.Error("data should not be in the dispatch block")
+	}
+
+	program, err := assembleTestProgram(jumpTableSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Interpret(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExitCode != 2 {
+		t.Error(fmt.Sprintf("expected the jump table to reach Second, got exit code %d", m.ExitCode))
+	}
+}
+
+func TestCompileWatchpoints(t *testing.T) {
+	source := "lda #$07\nsta $0300\nldx #$01\nsta $02ff,x\n"
+	c, err := compileSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.watchFn.IsNil() {
+		t.Error("expected rom_watch not to be declared without watchpoints")
+	}
+
+	opts := CompileOptions{Watchpoints: []int{0x0300}}
+	c, err = compileSourceWithOptions(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if !c.watchAddrs[0x0300] {
+		t.Error("expected stores to $0300 to call rom_watch")
+	}
+
+	opts = CompileOptions{Watchpoints: []int{0x10000}}
+	c, err = compileSourceWithOptions(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) == 0 {
+		t.Error("expected an error for a watchpoint outside of memory")
+	}
+}
+
+func TestCompileRamSize(t *testing.T) {
+	// $2002 is the read only PPU status register on the NES
+	source := "lda #$07\nsta $2000\nsta $2002\nldx #$02\nsta $4000, x\nlda $2002\nlda $3fff, x\n"
+	c, err := compileSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Warnings) == 0 {
+		t.Error("expected a warning about the PPU status register")
+	}
+
+	c, err = compileSourceWithOptions(source, CompileOptions{RamSize: MaxRamSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if len(c.Warnings) > 0 {
+		t.Error(fmt.Sprintf("unexpected warnings: %s", strings.Join(c.Warnings, "\n")))
+	}
+
+	c, err = compileSourceWithOptions(source, CompileOptions{RamSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) == 0 || !strings.Contains(c.Errors[0], "past the end of ram") {
+		t.Error(fmt.Sprintf("expected $2000 to be past the end of ram, got %q", c.Errors))
+	}
+
+	c, err = compileSourceWithOptions(source, CompileOptions{RamSize: 0x100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 1 || !strings.Contains(c.Errors[0], "RamSize $100") {
+		t.Error(fmt.Sprintf("expected RamSize $100 to be rejected, got %q", c.Errors))
+	}
+}
+
+func TestCompileSubroutines(t *testing.T) {
+	source := "jsr Double\njsr Wait\njsr Into\njmp Done\n" +
+		"Double:\nasl a\nrts\n" +
+		"Wait:\ndex\nbne Wait\nrts\n" +
+		"Fall:\nnop\nInto:\nrts\n" +
+		"Shared:\nnop\nrts\n" +
+		"Done:\njsr Shared\njmp Shared\n"
+	c, err := compileSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Fatal(strings.Join(c.Errors, "\n"))
+	}
+	for _, name := range []string{"Double", "Wait"} {
+		if c.subroutines[name] == nil {
+			t.Error(fmt.Sprintf("expected %s to be compiled as a function", name))
+		}
+	}
+	if c.labelRoutines["Wait"] != c.subroutines["Wait"] {
+		t.Error("expected the loop in Wait to be in its function")
+	}
+	// Into is run into from Fall, and Shared is the target of a jmp
+	for _, name := range []string{"Into", "Shared"} {
+		if c.subroutines[name] != nil {
+			t.Error(fmt.Sprintf("expected %s to stay in rom_start", name))
+		}
+	}
+}
+
+func TestCompileCpuState(t *testing.T) {
+	c, err := compileSource("lda #$01\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Fatal(strings.Join(c.Errors, "\n"))
+	}
+	if c.cpuStateType.StructName() != "CpuState" {
+		t.Error(fmt.Sprintf("expected the CpuState type, got %q", c.cpuStateType.StructName()))
+	}
+	// and the same type again, rather than CpuState.1
+	again, err := compileSource("lda #$02\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.cpuStateType.StructName() != "CpuState" {
+		t.Error(fmt.Sprintf("expected the second compile to reuse CpuState, got %q", again.cpuStateType.StructName()))
+	}
+	// A, X, Y, SP, PC and then the status flags from N to C
+	widths := []int{8, 8, 8, 8, 16, 1, 1, 1, 1, 1, 1, 1}
+	fields := c.cpuStateType.StructElementTypes()
+	if len(fields) != len(widths) {
+		t.Fatal(fmt.Sprintf("expected %d fields, got %d", len(widths), len(fields)))
+	}
+	for i, field := range fields {
+		if field.IntTypeWidth() != widths[i] {
+			t.Error(fmt.Sprintf("expected field %d to be i%d, got i%d", i, widths[i], field.IntTypeWidth()))
+		}
+	}
+}
+
+func TestCompileAutoVectors(t *testing.T) {
+	programAst, err := Parse(strings.NewReader(".org $c000\nStart:\nlda #$01\nsta $00\nLoop:\njmp Loop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+	fd, err := ioutil.TempFile("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	c, err := program.CompileToFileWithOptions(fd, CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) == 0 {
+		t.Error("expected an error without interrupt vectors")
+	}
+
+	c, err = program.CompileToFileWithOptions(fd, CompileOptions{AutoVectors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Error(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	if c.resetLabelName != "Start" {
+		t.Error(fmt.Sprintf("expected to start at Start, got %q", c.resetLabelName))
+	}
+	// the infinite loop is still worth a warning
+	for _, warning := range c.Warnings {
+		if !strings.Contains(warning, "infinite loop") {
+			t.Error(fmt.Sprintf("unexpected warning: %s", warning))
+		}
+	}
+}
+
+func TestCompileOrphanBlocks(t *testing.T) {
+	program, err := assembleTestProgram("ldx #$03\nLoop:\ndex\nbne Loop\njsr Done\nDone:\nrts\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := program.buildModule(CompileOptions{Flags: LintBlocksFlag})
+	if len(c.Errors) > 0 {
+		t.Fatal(strings.Join(c.Errors, "\n"))
+	}
+	for _, warning := range c.Warnings {
+		if strings.Contains(warning, "no predecessors") {
+			t.Error(fmt.Sprintf("unexpected warning: %s", warning))
+		}
+	}
+
+	// nothing branches to Orphan, though the dynamic jump table has a case
+	// for it
+	program, err = assembleTestProgram("lda #$01\nrts\nOrphan:\nlda #$02\nrts\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = program.buildModule(CompileOptions{Flags: LintBlocksFlag})
+	if len(c.Errors) > 0 {
+		t.Fatal(strings.Join(c.Errors, "\n"))
+	}
+	orphans := []string{}
+	for _, warning := range c.Warnings {
+		if strings.Contains(warning, "no predecessors") {
+			orphans = append(orphans, warning)
+		}
+	}
+	if len(orphans) != 1 || !strings.Contains(orphans[0], "block Orphan has no predecessors") {
+		t.Error(fmt.Sprintf("expected a warning about Orphan, got %q", c.Warnings))
+	}
+}
+
+func TestCompileSortedLabels(t *testing.T) {
+	c, err := compileSource("ldx Table\nLoop:\ndex\nbne Loop\njmp Done\nTable:\ndc.b 3\nDone:\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := c.SortedLabels()
+	kinds := map[string]LabelKind{}
+	for i, label := range labels {
+		kinds[label.Name] = label.Kind
+		if i > 0 && compiledLabelSorter(labels).Less(i, i-1) {
+			t.Error(fmt.Sprintf("%s at $%04x is after %s at $%04x", label.Name, label.Addr, labels[i-1].Name, labels[i-1].Addr))
+		}
+	}
+	if len(labels) != len(c.program.Labels) {
+		t.Error(fmt.Sprintf("expected %d labels, got %d", len(c.program.Labels), len(labels)))
+	}
+	kind, ok := kinds["Table"]
+	if !ok || kind != DataLabel {
+		t.Error(fmt.Sprintf("expected Table to be a data label, got %v", kind))
+	}
+	kind, ok = kinds["Loop"]
+	if !ok || kind != CodeLabel {
+		t.Error(fmt.Sprintf("expected Loop to be a code label, got %v", kind))
+	}
+}
+
+// prints ABC, or BC with OnlyLabels of Second
+const onlyLabelsTestSource = `jsr First
+jsr Second
+lda #$00
+sta $2009
+First:
+lda #$41
+sta $2008
+rts
+Second:
+lda #$42
+sta $2008
+jsr Helper
+rts
+Helper:
+lda #$43
+sta $2008
+rts
+`
+
+func TestCompileOnlyLabels(t *testing.T) {
+	c, err := compileSourceWithOptions(onlyLabelsTestSource, CompileOptions{OnlyLabels: []string{"Second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Fatal(fmt.Sprintf("unexpected errors: %s", strings.Join(c.Errors, "\n")))
+	}
+	for _, name := range []string{"Second", "Helper"} {
+		if _, ok := c.labeledBlocks[name]; !ok {
+			t.Error(fmt.Sprintf("expected a block for %s", name))
+		}
+	}
+	for _, name := range []string{"Reset_Routine", "First", "NMI_Routine", "IRQ_Routine"} {
+		if _, ok := c.labeledBlocks[name]; ok {
+			t.Error(fmt.Sprintf("%s was compiled", name))
+		}
+	}
+
+	c, err = compileSourceWithOptions(onlyLabelsTestSource, CompileOptions{OnlyLabels: []string{"Nowhere"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) != 1 || !strings.Contains(c.Errors[0], "Nowhere") {
+		t.Error(fmt.Sprintf("expected an error about Nowhere, got %q", c.Errors))
+	}
+}
+
+func TestCompileSourceMap(t *testing.T) {
+	c, err := compileSource("lda #$01\nLoop:\ndex\nbne Loop\njmp Done\nTable:\ndc.b 3\nDone:\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := map[string]SourceMapBlock{}
+	for _, block := range c.SourceMap().Blocks {
+		blocks[block.Label] = block
+	}
+	if _, ok := blocks["Table"]; ok {
+		t.Error("data label Table has a block")
+	}
+	loop, ok := blocks["Loop"]
+	if !ok {
+		t.Fatal("no block for Loop")
+	}
+	// dex is on line 5, after the .org and Reset_Routine
+	expected := []SourceMapLine{{0xc002, 5}, {0xc003, 6}, {0xc005, 7}}
+	if loop.Function != "rom_start" || loop.Address != 0xc002 || fmt.Sprint(loop.Lines) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("expected Loop at $c002 with lines %v, got %#v", expected, loop))
+	}
+}
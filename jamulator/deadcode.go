@@ -0,0 +1,134 @@
+package jamulator
+
+// removes code which can never run, and labels which nothing refers to
+
+// adds the labels which expr refers to
+func addReferencedLabels(refs map[string]bool, expr interface{}) {
+	switch t := expr.(type) {
+	case *LabelCall:
+		refs[t.LabelName] = true
+	case *BinaryExpr:
+		addReferencedLabels(refs, t.Left)
+		addReferencedLabels(refs, t.Right)
+	case *ByteExpr:
+		addReferencedLabels(refs, t.Expr)
+	}
+}
+
+// adds the labels whose size expr takes with sizeof
+func addSizedLabels(sized map[string]bool, expr interface{}) {
+	switch t := expr.(type) {
+	case *SizeofExpr:
+		sized[t.LabelName] = true
+	case *BinaryExpr:
+		addSizedLabels(sized, t.Left)
+		addSizedLabels(sized, t.Right)
+	case *ByteExpr:
+		addSizedLabels(sized, t.Expr)
+	}
+}
+
+// the labels used anywhere in the program. labels whose address is the
+// operand of a jmp or jsr count too, since disassembled code may not
+// name its targets. so do the labels taken with sizeof, and the label
+// which ends each of their regions, since removing it would change the
+// size.
+func (p *Program) referencedLabels() map[string]bool {
+	refs := make(map[string]bool)
+	sized := make(map[string]bool)
+	targets := make(map[int]bool)
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *Instruction:
+			if t.LabelName != "" {
+				refs[t.LabelName] = true
+			}
+			addReferencedLabels(refs, t.Expr)
+			addSizedLabels(sized, t.Expr)
+			if t.Type == DirectInstruction && opNameIs(t, "jmp", "jsr") {
+				targets[t.Value] = true
+			}
+		case *DataStatement:
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				addReferencedLabels(refs, de.Value)
+				addSizedLabels(sized, de.Value)
+			}
+		case *AssignStatement:
+			addReferencedLabels(refs, t.Expr)
+			addSizedLabels(sized, t.Expr)
+		}
+	}
+	for name, addr := range p.Labels {
+		if targets[addr] {
+			refs[name] = true
+		}
+	}
+	// a region runs to the next label past its start, or to an .org
+	regionStart := -1
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *OrgPseudoOp:
+			regionStart = -1
+		case *LabelStatement:
+			addr := p.Labels[t.LabelName]
+			if regionStart >= 0 && addr > regionStart {
+				refs[t.LabelName] = true
+				regionStart = -1
+			}
+			if sized[t.LabelName] {
+				refs[t.LabelName] = true
+				regionStart = addr
+			}
+		}
+	}
+	return refs
+}
+
+// removes instructions which can't be reached: those after a jmp, rts or
+// rti up to the next label which is referenced. labels which are never
+// referenced are removed as well, except for entryPoints. the interrupt
+// vectors refer to the NMI, reset and IRQ routines, so they are kept
+// without being listed. returns the number of bytes removed.
+//
+// like Optimize, this moves code, so it is not suitable for code which
+// depends on its own addresses.
+func (p *Program) EliminateDeadCode(entryPoints ...string) int {
+	removed := 0
+	for {
+		refs := p.referencedLabels()
+		for _, name := range entryPoints {
+			refs[name] = true
+		}
+		changed := false
+		reachable := true
+		for e := p.List.Front(); e != nil; {
+			next := e.Next()
+			switch t := e.Value.(type) {
+			case *LabelStatement:
+				if refs[t.LabelName] {
+					reachable = true
+				} else {
+					p.List.Remove(e)
+					changed = true
+				}
+			case *Instruction:
+				if !reachable {
+					removed += len(t.Payload)
+					p.List.Remove(e)
+					changed = true
+				} else if opNameIs(t, "jmp", "rts", "rti") {
+					reachable = false
+				}
+			}
+			e = next
+		}
+		if !changed {
+			break
+		}
+		p.resolveAgain()
+		if len(p.Errors) > 0 {
+			break
+		}
+	}
+	return removed
+}
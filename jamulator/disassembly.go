@@ -16,11 +16,24 @@ type Renderer interface {
 	Render() string
 }
 
+type DisassembleOptions struct {
+	// decode the stable undocumented op codes, such as lax, instead of
+	// leaving them as data
+	AllowIllegal bool
+	// names for the labels at these addresses, such as from a symbol
+	// file. other labels are named after their address.
+	Symbols map[int]string
+	// addresses of code which can't be found by following the program
+	// from its interrupt vectors, such as the targets of indirect jumps
+	EntryPoints []int
+}
+
 type Disassembly struct {
 	prog       *Program
 	offset     int
 	dynJumps   []int
 	jumpTables map[int]bool
+	opts       DisassembleOptions
 }
 
 func (d *Disassembly) elemAsByte(elem *list.Element) (byte, error) {
@@ -87,6 +100,36 @@ func (p *Program) getLabelAt(addr int, name string) (string, error) {
 	return i.LabelName, nil
 }
 
+// whether addr is in PRG ROM where the source puts it. a single bank is
+// at $c000, and a label for its mirror at $8000 would go there instead.
+func (d *Disassembly) inBank(addr int) bool {
+	return addr >= 0x10000-0x4000*len(d.prog.PrgRom) && addr <= 0xffff
+}
+
+// a label for the operand of the instruction at addr. it can't go on the
+// instruction's own operand bytes, which are about to be removed.
+func (d *Disassembly) operandLabelAt(addr int, size int, target int) (string, error) {
+	if target > addr && target < addr+size {
+		return "", errors.New("cannot label an instruction's own operand")
+	}
+	return d.labelAt(target, "")
+}
+
+// like getLabelAt, but a name from opts.Symbols wins over name
+func (d *Disassembly) labelAt(addr int, name string) (string, error) {
+	if !d.inBank(addr) {
+		return "", errors.New(fmt.Sprintf("$%04x is not in the bank", addr))
+	}
+	symbol, ok := d.opts.Symbols[addr]
+	if ok {
+		_, taken := d.prog.Labels[symbol]
+		if !taken {
+			name = symbol
+		}
+	}
+	return d.prog.getLabelAt(addr, name)
+}
+
 func (d *Disassembly) removeElemAt(addr int) {
 	elem := d.prog.elemAtAddr(addr)
 	d.prog.List.Remove(elem)
@@ -273,14 +316,20 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 		// already decoded as instruction
 		return nil
 	}
+	opCodeInfo := opCodeTable[opCode]
+	if opCodeInfo.illegal || (opCodeInfo.undocumented && !d.opts.AllowIllegal) {
+		return errors.New("cannot disassemble as instruction: bad op code")
+	}
+	if opNameToOpCode[opCodeInfo.addrMode][opCodeInfo.opName] != opCode {
+		// another encoding of nop, which would reassemble differently
+		return errors.New("cannot disassemble as instruction: ambiguous op code")
+	}
 	i := new(Instruction)
-	opCodeInfo := opCodeDataMap[opCode]
 	i.OpName = opCodeInfo.opName
 	i.OpCode = opCode
+	i.AddressingMode = AddressingMode(opCodeInfo.addrMode)
 	i.Offset = addr
 	switch opCodeInfo.addrMode {
-	case nilAddr:
-		return errors.New("cannot disassemble as instruction: bad op code")
 	case absAddr:
 		// convert data statements into instruction statement
 		w, err := d.elemAsWord(elem.Next())
@@ -290,7 +339,7 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 		i.Value = int(w)
 		i.Payload = []byte{opCode, 0, 0}
 		binary.LittleEndian.PutUint16(i.Payload[1:], w)
-		i.LabelName, err = d.prog.getLabelAt(i.Value, "")
+		i.LabelName, err = d.operandLabelAt(addr, 3, i.Value)
 		if err == nil {
 			i.Type = DirectWithLabelInstruction
 		} else {
@@ -328,7 +377,7 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 		i.Value = int(w)
 		i.Payload = []byte{opCode, 0, 0}
 		binary.LittleEndian.PutUint16(i.Payload[1:], w)
-		i.LabelName, err = d.prog.getLabelAt(i.Value, "")
+		i.LabelName, err = d.operandLabelAt(addr, 3, i.Value)
 		if err == nil {
 			i.Type = DirectWithLabelIndexedInstruction
 		} else {
@@ -422,12 +471,18 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 		if err != nil {
 			return err
 		}
+		target := addr + 2 + int(int8(v))
+		if !d.inBank(target) {
+			// there's nowhere to put the label, so the branch is left
+			// as bytes
+			return errors.New("cannot disassemble as instruction: branch out of the bank")
+		}
 		i.Type = DirectWithLabelInstruction
-		i.Value = addr + 2 + int(int8(v))
+		i.Value = target
 		i.Payload = []byte{opCode, v}
-		i.LabelName, err = d.prog.getLabelAt(i.Value, "")
+		i.LabelName, err = d.operandLabelAt(addr, 2, i.Value)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		elem.Value = i
 
@@ -556,7 +611,7 @@ func (d *Disassembly) markAsDataWordLabel(addr int, suggestedName string) error
 		return nil
 	}
 
-	labelName, err := d.prog.getLabelAt(targetAddr, suggestedName)
+	labelName, err := d.labelAt(targetAddr, suggestedName)
 	if err != nil {
 		tmp := IntegerDataItem(targetAddr)
 		newStmt.dataList.PushBack(&tmp)
@@ -771,11 +826,21 @@ func (d *Disassembly) resolveDynJumpCases() {
 }
 
 func (r *Rom) Disassemble() (*Program, error) {
+	return r.DisassembleWithOptions(DisassembleOptions{})
+}
+
+func (r *Rom) DisassembleWithOptions(opts DisassembleOptions) (*Program, error) {
 	if len(r.PrgRom) != 1 && len(r.PrgRom) != 2 {
 		return nil, errors.New("only 1 or 2 prg rom banks supported")
 	}
+	for i, bank := range r.PrgRom {
+		if len(bank) != 0x4000 {
+			return nil, errors.New(fmt.Sprintf("prg rom bank %d is %d bytes; expected 16KB", i, len(bank)))
+		}
+	}
 
 	dis := new(Disassembly)
+	dis.opts = opts
 	dis.jumpTables = make(map[int]bool)
 	dis.prog = new(Program)
 	dis.prog.List = list.New()
@@ -790,6 +855,19 @@ func (r *Rom) Disassemble() (*Program, error) {
 	dis.markAsDataWordLabel(0xfffa, "NMI_Routine")
 	dis.markAsDataWordLabel(0xfffc, "Reset_Routine")
 	dis.markAsDataWordLabel(0xfffe, "IRQ_Routine")
+	for _, addr := range opts.EntryPoints {
+		if addr < 0x8000 || addr > 0xffff {
+			return nil, errors.New(fmt.Sprintf("entry point $%04x is not in PRG ROM", addr))
+		}
+		err := dis.markAsInstruction(addr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("entry point $%04x: %s", addr, err.Error()))
+		}
+		_, err = dis.labelAt(addr, "")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("entry point $%04x: %s", addr, err.Error()))
+		}
+	}
 
 	// go over the dynamic jumps that we found and mark the options as labels
 	dis.resolveDynJumpCases()
@@ -802,18 +880,23 @@ func (r *Rom) Disassemble() (*Program, error) {
 	p.ChrRom = r.ChrRom
 	p.PrgRom = r.PrgRom
 	p.Mirroring = r.Mirroring
+	p.Mapper = r.Mapper
 
 	return p, nil
 }
 
 func Disassemble(reader io.Reader) (*Program, error) {
+	return DisassembleWithOptions(reader, DisassembleOptions{})
+}
+
+func DisassembleWithOptions(reader io.Reader, opts DisassembleOptions) (*Program, error) {
 	r := new(Rom)
 	bank, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 	r.PrgRom = append(r.PrgRom, bank)
-	return r.Disassemble()
+	return r.DisassembleWithOptions(opts)
 }
 
 func DisassembleFile(filename string) (*Program, error) {
@@ -834,27 +917,83 @@ func DisassembleFile(filename string) (*Program, error) {
 	return p, nil
 }
 
+func (op ExprOperator) String() string {
+	switch op {
+	case AddOperator:
+		return "+"
+	case SubOperator:
+		return "-"
+	case MulOperator:
+		return "*"
+	case DivOperator:
+		return "/"
+	}
+	panic("unexpected ExprOperator")
+}
+
+func (op ExprOperator) precedence() int {
+	if op == MulOperator || op == DivOperator {
+		return 2
+	}
+	return 1
+}
+
+func renderExpr(node interface{}) string {
+	switch t := node.(type) {
+	case *IntegerDataItem:
+		return fmt.Sprintf("$%02x", int(*t))
+	case *LabelCall:
+		return t.LabelName
+	case *SizeofExpr:
+		return fmt.Sprintf("sizeof(%s)", t.LabelName)
+	case *BinaryExpr:
+		left := renderExpr(t.Left)
+		right := renderExpr(t.Right)
+		// only parenthesize where precedence demands it
+		l, ok := t.Left.(*BinaryExpr)
+		if ok && l.Op.precedence() < t.Op.precedence() {
+			left = "(" + left + ")"
+		}
+		r, ok := t.Right.(*BinaryExpr)
+		if ok && r.Op.precedence() <= t.Op.precedence() {
+			right = "(" + right + ")"
+		}
+		return fmt.Sprintf("%s %s %s", left, t.Op.String(), right)
+	case *ByteExpr:
+		if t.High {
+			return fmt.Sprintf(".hibyte(%s)", renderExpr(t.Expr))
+		}
+		return fmt.Sprintf(".lobyte(%s)", renderExpr(t.Expr))
+	}
+	panic("unexpected expression node")
+}
+
 func (i *Instruction) Render() string {
+	if i.Expr != nil {
+		return i.renderExpr()
+	}
 	switch i.Type {
 	case ImmediateInstruction:
 		return fmt.Sprintf("%s #$%02x", i.OpName, i.Value)
 	case ImpliedInstruction:
 		return i.OpName
+	case AccumulatorInstruction:
+		return fmt.Sprintf("%s %s", i.OpName, i.RegisterName)
 	case DirectInstruction:
-		if opCodeDataMap[i.OpCode].addrMode == zeroPageAddr {
+		if opCodeTable[i.OpCode].addrMode == zeroPageAddr {
 			return fmt.Sprintf("%s $%02x", i.OpName, i.Value)
 		}
-		return fmt.Sprintf("%s $%04x", i.OpName, i.Value)
+		return fmt.Sprintf("%s %s$%04x", i.OpName, i.forceAbsolutePrefix(), i.Value)
 	case DirectWithLabelInstruction:
-		return fmt.Sprintf("%s %s", i.OpName, i.LabelName)
+		return fmt.Sprintf("%s %s%s", i.OpName, i.forceAbsolutePrefix(), i.LabelName)
 	case DirectIndexedInstruction:
-		addrMode := opCodeDataMap[i.OpCode].addrMode
+		addrMode := opCodeTable[i.OpCode].addrMode
 		if addrMode == zeroXIndexAddr || addrMode == zeroYIndexAddr {
 			return fmt.Sprintf("%s $%02x, %s", i.OpName, i.Value, i.RegisterName)
 		}
-		return fmt.Sprintf("%s $%04x, %s", i.OpName, i.Value, i.RegisterName)
+		return fmt.Sprintf("%s %s$%04x, %s", i.OpName, i.forceAbsolutePrefix(), i.Value, i.RegisterName)
 	case DirectWithLabelIndexedInstruction:
-		return fmt.Sprintf("%s %s, %s", i.OpName, i.LabelName, i.RegisterName)
+		return fmt.Sprintf("%s %s%s, %s", i.OpName, i.forceAbsolutePrefix(), i.LabelName, i.RegisterName)
 	case IndirectInstruction:
 		return fmt.Sprintf("%s ($%04x)", i.OpName, i.Value)
 	case IndirectXInstruction:
@@ -865,6 +1004,40 @@ func (i *Instruction) Render() string {
 	panic("unexpected Instruction Type")
 }
 
+// a: for an absolute mode with a zero page address, which the assembler
+// would otherwise encode as zero page
+func (i *Instruction) forceAbsolutePrefix() string {
+	if i.ForceAbsolute {
+		return "a:"
+	}
+	switch opCodeTable[i.OpCode].addrMode {
+	case absAddr, absXAddr, absYAddr:
+		if i.Value <= 0xff {
+			return "a:"
+		}
+	}
+	return ""
+}
+
+func (i *Instruction) renderExpr() string {
+	expr := renderExpr(i.Expr)
+	switch i.Type {
+	case ImmediateInstruction:
+		return fmt.Sprintf("%s #%s", i.OpName, expr)
+	case DirectWithLabelInstruction:
+		return fmt.Sprintf("%s %s%s", i.OpName, i.forceAbsolutePrefix(), expr)
+	case DirectWithLabelIndexedInstruction:
+		return fmt.Sprintf("%s %s%s, %s", i.OpName, i.forceAbsolutePrefix(), expr, i.RegisterName)
+	case IndirectInstruction:
+		return fmt.Sprintf("%s (%s)", i.OpName, expr)
+	case IndirectXInstruction:
+		return fmt.Sprintf("%s (%s, X)", i.OpName, expr)
+	case IndirectYInstruction:
+		return fmt.Sprintf("%s (%s), Y", i.OpName, expr)
+	}
+	panic("unexpected Instruction Type")
+}
+
 func (i *OrgPseudoOp) Render() string {
 	if i.Fill == 0xff {
 		return fmt.Sprintf(".org $%04x", i.Value)
@@ -872,6 +1045,20 @@ func (i *OrgPseudoOp) Render() string {
 	return fmt.Sprintf(".org $%04x, $%02x", i.Value, i.Fill)
 }
 
+func (s *AlignStatement) Render() string {
+	if s.Fill == 0xff {
+		return fmt.Sprintf(".align %d", s.Value)
+	}
+	return fmt.Sprintf(".align %d, $%02x", s.Value, s.Fill)
+}
+
+func (s *ReserveStatement) Render() string {
+	if s.Fill == 0 {
+		return fmt.Sprintf(".res %d", s.Size)
+	}
+	return fmt.Sprintf(".res %d, $%02x", s.Size, s.Fill)
+}
+
 func (s *DataStatement) Render() string {
 	buf := new(bytes.Buffer)
 	switch s.Type {
@@ -879,15 +1066,21 @@ func (s *DataStatement) Render() string {
 	case ByteDataStmt:
 		buf.WriteString(".db ")
 	case WordDataStmt:
-		buf.WriteString(".dw ")
+		if s.BigEndian {
+			buf.WriteString(".dw.be ")
+		} else {
+			buf.WriteString(".dw ")
+		}
 	}
 	for e := s.dataList.Front(); e != nil; e = e.Next() {
 		switch t := e.Value.(type) {
 		case *LabelCall:
 			buf.WriteString(t.LabelName)
+		case *BinaryExpr, *SizeofExpr, *ByteExpr:
+			buf.WriteString(renderExpr(t))
 		case *StringDataItem:
 			buf.WriteString("\"")
-			buf.WriteString(string(*t))
+			buf.WriteString(escapeString(string(*t)))
 			buf.WriteString("\"")
 		case *IntegerDataItem:
 			switch s.Type {
@@ -905,6 +1098,13 @@ func (s *DataStatement) Render() string {
 	return buf.String()
 }
 
+func (s *AssignStatement) Render() string {
+	if s.Expr != nil {
+		return fmt.Sprintf("%s = %s", s.VarName, renderExpr(s.Expr))
+	}
+	return fmt.Sprintf("%s = $%x", s.VarName, s.Value)
+}
+
 func (s *LabelStatement) Render() string {
 	return fmt.Sprintf("%s:", s.LabelName)
 }
@@ -930,6 +1130,15 @@ func (p *Program) WriteSource(writer io.Writer) (err error) {
 		case *OrgPseudoOp:
 			_, err = w.WriteString(t.Render())
 			_, err = w.WriteString("\n")
+		case *AlignStatement:
+			_, err = w.WriteString(t.Render())
+			_, err = w.WriteString("\n")
+		case *ReserveStatement:
+			_, err = w.WriteString(t.Render())
+			_, err = w.WriteString("\n")
+		case *AssignStatement:
+			_, err = w.WriteString(t.Render())
+			_, err = w.WriteString("\n")
 		}
 	}
 
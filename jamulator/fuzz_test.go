@@ -0,0 +1,120 @@
+package jamulator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// op codes which are easy to get wrong: operands cut off by the end of
+// the bank, jmp indirect across a page, brk, undocumented op codes, a
+// jsr into what looks like a jump table, and absolute modes with zero
+// page addresses
+var disassembleFuzzSeeds = [][]byte{
+	{},
+	{0x20},
+	{0xad, 0x34},
+	{0x6c, 0xff, 0xc0},
+	{0x00, 0x00},
+	{0xa7, 0x10, 0xb3},
+	{0xd0, 0xfe},
+	{0x20, 0x06, 0xc0, 0x00, 0xc0, 0x04, 0xc0, 0x0a, 0xc0, 0x60},
+	{0xa9, 0x01, 0x8d, 0x00, 0x20, 0x4c, 0x00, 0xc0},
+	{0xad, 0x10, 0x00, 0x9d, 0xff, 0x00, 0xbe, 0x00, 0x00},
+}
+
+// puts code at the start of a 16KB bank whose vectors point at it
+func fuzzBank(code []byte) []byte {
+	bank := make([]byte, 0x4000)
+	copy(bank, code)
+	for i := 0x3ffa; i < 0x4000; i += 2 {
+		bank[i], bank[i+1] = 0x00, 0xc0
+	}
+	return bank
+}
+
+func FuzzDisassemble(f *testing.F) {
+	for _, seed := range disassembleFuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, code []byte) {
+		if len(code) > 0x3ffa {
+			return
+		}
+		program, err := Disassemble(bytes.NewReader(code))
+		if err == nil && program == nil {
+			t.Fatal("no program and no error")
+		}
+
+		bank := fuzzBank(code)
+		program, err = Disassemble(bytes.NewReader(bank))
+		if err != nil {
+			return
+		}
+		if program == nil {
+			t.Fatal("no program and no error")
+		}
+
+		// the disassembled source should assemble back into the bank
+		source := new(bytes.Buffer)
+		err = program.WriteSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		programAst, err := Parse(strings.NewReader(source.String()))
+		if err != nil {
+			t.Fatalf("%s\n%s", err.Error(), source.String())
+		}
+		reassembled := programAst.ToProgram()
+		if len(reassembled.Errors) > 0 {
+			t.Fatalf("%s\n%s", strings.Join(reassembled.Errors, "\n"), source.String())
+		}
+		out := new(bytes.Buffer)
+		err = reassembled.Assemble(out)
+		if err != nil {
+			t.Fatalf("%s\n%s", err.Error(), source.String())
+		}
+		if bytes.Compare(out.Bytes(), bank) != 0 {
+			t.Fatalf("reassembled bank differs\n%s", source.String())
+		}
+	})
+}
+
+var parseFuzzSeeds = []string{
+	"",
+	"lda #$01\n",
+	"Start: lda Table, x\njmp (Vector)\nTable: .db 1, 2, 3\nVector: .dw Start\n",
+	".org $c000\nZP = $10\nsta ZP+1, y\nbne .local\n.local:\nrts\n",
+	".macro inc16 addr\ninc addr\nbne .done\ninc addr+1\n.done:\n.endm\ninc16 $10\n",
+	".if 1\nnop\n.else\nbrk\n.endif\n",
+	"ldx #sizeof(Table)\nTable: dc.b \"ab\\n\"\n",
+	"lda\n",
+	"sta #$10\n",
+	"jmp ($10), y\n",
+	"dc.b 256\n",
+	"bne Nowhere\n",
+	".org $ffff\nnop\nnop\n",
+	".endif\n",
+	".macro m\n",
+	"X = X + 1\n",
+	"lda (",
+	"\"unterminated\n",
+	"lda #$1/0\n",
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range parseFuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		programAst, err := Parse(strings.NewReader(source))
+		if err != nil {
+			return
+		}
+		program := programAst.ToProgram()
+		if len(program.Errors) > 0 {
+			return
+		}
+		program.Assemble(new(bytes.Buffer))
+	})
+}
@@ -0,0 +1,125 @@
+package jamulator
+
+// writes assembled programs in Intel HEX format
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	ihexDataRecord          = 0x00
+	ihexEofRecord           = 0x01
+	ihexExtLinearAddrRecord = 0x04
+	ihexMaxRecordDataLen    = 16
+)
+
+type ihexWriter struct {
+	writer *bufio.Writer
+	// address and contents of the data not yet written
+	addr int
+	data []byte
+	// upper 16 bits of the address, as of the last extended
+	// linear address record
+	upperAddr int
+}
+
+func (w *ihexWriter) writeRecord(recordType byte, addr int, data []byte) error {
+	sum := byte(len(data)) + byte(addr>>8) + byte(addr) + recordType
+	for _, b := range data {
+		sum += b
+	}
+	_, err := fmt.Fprintf(w.writer, ":%02X%04X%02X%X%02X\n", len(data), addr&0xffff, recordType, data, -sum)
+	return err
+}
+
+// writes out the pending data, at most 16 bytes per record
+func (w *ihexWriter) flush() error {
+	for len(w.data) > 0 {
+		if w.addr>>16 != w.upperAddr {
+			w.upperAddr = w.addr >> 16
+			upper := []byte{byte(w.upperAddr >> 8), byte(w.upperAddr)}
+			err := w.writeRecord(ihexExtLinearAddrRecord, 0, upper)
+			if err != nil {
+				return err
+			}
+		}
+		size := ihexMaxRecordDataLen
+		if size > len(w.data) {
+			size = len(w.data)
+		}
+		// records can't cross a 64KB boundary
+		if w.addr&0xffff+size > 0x10000 {
+			size = 0x10000 - w.addr&0xffff
+		}
+		err := w.writeRecord(ihexDataRecord, w.addr, w.data[:size])
+		if err != nil {
+			return err
+		}
+		w.addr += size
+		w.data = w.data[size:]
+	}
+	return nil
+}
+
+func (w *ihexWriter) write(addr int, data []byte) error {
+	if addr != w.addr+len(w.data) {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+		w.addr = addr
+	}
+	w.data = append(w.data, data...)
+	return nil
+}
+
+// like Assemble, but instead of filling the gaps between org
+// statements, each contiguous run of bytes is written at its own
+// address.
+func (p *Program) WriteIhex(w io.Writer) error {
+	iw := &ihexWriter{writer: bufio.NewWriter(w)}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		t, ok := e.Value.(Assembler)
+		if !ok {
+			continue
+		}
+		err := t.Assemble(p)
+		if err != nil {
+			return err
+		}
+		err = iw.write(t.GetOffset(), t.GetPayload())
+		if err != nil {
+			return err
+		}
+	}
+	err := iw.flush()
+	if err != nil {
+		return err
+	}
+	err = iw.writeRecord(ihexEofRecord, 0, []byte{})
+	if err != nil {
+		return err
+	}
+	return iw.writer.Flush()
+}
+
+func (p *Program) WriteIhexFile(filename string) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	err = p.WriteIhex(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+
+	return nil
+}
@@ -64,7 +64,14 @@ var interpretOps = [256]func(*Compilation) {
 	nil,
 	nil,
 	nil,
-	nil,
+	func (c *Compilation) {
+		// 0x24 bit zpg
+		addr := c.interpZpgAddr()
+		c.debugPrintf("bit $%02x\n", []llvm.Value{addr})
+		addr16 := c.builder.CreateZExt(addr, llvm.Int16Type(), "")
+		c.performBit(c.dynLoad(addr16, 0, 0xff))
+		c.cycle(3, -1)
+	},
 	nil,
 	nil,
 	nil,
@@ -436,17 +443,19 @@ func (c *Compilation) addInterpretBlock() {
 	// fall back on interpreting
 	c.selectBlock(c.interpretBlock)
 	// load the pc
-	pc := c.builder.CreateLoad(c.rPC, "")
+	opCodeAddr := c.builder.CreateLoad(c.rPC, "")
 	// get the opcode at pc
-	opCode := c.dynLoad(pc, 0, 0xffff)
+	opCode := c.dynLoad(opCodeAddr, 0, 0xffff)
 	// increment pc
-	pc = c.builder.CreateAdd(pc, llvm.ConstInt(pc.Type(), 1, false), "")
+	pc := c.builder.CreateAdd(opCodeAddr, llvm.ConstInt(opCodeAddr.Type(), 1, false), "")
 	c.builder.CreateStore(pc, c.rPC)
 	// switch on the opcode
 	badOpCodeBlock := c.createBlock("BadOpCode")
 	sw := c.builder.CreateSwitch(opCode, badOpCodeBlock, interpretOpCount)
 	c.selectBlock(badOpCodeBlock)
-	c.createPanic("invalid op code: $%02x\n", []llvm.Value{opCode})
+	// the runtime can halt, or skip the op code by returning
+	c.builder.CreateCall(c.illegalOpcodeFn, []llvm.Value{opCodeAddr, opCode}, "")
+	c.builder.CreateBr(c.dynJumpBlock)
 
 	i8Type := llvm.Int8Type()
 	for op, fn := range interpretOps {
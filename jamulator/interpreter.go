@@ -0,0 +1,487 @@
+package jamulator
+
+// runs PRG ROM one instruction at a time instead of recompiling it. it is
+// slow, but it copes with the programs that static recompilation can't,
+// such as self-modifying code, and it is a reference to test the
+// recompiler against.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// how long Interpret lets a program run before giving up on it
+const DefaultMaxCycles = 100000000
+
+// the state of the cpu and memory of a program being interpreted.
+// memory is mapped as on the NES, as code compiled without RamSize sees
+// it: 2KB of work RAM mirrored up to $1fff, 8KB of save RAM at $6000,
+// PRG ROM from $8000, and the putchar and exit addresses at $2008 and
+// $2009. other registers read as 0 and ignore writes.
+type Interpreter struct {
+	RegisterState
+	PC uint16
+	// cpu cycles executed so far
+	Cycles int
+	// where bytes stored to $2008 are written
+	Output io.Writer
+	// honor the D flag in adc and sbc, as CompileOptions.DecimalMode
+	DecimalMode bool
+	// set when the program stores to $2009, with the byte stored
+	Exited   bool
+	ExitCode int
+	// set when the program returns from the interrupt with rti
+	Returned bool
+
+	ram  [0x800]byte
+	sram [0x2000]byte
+	prg  []byte
+	// Watch callbacks, by address
+	watches map[uint16]func(addr uint16, value byte)
+}
+
+// prg is one or two 16KB PRG ROM banks. a single bank is mirrored at
+// $8000 and $c000, as with mapper 0.
+func NewInterpreter(prg []byte) (*Interpreter, error) {
+	if len(prg) != 0x4000 && len(prg) != 0x8000 {
+		return nil, errors.New(fmt.Sprintf("PRG ROM is %d bytes; expected 16KB or 32KB", len(prg)))
+	}
+	m := &Interpreter{
+		RegisterState: PowerOnState,
+		Output:        ioutil.Discard,
+		prg:           prg,
+	}
+	m.PC = m.readWord(0xfffc)
+	return m, nil
+}
+
+// runs the reset routine of prg until it exits, returns with rti, or
+// runs for DefaultMaxCycles
+func Interpret(prg []byte) (*Interpreter, error) {
+	m, err := NewInterpreter(prg)
+	if err != nil {
+		return nil, err
+	}
+	return m, m.Run(DefaultMaxCycles)
+}
+
+func (m *Interpreter) Read(addr uint16) byte {
+	switch {
+	case addr < 0x2000:
+		return m.ram[addr&0x7ff]
+	case 0x6000 <= addr && addr < 0x8000:
+		return m.sram[addr-0x6000]
+	case addr >= 0x8000:
+		return m.prg[int(addr-0x8000)%len(m.prg)]
+	}
+	return 0
+}
+
+// calls fn with the value of every store to addr, before the store
+// happens. mirrors of addr aren't watched. only one fn is kept per
+// address, and a nil fn removes it.
+func (m *Interpreter) Watch(addr uint16, fn func(addr uint16, value byte)) {
+	if fn == nil {
+		delete(m.watches, addr)
+		return
+	}
+	if m.watches == nil {
+		m.watches = make(map[uint16]func(addr uint16, value byte))
+	}
+	m.watches[addr] = fn
+}
+
+func (m *Interpreter) Write(addr uint16, value byte) {
+	if m.watches != nil {
+		fn, ok := m.watches[addr]
+		if ok {
+			fn(addr, value)
+		}
+	}
+	switch {
+	case addr < 0x2000:
+		m.ram[addr&0x7ff] = value
+	case addr == 0x2008: // putchar
+		m.Output.Write([]byte{value})
+	case addr == 0x2009: // exit
+		m.Exited = true
+		m.ExitCode = int(value)
+	case 0x6000 <= addr && addr < 0x8000:
+		m.sram[addr-0x6000] = value
+	}
+}
+
+func (m *Interpreter) readWord(addr uint16) uint16 {
+	return uint16(m.Read(addr)) | uint16(m.Read(addr+1))<<8
+}
+
+// reads a pointer from the zero page, where the high byte wraps around
+// to $00
+func (m *Interpreter) readZeroPageWord(addr byte) uint16 {
+	return uint16(m.Read(uint16(addr))) | uint16(m.Read(uint16(addr+1)))<<8
+}
+
+func (m *Interpreter) push(value byte) {
+	m.Write(0x100|uint16(m.SP), value)
+	m.SP -= 1
+}
+
+func (m *Interpreter) pull() byte {
+	m.SP += 1
+	return m.Read(0x100 | uint16(m.SP))
+}
+
+func (m *Interpreter) pushWord(value uint16) {
+	m.push(byte(value >> 8))
+	m.push(byte(value))
+}
+
+func (m *Interpreter) pullWord() uint16 {
+	lo := m.pull()
+	return uint16(lo) | uint16(m.pull())<<8
+}
+
+func (m *Interpreter) flag(mask byte) bool {
+	return m.Status&mask != 0
+}
+
+func (m *Interpreter) setFlag(mask byte, on bool) {
+	if on {
+		m.Status |= mask
+	} else {
+		m.Status &^= mask
+	}
+}
+
+func (m *Interpreter) setZeroNeg(value byte) {
+	m.setFlag(statusZero, value == 0)
+	m.setFlag(statusNeg, value&0x80 != 0)
+}
+
+func (m *Interpreter) carry() byte {
+	return m.Status & statusCarry
+}
+
+func (m *Interpreter) compare(register byte, value byte) {
+	m.setFlag(statusCarry, register >= value)
+	m.setZeroNeg(register - value)
+}
+
+func (m *Interpreter) adc(value byte) {
+	a := m.A
+	carry := int(m.carry())
+	sum := int(a) + int(value) + carry
+	result := byte(sum)
+	m.setFlag(statusOverflow, (a^result)&(value^result)&0x80 != 0)
+	m.setFlag(statusCarry, sum > 0xff)
+	m.setZeroNeg(result)
+	if m.DecimalMode && m.flag(statusDec) {
+		lo := int(a&0x0f) + int(value&0x0f) + carry
+		hi := int(a>>4) + int(value>>4)
+		if lo > 9 {
+			lo += 6
+		}
+		if lo > 0x0f {
+			hi += 1
+		}
+		if hi > 9 {
+			hi += 6
+		}
+		m.setFlag(statusCarry, hi > 0x0f)
+		result = byte(hi<<4) | byte(lo&0x0f)
+	}
+	m.A = result
+}
+
+func (m *Interpreter) sbc(value byte) {
+	a := m.A
+	borrow := 1 - int(m.carry())
+	diff := int(a) - int(value) - borrow
+	result := byte(diff)
+	m.setFlag(statusOverflow, (a^value)&(a^result)&0x80 != 0)
+	m.setFlag(statusCarry, diff >= 0)
+	m.setZeroNeg(result)
+	if m.DecimalMode && m.flag(statusDec) {
+		lo := int(a&0x0f) - int(value&0x0f) - borrow
+		hi := int(a>>4) - int(value>>4)
+		if lo < 0 {
+			lo -= 6
+			hi -= 1
+		}
+		if hi < 0 {
+			hi -= 6
+		}
+		result = byte(hi<<4) | byte(lo&0x0f)
+	}
+	m.A = result
+}
+
+// executes instructions until the program exits, returns from the
+// interrupt, or maxCycles have passed since Run was called
+func (m *Interpreter) Run(maxCycles int) error {
+	limit := m.Cycles + maxCycles
+	for !m.Exited && !m.Returned {
+		if m.Cycles >= limit {
+			return errors.New(fmt.Sprintf("$%04x: still running after %d cycles", m.PC, maxCycles))
+		}
+		err := m.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executes the instruction at PC
+func (m *Interpreter) Step() error {
+	pc := m.PC
+	opCode := m.Read(pc)
+	info := opCodeTable[opCode]
+	if info.illegal {
+		return errors.New(fmt.Sprintf("$%04x: invalid op code $%02x", pc, opCode))
+	}
+	m.PC = pc + uint16(info.size)
+	m.Cycles += opCodeCycles[opCode]
+
+	// work out the operand's address
+	var addr uint16
+	pageCrossed := false
+	indexed := func(base uint16, index byte) uint16 {
+		addr := base + uint16(index)
+		pageCrossed = addr&0xff00 != base&0xff00
+		return addr
+	}
+	switch info.addrMode {
+	case immedAddr:
+		addr = pc + 1
+	case zeroPageAddr:
+		addr = uint16(m.Read(pc + 1))
+	case zeroXIndexAddr:
+		addr = uint16(m.Read(pc+1) + m.X)
+	case zeroYIndexAddr:
+		addr = uint16(m.Read(pc+1) + m.Y)
+	case absAddr:
+		addr = m.readWord(pc + 1)
+	case absXAddr:
+		addr = indexed(m.readWord(pc+1), m.X)
+	case absYAddr:
+		addr = indexed(m.readWord(pc+1), m.Y)
+	case indirectAddr:
+		// the high byte of the target doesn't carry into the next page
+		ptr := m.readWord(pc + 1)
+		addr = uint16(m.Read(ptr)) | uint16(m.Read(ptr&0xff00|(ptr+1)&0x00ff))<<8
+	case xIndexIndirectAddr:
+		addr = m.readZeroPageWord(m.Read(pc+1) + m.X)
+	case indirectYIndexAddr:
+		addr = indexed(m.readZeroPageWord(m.Read(pc+1)), m.Y)
+	case relativeAddr:
+		addr = m.PC + uint16(int8(m.Read(pc+1)))
+	}
+	if pageCrossed && opCodeMayCrossPage(opCode) {
+		m.Cycles += 1
+	}
+
+	branch := func(taken bool) {
+		if taken {
+			m.Cycles += 1
+			if addr&0xff00 != m.PC&0xff00 {
+				m.Cycles += 1
+			}
+			m.PC = addr
+		}
+	}
+	// read-modify-write, on A when there is no operand
+	modify := func(fn func(byte) byte) {
+		if info.addrMode == impliedAddr {
+			m.A = fn(m.A)
+			return
+		}
+		m.Write(addr, fn(m.Read(addr)))
+	}
+
+	switch info.opName {
+	case "lda":
+		m.A = m.Read(addr)
+		m.setZeroNeg(m.A)
+	case "ldx":
+		m.X = m.Read(addr)
+		m.setZeroNeg(m.X)
+	case "ldy":
+		m.Y = m.Read(addr)
+		m.setZeroNeg(m.Y)
+	case "lax":
+		m.A = m.Read(addr)
+		m.X = m.A
+		m.setZeroNeg(m.A)
+	case "sta":
+		m.Write(addr, m.A)
+	case "stx":
+		m.Write(addr, m.X)
+	case "sty":
+		m.Write(addr, m.Y)
+	case "sax":
+		m.Write(addr, m.A&m.X)
+	case "adc":
+		m.adc(m.Read(addr))
+	case "sbc":
+		m.sbc(m.Read(addr))
+	case "and":
+		m.A &= m.Read(addr)
+		m.setZeroNeg(m.A)
+	case "ora":
+		m.A |= m.Read(addr)
+		m.setZeroNeg(m.A)
+	case "eor":
+		m.A ^= m.Read(addr)
+		m.setZeroNeg(m.A)
+	case "cmp":
+		m.compare(m.A, m.Read(addr))
+	case "cpx":
+		m.compare(m.X, m.Read(addr))
+	case "cpy":
+		m.compare(m.Y, m.Read(addr))
+	case "bit":
+		value := m.Read(addr)
+		m.setFlag(statusZero, m.A&value == 0)
+		m.setFlag(statusNeg, value&0x80 != 0)
+		m.setFlag(statusOverflow, value&0x40 != 0)
+	case "inc":
+		modify(func(v byte) byte {
+			m.setZeroNeg(v + 1)
+			return v + 1
+		})
+	case "dec":
+		modify(func(v byte) byte {
+			m.setZeroNeg(v - 1)
+			return v - 1
+		})
+	case "dcp":
+		modify(func(v byte) byte {
+			m.compare(m.A, v-1)
+			return v - 1
+		})
+	case "isc":
+		modify(func(v byte) byte {
+			m.sbc(v + 1)
+			return v + 1
+		})
+	case "asl":
+		modify(func(v byte) byte {
+			m.setFlag(statusCarry, v&0x80 != 0)
+			m.setZeroNeg(v << 1)
+			return v << 1
+		})
+	case "lsr":
+		modify(func(v byte) byte {
+			m.setFlag(statusCarry, v&0x01 != 0)
+			m.setZeroNeg(v >> 1)
+			return v >> 1
+		})
+	case "rol":
+		modify(func(v byte) byte {
+			result := v<<1 | m.carry()
+			m.setFlag(statusCarry, v&0x80 != 0)
+			m.setZeroNeg(result)
+			return result
+		})
+	case "ror":
+		modify(func(v byte) byte {
+			result := v>>1 | m.carry()<<7
+			m.setFlag(statusCarry, v&0x01 != 0)
+			m.setZeroNeg(result)
+			return result
+		})
+	case "inx":
+		m.X += 1
+		m.setZeroNeg(m.X)
+	case "iny":
+		m.Y += 1
+		m.setZeroNeg(m.Y)
+	case "dex":
+		m.X -= 1
+		m.setZeroNeg(m.X)
+	case "dey":
+		m.Y -= 1
+		m.setZeroNeg(m.Y)
+	case "tax":
+		m.X = m.A
+		m.setZeroNeg(m.X)
+	case "tay":
+		m.Y = m.A
+		m.setZeroNeg(m.Y)
+	case "txa":
+		m.A = m.X
+		m.setZeroNeg(m.A)
+	case "tya":
+		m.A = m.Y
+		m.setZeroNeg(m.A)
+	case "tsx":
+		m.X = m.SP
+		m.setZeroNeg(m.X)
+	case "txs":
+		m.SP = m.X
+	case "pha":
+		m.push(m.A)
+	case "php":
+		m.push(m.Status | statusBrk | statusUnused)
+	case "pla":
+		m.A = m.pull()
+		m.setZeroNeg(m.A)
+	case "plp":
+		m.Status = m.pull()
+	case "clc":
+		m.setFlag(statusCarry, false)
+	case "sec":
+		m.setFlag(statusCarry, true)
+	case "cli":
+		m.setFlag(statusInt, false)
+	case "sei":
+		m.setFlag(statusInt, true)
+	case "cld":
+		m.setFlag(statusDec, false)
+	case "sed":
+		m.setFlag(statusDec, true)
+	case "clv":
+		m.setFlag(statusOverflow, false)
+	case "bcc":
+		branch(!m.flag(statusCarry))
+	case "bcs":
+		branch(m.flag(statusCarry))
+	case "bne":
+		branch(!m.flag(statusZero))
+	case "beq":
+		branch(m.flag(statusZero))
+	case "bpl":
+		branch(!m.flag(statusNeg))
+	case "bmi":
+		branch(m.flag(statusNeg))
+	case "bvc":
+		branch(!m.flag(statusOverflow))
+	case "bvs":
+		branch(m.flag(statusOverflow))
+	case "jmp":
+		m.PC = addr
+	case "jsr":
+		// the return address pushed is the last byte of the jsr
+		m.pushWord(m.PC - 1)
+		m.PC = addr
+	case "rts":
+		m.PC = m.pullWord() + 1
+	case "rti":
+		m.Status = m.pull()
+		m.PC = m.pullWord()
+		m.Returned = true
+	case "brk":
+		// brk skips the byte after it
+		m.pushWord(m.PC + 1)
+		m.push(m.Status | statusBrk | statusUnused)
+		m.setFlag(statusInt, true)
+		m.PC = m.readWord(0xfffe)
+	case "nop":
+	default:
+		return errors.New(fmt.Sprintf("$%04x: %s is not supported by the interpreter", pc, info.opName))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package jamulator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// adds 7 five times, doubles it in a subroutine, subtracts $50, then
+// prints A, X, Y and the status byte and exits with code 3
+const interpretTestSource = "ldx #$05\nlda #$00\nclc\n" +
+	"Loop:\nadc #$07\ndex\nbne Loop\n" +
+	"jsr Double\nsec\nsbc #$50\ntay\nldx #$80\n" +
+	"php\nsta $2008\nstx $2008\nsty $2008\npla\nand #$cf\nsta $2008\n" +
+	"lda #$03\nsta $2009\n" +
+	"Double:\nasl\nrts\n"
+
+var interpretTestOutput = []byte{0xf6, 0x80, 0xf6, statusNeg | statusInt}
+
+// pushes with SP at $00 and pulls it back, exiting with code 42 if the
+// stack wraps around within page 1 as on the 6502, or else the number
+// of the check which failed
+const stackWrapTestSource = "ldx #$00\ntxs\nlda #$2a\npha\n" +
+	"ldy #$01\ntsx\ncpx #$ff\nbne Fail\n" +
+	"ldy #$02\nlda $0100\ncmp #$2a\nbne Fail\n" +
+	"ldy #$03\nlda $01ff\nbne Fail\n" +
+	"pla\nldy #$04\ntsx\ncpx #$00\nbne Fail\n" +
+	"ldy #$05\ncmp #$2a\nbne Fail\n" +
+	"sta $2009\n" +
+	"Fail:\nsty $2009\n"
+
+func TestInterpret(t *testing.T) {
+	program, err := assembleTestProgram(interpretTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewInterpreter(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	m.Output = out
+	err = m.Run(DefaultMaxCycles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exited || m.ExitCode != 3 {
+		t.Error(fmt.Sprintf("expected exit code 3, got exited %t, code %d", m.Exited, m.ExitCode))
+	}
+	if bytes.Compare(out.Bytes(), interpretTestOutput) != 0 {
+		t.Error(fmt.Sprintf("expected output % x, got % x", interpretTestOutput, out.Bytes()))
+	}
+	if m.SP != PowerOnState.SP {
+		t.Error(fmt.Sprintf("expected the stack to be balanced, SP is $%02x", m.SP))
+	}
+}
+
+func TestInterpretFlags(t *testing.T) {
+	flagTests := []struct {
+		source string
+		a      byte
+		status byte
+	}{
+		{"sec\nlda #$50\nsbc #$10\n", 0x40, statusCarry},
+		{"clc\nlda #$50\nsbc #$10\n", 0x3f, statusCarry},
+		{"sec\nlda #$50\nsbc #$b0\n", 0xa0, statusNeg | statusOverflow},
+		{"clc\nlda #$50\nadc #$50\n", 0xa0, statusNeg | statusOverflow},
+		{"clc\nlda #$ff\nadc #$01\n", 0x00, statusZero | statusCarry},
+		{"lda #$81\nasl\n", 0x02, statusCarry},
+		{"sec\nlda #$01\nror\n", 0x80, statusNeg | statusCarry},
+	}
+	const mask = statusCarry | statusZero | statusOverflow | statusNeg
+	for _, ft := range flagTests {
+		program, err := assembleTestProgram(ft.source + "Done:\njmp Done\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewInterpreter(program.PrgRom[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for m.Read(m.PC) != 0x4c {
+			err = m.Step()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m.A != ft.a || m.Status&mask != ft.status {
+			t.Error(fmt.Sprintf("%q: expected A $%02x, flags $%02x; got A $%02x, flags $%02x", ft.source, ft.a, ft.status, m.A, m.Status&mask))
+		}
+	}
+}
+
+func TestInterpretRunaway(t *testing.T) {
+	program, err := assembleTestProgram("Forever:\njmp Forever\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewInterpreter(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Run(1000)
+	if err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Error(fmt.Sprintf("expected the program to be stopped, got %v", err))
+	}
+}
+
+func TestInterpretWatch(t *testing.T) {
+	source := "lda #$11\nsta $0300\nldx #$00\nlda #$22\nsta $0300,x\nsta $0301\n" +
+		"lda #$00\nsta $2009\n"
+	program, err := assembleTestProgram(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewInterpreter(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []byte
+	m.Watch(0x0300, func(addr uint16, value byte) {
+		if addr != 0x0300 {
+			t.Error(fmt.Sprintf("expected a store to $0300, got $%04x", addr))
+		}
+		stored = append(stored, value)
+	})
+	err = m.Run(DefaultMaxCycles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(stored, []byte{0x11, 0x22}) != 0 {
+		t.Error(fmt.Sprintf("expected the watch to see 11 22, got % x", stored))
+	}
+}
+
+func TestInterpretStackWrap(t *testing.T) {
+	program, err := assembleTestProgram(stackWrapTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewInterpreter(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Run(DefaultMaxCycles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exited || m.ExitCode != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code 42, got exited %t, code %d", m.Exited, m.ExitCode))
+	}
+}
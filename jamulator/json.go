@@ -0,0 +1,77 @@
+package jamulator
+
+// a description of the assembled program for other tools to read
+
+import (
+	"encoding/json"
+)
+
+type instructionJson struct {
+	Address  int    `json:"address"`
+	OpCode   byte   `json:"opcode"`
+	Mnemonic string `json:"mnemonic"`
+	Mode     string `json:"mode"`
+	// the operand's value, which for branches is the target address.
+	// absent for implied instructions.
+	Operand *int   `json:"operand,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Line    int    `json:"line"`
+}
+
+// a region of bytes which aren't instructions
+type dataJson struct {
+	Address int `json:"address"`
+	Size    int `json:"size"`
+	Line    int `json:"line"`
+	// "data" for dc.b and friends, "align" for the padding of .align,
+	// and "reserve" for .res and ds
+	Kind string `json:"kind"`
+}
+
+type programJson struct {
+	Instructions []instructionJson `json:"instructions"`
+	Data         []dataJson        `json:"data"`
+	Labels       map[string]int    `json:"labels"`
+	Variables    map[string]int    `json:"variables"`
+}
+
+// describes each instruction and data statement in program order, along
+// with the symbol table. the program must be resolved, as by ToProgram.
+func (p *Program) MarshalJSON() ([]byte, error) {
+	doc := programJson{
+		Instructions: []instructionJson{},
+		Data:         []dataJson{},
+		Labels:       p.Labels,
+		Variables:    p.Variables,
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *Instruction:
+			info := opCodeTable[t.OpCode]
+			entry := instructionJson{
+				Address:  t.Offset,
+				OpCode:   t.OpCode,
+				Mnemonic: info.opName,
+				Mode:     AddressingMode(info.addrMode).String(),
+				Label:    t.LabelName,
+				Line:     t.Line,
+			}
+			if info.addrMode != impliedAddr {
+				value := t.Value
+				entry.Operand = &value
+			}
+			doc.Instructions = append(doc.Instructions, entry)
+		case *DataStatement:
+			doc.Data = append(doc.Data, dataJson{t.Offset, len(t.Payload), t.Line, "data"})
+		case *AlignStatement:
+			if len(t.Payload) > 0 {
+				doc.Data = append(doc.Data, dataJson{t.Offset, len(t.Payload), t.Line, "align"})
+			}
+		case *ReserveStatement:
+			if len(t.Payload) > 0 {
+				doc.Data = append(doc.Data, dataJson{t.Offset, len(t.Payload), t.Line, "reserve"})
+			}
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,121 @@
+package jamulator
+
+// links compiled programs into executables which run without the NES
+// runtime, for programs that only talk to the outside world through the
+// putchar and exit addresses
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// the C compiler used to link when CompileOptions.Linker is empty
+const DefaultLinker = "cc"
+
+// provides main and does nothing for the PPU, APU and mapper hooks
+const stubRuntimeSource = `#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+void rom_start(uint8_t interrupt);
+
+void rom_cycle(uint8_t cycles) {}
+void rom_frame() {}
+
+uint8_t rom_ppu_read_status() { return 0; }
+uint8_t rom_ppu_read_oamdata() { return 0; }
+uint8_t rom_ppu_read_data() { return 0; }
+void rom_ppu_write_control(uint8_t b) {}
+void rom_ppu_write_mask(uint8_t b) {}
+void rom_ppu_write_oamaddress(uint8_t b) {}
+void rom_ppu_write_oamdata(uint8_t b) {}
+void rom_ppu_write_scroll(uint8_t b) {}
+void rom_ppu_write_address(uint8_t b) {}
+void rom_ppu_write_data(uint8_t b) {}
+void rom_ppu_write_dma(uint8_t b) {}
+
+uint8_t rom_apu_read_status() { return 0; }
+void rom_apu_write_square1control(uint8_t b) {}
+void rom_apu_write_square1sweeps(uint8_t b) {}
+void rom_apu_write_square1low(uint8_t b) {}
+void rom_apu_write_square1high(uint8_t b) {}
+void rom_apu_write_square2control(uint8_t b) {}
+void rom_apu_write_square2sweeps(uint8_t b) {}
+void rom_apu_write_square2low(uint8_t b) {}
+void rom_apu_write_square2high(uint8_t b) {}
+void rom_apu_write_trianglecontrol(uint8_t b) {}
+void rom_apu_write_trianglelow(uint8_t b) {}
+void rom_apu_write_trianglehigh(uint8_t b) {}
+void rom_apu_write_noisebase(uint8_t b) {}
+void rom_apu_write_noiseperiod(uint8_t b) {}
+void rom_apu_write_noiselength(uint8_t b) {}
+void rom_apu_write_dmcflags(uint8_t b) {}
+void rom_apu_write_dmcdirectload(uint8_t b) {}
+void rom_apu_write_dmcsampleaddress(uint8_t b) {}
+void rom_apu_write_dmcsamplelength(uint8_t b) {}
+void rom_apu_write_controlflags1(uint8_t b) {}
+void rom_apu_write_controlflags2(uint8_t b) {}
+
+void rom_bankswitch(uint16_t addr, uint8_t value) {}
+void rom_watch(uint16_t addr, uint8_t value) {}
+
+void rom_trace(uint16_t pc, uint8_t opcode) {
+    fprintf(stderr, "%04X  %02X\n", pc, opcode);
+}
+
+void rom_illegal_opcode(uint16_t pc, uint8_t opcode) {
+    fprintf(stderr, "illegal op code $%02x at $%04x\n", opcode, pc);
+    exit(1);
+}
+
+int main() {
+    // 2 is ROM_INTERRUPT_RESET
+    rom_start(2);
+    return 0;
+}
+`
+
+// compiles the program to a native object file and links it with a
+// small runtime into an executable. the program runs its reset routine
+// and exits when it stores to $2009 or returns from the reset routine.
+// memory is the NES memory map, with stores to the PPU and APU registers
+// ignored, unless opts.RamSize asks for flat RAM.
+// functions named in opts.Syscalls are not provided, so they can't be
+// used here.
+func (p *Program) CompileExecutable(filename string, opts CompileOptions) (*CompileResult, error) {
+	if len(opts.Syscalls) > 0 {
+		return nil, errors.New("syscalls can't be linked into an executable")
+	}
+	linker := opts.Linker
+	if linker == "" {
+		linker = DefaultLinker
+	}
+	tmpDir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPrgObject := path.Join(tmpDir, "prg.o")
+	tmpRuntimeSource := path.Join(tmpDir, "runtime.c")
+
+	opts.ObjectFile = true
+	result, err := p.Compile(tmpPrgObject, opts)
+	if err != nil {
+		return result, err
+	}
+	result.Filename = filename
+
+	err = ioutil.WriteFile(tmpRuntimeSource, []byte(stubRuntimeSource), 0644)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(linker, "-o", filename, tmpPrgObject, tmpRuntimeSource).CombinedOutput()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s\n%s", linker, err.Error(), out))
+	}
+	return result, nil
+}
@@ -0,0 +1,610 @@
+// +build integration
+
+package jamulator
+
+// these tests need a working LLVM native target and a C compiler. run
+// them with go test -tags integration
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/axw/gollvm/llvm"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// compiles source as in assembleTestProgram into an executable and runs
+// it, returning what it printed and its exit code
+func runExecutable(t *testing.T, source string, opts CompileOptions) ([]byte, int) {
+	program, err := assembleTestProgram(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runProgram(t, program, opts)
+}
+
+func runProgram(t *testing.T, program *Program, opts CompileOptions) ([]byte, int) {
+	out, _, code := runProgramStderr(t, program, opts)
+	return out, code
+}
+
+// like runProgram, but also returns what the program wrote to stderr
+func runProgramStderr(t *testing.T, program *Program, opts CompileOptions) ([]byte, []byte, int) {
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "prg")
+	_, err = program.CompileExecutable(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command(filename)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err == nil {
+		return out, stderr.Bytes(), 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return out, stderr.Bytes(), exitErr.ExitCode()
+}
+
+func TestCompileExecutable(t *testing.T) {
+	_, code := runExecutable(t, "lda #$2a\nsta $2009\n", CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code 42, got %d", code))
+	}
+}
+
+// the interpreter and the recompiler should agree on the registers the
+// program prints
+func TestInterpretMatchesRecompiler(t *testing.T) {
+	program, err := assembleTestProgram(interpretTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, code := runProgram(t, program, CompileOptions{})
+	if code != 3 {
+		t.Fatal(fmt.Sprintf("expected exit code 3, got %d", code))
+	}
+
+	m, err := NewInterpreter(program.PrgRom[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	interpreted := new(bytes.Buffer)
+	m.Output = interpreted
+	err = m.Run(DefaultMaxCycles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(compiled, interpreted.Bytes()) != 0 {
+		t.Error(fmt.Sprintf("recompiled program printed % x, interpreter printed % x", compiled, interpreted.Bytes()))
+	}
+}
+
+func TestCompileExecutableJumpTable(t *testing.T) {
+	_, code := runExecutable(t, jumpTableSource, CompileOptions{})
+	if code != 2 {
+		t.Error(fmt.Sprintf("expected the jump table to reach Second, got exit code %d", code))
+	}
+}
+
+// A and the flags after $50 - $10 and friends, from the recompiled code
+func TestCompileExecutableSbc(t *testing.T) {
+	sbcTests := []struct {
+		source string
+		a      byte
+		status byte
+	}{
+		{"sec\nlda #$50\nsbc #$10\n", 0x40, statusCarry},
+		{"clc\nlda #$50\nsbc #$10\n", 0x3f, statusCarry},
+		{"sec\nlda #$50\nsbc #$50\n", 0x00, statusCarry | statusZero},
+		{"sec\nlda #$50\nsbc #$b0\n", 0xa0, statusNeg | statusOverflow},
+		{"sec\nlda #$10\nsbc #$50\n", 0xc0, statusNeg},
+		{"sec\nlda #$d0\nsbc #$70\n", 0x60, statusCarry | statusOverflow},
+		{"lda #$10\nsta $20\nsec\nlda #$50\nsbc $20\n", 0x40, statusCarry},
+		{"lda #$10\nsta $0300\nldx #$00\nclc\nlda #$50\nsbc $0300, x\n", 0x3f, statusCarry},
+	}
+	const mask = statusCarry | statusZero | statusOverflow | statusNeg
+	for _, st := range sbcTests {
+		out, code := runExecutable(t, st.source+"php\nsta $2008\npla\nsta $2008\nlda #$00\nsta $2009\n", CompileOptions{})
+		if code != 0 || len(out) != 2 || out[0] != st.a || out[1]&mask != st.status {
+			t.Error(fmt.Sprintf("%q: expected A $%02x, flags $%02x; got % x and exit code %d", st.source, st.a, st.status, out, code))
+		}
+	}
+}
+
+// with RamSize, $2000 is memory rather than PPUCTRL
+func TestCompileExecutableRam(t *testing.T) {
+	_, code := runExecutable(t, "lda #$21\nsta $2000\nldx #$00\ninc $2000, x\nlda $2000\nsta $2009\n", CompileOptions{RamSize: MaxRamSize})
+	if code != 0x22 {
+		t.Error(fmt.Sprintf("expected exit code $22, got %d", code))
+	}
+}
+
+// indexed stores to the putchar and exit addresses still reach them with
+// flat RAM, rather than the RAM underneath
+func TestCompileExecutableRamIo(t *testing.T) {
+	out, code := runExecutable(t, "ldx #$08\nlda #'h'\nsta $2000, x\nlda #'i'\nsta $2000, x\n"+
+		"inx\nlda #$2a\nsta $2000, x\nlda #$00\nsta $2009\n", CompileOptions{RamSize: MaxRamSize})
+	if string(out) != "hi" || code != 0x2a {
+		t.Error(fmt.Sprintf("expected \"hi\" and exit code $2a, got %q and %d", out, code))
+	}
+}
+
+// small routines which are only called are inlined by the optimizer
+func TestCompileInlinesSubroutine(t *testing.T) {
+	program, err := assembleTestProgram("lda #$15\njsr Double\nsta $2009\nDone:\njmp Done\nDouble:\nasl a\nrts\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bitcode := path.Join(dir, "prg.bc")
+	_, err = program.Compile(bitcode, CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := llvm.ParseBitcodeFile(bitcode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Dispose()
+	if !mod.NamedFunction("Double").IsNil() {
+		t.Error("expected Double to be inlined into rom_start")
+	}
+
+	_, code := runProgram(t, program, CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code $2a, got %d", code))
+	}
+}
+
+// the routine is a function of its own, working on the CpuState it is
+// passed
+func TestCompileExecutableCpuState(t *testing.T) {
+	_, code := runExecutable(t, "ldx #$05\nlda #$00\njsr AddX\nsta $2009\n"+
+		"Done:\njmp Done\nAddX:\nclc\nadc #$07\ndex\nbne AddX\nrts\n", CompileOptions{Flags: DisableOptFlag})
+	if code != 0x23 {
+		t.Error(fmt.Sprintf("expected exit code $23, got %d", code))
+	}
+}
+
+// $02 jams a real 6502, and the generated code has nothing for it
+func TestCompileExecutableIllegalOpcode(t *testing.T) {
+	program, err := assembleTestProgram("jmp (Ptr)\nPtr:\ndc.w Bad\nBad:\ndc.b $02\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runProgramStderr(t, program, CompileOptions{})
+	if code == 0 {
+		t.Error("expected the program to halt with a non-zero exit code")
+	}
+	if !bytes.Contains(stderr, []byte("illegal op code $02 at $c005")) {
+		t.Error(fmt.Sprintf("expected rom_illegal_opcode to be called, got %q", stderr))
+	}
+}
+
+func TestCompileExecutableTrace(t *testing.T) {
+	program, err := assembleTestProgram("lda #$01\nldx #$02\nsta $2009\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runProgramStderr(t, program, CompileOptions{Trace: true})
+	if code != 1 {
+		t.Error(fmt.Sprintf("expected exit code 1, got %d", code))
+	}
+	expected := "C000  A9\nC002  A2\nC004  8D\n"
+	if string(stderr) != expected {
+		t.Error(fmt.Sprintf("expected trace %q, got %q", expected, stderr))
+	}
+}
+
+func TestCompileExecutableStackWrap(t *testing.T) {
+	_, code := runExecutable(t, stackWrapTestSource, CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code 42, got %d", code))
+	}
+}
+
+func TestCompileExecutableOnlyLabels(t *testing.T) {
+	out, code := runExecutable(t, onlyLabelsTestSource, CompileOptions{OnlyLabels: []string{"Second"}})
+	if code != 0 || string(out) != "BC" {
+		t.Error(fmt.Sprintf("expected BC and exit code 0, got %q and %d", out, code))
+	}
+}
+
+// stores to the zero page and reads the values back, exiting with code
+// 42, or else the number of the check which failed
+const zeroPageTestSource = "ldy #$01\nlda #$42\nsta $10\nlda #$00\nldx $10\ncpx #$42\nbne Fail\n" +
+	"ldy #$02\ninc $10\nlda $10\ncmp #$43\nbne Fail\n" +
+	"ldy #$03\nldx #$05\nlda #$2a\nsta $0b, x\nlda #$00\nlda $10\ncmp #$2a\nbne Fail\n" +
+	"sta $2009\n" +
+	"Fail:\nsty $2009\n"
+
+func TestCompileExecutableZeroPage(t *testing.T) {
+	_, code := runExecutable(t, zeroPageTestSource, CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code 42, got %d", code))
+	}
+}
+
+// counts the NMIs while the reset routine spins for about 3500 cycles,
+// which is three frames of 1000
+const nmiCountTestSource = ".org $c000\n" +
+	"Reset_Routine:\nldy #$03\nOuter:\nldx #$e6\nSpin:\ndex\nbne Spin\ndey\nbne Outer\nlda $10\nsta $2009\n" +
+	"NMI_Routine:\ninc $10\nrti\nIRQ_Routine:\nrti\n" +
+	".org $fffa\ndc.w NMI_Routine\ndc.w Reset_Routine\ndc.w IRQ_Routine\n"
+
+func TestCompileExecutableNmiDriver(t *testing.T) {
+	programAst, err := Parse(strings.NewReader(nmiCountTestSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(strings.Join(program.Errors, "\n"))
+	}
+	buf := new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+	_, code := runProgram(t, program, CompileOptions{NmiCycles: 1000})
+	if code != 3 {
+		t.Error(fmt.Sprintf("expected the NMI routine to run 3 times, got %d", code))
+	}
+}
+
+// prints rom_page_crossings when the program exits
+const pageCrossingsReportSource = `#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+extern uint32_t rom_page_crossings;
+
+static void report() {
+    printf("%u", rom_page_crossings);
+}
+
+__attribute__((constructor)) static void init() {
+    atexit(report);
+}
+`
+
+func TestCompileExecutablePageCrossings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := path.Join(dir, "report.c")
+	err = ioutil.WriteFile(report, []byte(pageCrossingsReportSource), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// links the report in alongside the runtime
+	linker := path.Join(dir, "cc")
+	err = ioutil.WriteFile(linker, []byte("#!/bin/sh\nexec "+DefaultLinker+" \"$@\" "+report+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crossingTests := []struct {
+		source    string
+		crossings string
+	}{
+		{"ldx #$01\nlda $10ff, x\n", "1"},
+		{"ldx #$01\nlda $1000, x\n", "0"},
+		{"ldx #$ff\nlda $1000, x\nldx #$01\nlda $10ff, x\n", "1"},
+	}
+	for _, ct := range crossingTests {
+		out, code := runExecutable(t, ct.source+"lda #$00\nsta $2009\n", CompileOptions{CountPageCrossings: true, Linker: linker})
+		if code != 0 || string(out) != ct.crossings {
+			t.Error(fmt.Sprintf("%q: expected %s page crossings, got %q and exit code %d", ct.source, ct.crossings, out, code))
+		}
+	}
+}
+
+// compiles the program to an object file, links it with runtimeSource
+// instead of the stub runtime, and runs it, returning what it printed.
+// the program must exit with 0.
+func runWithRuntime(t *testing.T, program *Program, opts CompileOptions, runtimeSource string) []byte {
+	dir, err := ioutil.TempDir("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	object := path.Join(dir, "prg.o")
+	opts.ObjectFile = true
+	_, err = program.Compile(object, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := path.Join(dir, "runtime.c")
+	err = ioutil.WriteFile(runtime, []byte(runtimeSource), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(dir, "prg")
+	out, err := exec.Command(DefaultLinker, "-o", filename, object, runtime).CombinedOutput()
+	if err != nil {
+		t.Fatal(fmt.Sprintf("%s\n%s", err.Error(), out))
+	}
+	out, err = exec.Command(filename).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// the host side of the syscall, which prints what was stored with the
+// number of times it was called
+const syscallHostSource = `#include <stdint.h>
+#include <stdio.h>
+
+static int calls = 0;
+
+void host_print_hex(uint8_t b) {
+    calls++;
+    printf("%d:%02x ", calls, b);
+}
+`
+
+// syscalls aren't provided by CompileExecutable, so this links the stub
+// runtime with the host function itself
+func TestCompileSyscallCall(t *testing.T) {
+	program, err := assembleTestProgram("lda #$2a\nsta $5000\nlda #$07\nsta $5000\nlda #$00\nsta $2009\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CompileOptions{Syscalls: map[int]string{0x5000: "host_print_hex"}}
+	out := runWithRuntime(t, program, opts, stubRuntimeSource+syscallHostSource)
+	if string(out) != "1:2a 2:07 " {
+		t.Error(fmt.Sprintf("expected host_print_hex to be called with $2a and then $07, got %q", out))
+	}
+}
+
+// writes to PPUSTATUS, directly, indexed and through a mirror, are
+// ignored rather than halting the program
+func TestCompileExecutablePpuStatusWrite(t *testing.T) {
+	_, code := runExecutable(t, "lda #$80\nsta $2002\nldx #$02\nsta $2000, x\nsta $3ffa\n"+
+		"lda #$2a\nsta $2009\n", CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code $2a, got %d", code))
+	}
+}
+
+// strobes the controller, writes to an unused APU register directly and
+// indexed, and polls eight buttons, none of which are pressed. exits
+// with 42, or 1 if a button reads as pressed.
+const controllerTestSource = "lda #$01\nsta $4016\nlda #$00\nsta $4016\n" +
+	"sta $4009\nldx #$09\nsta $4000, x\n" +
+	"ldy #$08\nPoll:\nlda $4016\nand #$01\nbne Fail\ndey\nbne Poll\n" +
+	"lda #$2a\nsta $2009\n" +
+	"Fail:\nlda #$01\nsta $2009\n"
+
+func TestCompileExecutableController(t *testing.T) {
+	_, code := runExecutable(t, controllerTestSource, CompileOptions{})
+	if code != 0x2a {
+		t.Error(fmt.Sprintf("expected exit code $2a, got %d", code))
+	}
+}
+
+// stores to PRG ROM call rom_bankswitch and leave the ROM as it was
+func TestCompileExecutableBankSwitch(t *testing.T) {
+	program, err := assembleTestProgram("lda #$01\nsta $8000\nldx #$00\nlda #$02\nsta Data, x\n" +
+		"lda Data\nsta $2008\nlda #$00\nsta $2009\nData:\ndc.b '*'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := "void rom_bankswitch(uint16_t addr, uint8_t value) {}"
+	if !strings.Contains(stubRuntimeSource, noop) {
+		t.Fatal("expected the stub runtime to define rom_bankswitch")
+	}
+	runtime := strings.Replace(stubRuntimeSource, noop,
+		"void rom_bankswitch(uint16_t addr, uint8_t value) {\n    printf(\"%04x:%02x \", addr, value);\n}", 1)
+	out := runWithRuntime(t, program, CompileOptions{}, runtime)
+	expected := fmt.Sprintf("8000:01 %04x:02 *", program.Labels["Data"])
+	if string(out) != expected {
+		t.Error(fmt.Sprintf("expected %q, got %q", expected, out))
+	}
+}
+
+// prints the results of adc and sbc with the D flag set: 9 + 1, 10 - 1,
+// 99 + 1 and its carry, 0 - 1 and its carry, 17 + 25 from memory, and
+// then 9 + 1 with D cleared
+const decimalTestSource = "sed\nclc\nlda #$09\nadc #$01\nsta $2008\n" +
+	"sec\nlda #$10\nsbc #$01\nsta $2008\n" +
+	"clc\nlda #$99\nadc #$01\nsta $2008\nphp\npla\nand #$01\nsta $2008\n" +
+	"sec\nlda #$00\nsbc #$01\nsta $2008\nphp\npla\nand #$01\nsta $2008\n" +
+	"lda #$25\nsta $10\nclc\nlda #$17\nadc $10\nsta $2008\n" +
+	"cld\nclc\nlda #$09\nadc #$01\nsta $2008\n" +
+	"lda #$00\nsta $2009\n"
+
+func TestCompileExecutableDecimalMode(t *testing.T) {
+	decimalTests := []struct {
+		decimal  bool
+		expected []byte
+	}{
+		{false, []byte{0x0a, 0x0f, 0x9a, 0x00, 0xff, 0x00, 0x3c, 0x0a}},
+		{true, []byte{0x10, 0x09, 0x00, 0x01, 0x99, 0x00, 0x42, 0x0a}},
+	}
+	for _, dt := range decimalTests {
+		out, code := runExecutable(t, decimalTestSource, CompileOptions{DecimalMode: dt.decimal})
+		if code != 0 || bytes.Compare(out, dt.expected) != 0 {
+			t.Error(fmt.Sprintf("decimal mode %t: expected % x, got % x and exit code %d", dt.decimal, dt.expected, out, code))
+		}
+	}
+}
+
+// prints N, Z and C after comparing $40 with $40, $20 and $80, then
+// with $40 from memory through each addressing mode, then cpx and cpy
+func TestCompileExecutableCompare(t *testing.T) {
+	const flags = "php\npla\nand #$83\nsta $2008\n"
+	source := "lda #$40\nsta $10\nsta $0300\nlda #$00\nsta $20\nlda #$03\nsta $21\n" +
+		"lda #$40\ncmp #$40\n" + flags +
+		"lda #$40\ncmp #$20\n" + flags +
+		"lda #$40\ncmp #$80\n" + flags +
+		"lda #$40\ncmp $10\n" + flags +
+		"lda #$40\nldx #$00\ncmp ($20, x)\n" + flags +
+		"lda #$40\nldy #$00\ncmp ($20), y\n" + flags +
+		"ldx #$20\ncpx #$40\n" + flags +
+		"ldy #$ff\ncpy $10\n" + flags +
+		"lda #$00\nsta $2009\n"
+	expected := []byte{
+		statusZero | statusCarry,
+		statusCarry,
+		statusNeg,
+		statusZero | statusCarry,
+		statusZero | statusCarry,
+		statusZero | statusCarry,
+		statusNeg,
+		statusNeg | statusCarry,
+	}
+	out, code := runExecutable(t, source, CompileOptions{})
+	if code != 0 || bytes.Compare(out, expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x, got % x and exit code %d", expected, out, code))
+	}
+}
+
+// runs bit $10 from data, which only the interpret block can execute,
+// printing N, V and Z with A $00 and then $41 against $c0. then checks
+// bvs and bvc after compiled bits, exiting with 42, or 1 if either
+// branch goes the wrong way.
+const interpretBitTestSource = "lda #$c0\nsta $10\nlda #$00\njmp (Ptr1)\n" +
+	"Ptr1:\ndc.w Bit1\nBit1:\ndc.b $24, $10\n" +
+	"After1:\nphp\npla\nand #$c2\nsta $2008\n" +
+	"lda #$41\njmp (Ptr2)\n" +
+	"Ptr2:\ndc.w Bit2\nBit2:\ndc.b $24, $10\n" +
+	"After2:\nphp\npla\nand #$c2\nsta $2008\n" +
+	"lda #$00\nsta $11\nbit $11\nbvs Fail\nbit $10\nbvc Fail\n" +
+	"lda #$2a\nsta $2009\n" +
+	"Fail:\nlda #$01\nsta $2009\n"
+
+func TestCompileExecutableInterpretBit(t *testing.T) {
+	out, code := runExecutable(t, interpretBitTestSource, CompileOptions{})
+	expected := []byte{statusNeg | statusOverflow | statusZero, statusNeg | statusOverflow}
+	if code != 0x2a || bytes.Compare(out, expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x and exit code $2a, got % x and %d", expected, out, code))
+	}
+}
+
+// prints A, X, Y, the stack pointer after one push, and the status byte
+// as the reset routine finds them
+const resetStateTestSource = "sta $2008\nstx $2008\nsty $2008\n" +
+	"php\ntsx\nstx $2008\npla\nsta $2008\n" +
+	"lda #$00\nsta $2009\n"
+
+func TestCompileExecutableResetState(t *testing.T) {
+	resetTests := []struct {
+		state    *RegisterState
+		expected []byte
+	}{
+		{nil, []byte{0x00, 0x00, 0x00, 0xfc, statusInt | statusBrk | statusUnused}},
+		{&RegisterState{A: 0x12, X: 0x34, Y: 0x56, SP: 0xff, Status: statusCarry},
+			[]byte{0x12, 0x34, 0x56, 0xfe, statusCarry | statusBrk | statusUnused}},
+	}
+	for _, rt := range resetTests {
+		out, code := runExecutable(t, resetStateTestSource, CompileOptions{ResetState: rt.state})
+		if code != 0 || bytes.Compare(out, rt.expected) != 0 {
+			t.Error(fmt.Sprintf("%+v: expected % x, got % x and exit code %d", rt.state, rt.expected, out, code))
+		}
+	}
+}
+
+// jmp ($02ff) reaches Bugged through the high byte at $0200, or Fixed
+// through the one at $0300
+const jmpIndirectTestSource = "lda #$00\nsta $02ff\nlda #$c1\nsta $0200\nlda #$c2\nsta $0300\n" +
+	"jmp ($02ff)\n" +
+	".org $c100\nBugged:\nlda #$01\nsta $2009\n" +
+	".org $c200\nFixed:\nlda #$02\nsta $2009\n"
+
+func TestCompileExecutableJmpIndirectBug(t *testing.T) {
+	for _, fix := range []bool{false, true} {
+		expected := 1
+		if fix {
+			expected = 2
+		}
+		_, code := runExecutable(t, jmpIndirectTestSource, CompileOptions{FixJmpBug: fix})
+		if code != expected {
+			t.Error(fmt.Sprintf("FixJmpBug %v: expected exit code %d, got %d", fix, expected, code))
+		}
+	}
+}
+
+// prints what zero page and absolute indexed loads find, and what an
+// indexed store crossing a page wrote: $80,x wraps within the zero page,
+// a:$80,x doesn't, and $ffff,x wraps around to $0001
+const absoluteIndexedTestSource = "ldx #$90\nlda #$11\nsta $0010\nlda #$22\nsta $0110\n" +
+	"lda $80, x\nsta $2008\nlda a:$80, x\nsta $2008\n" +
+	"ldx #$02\nldy #$02\nlda #$33\nsta $0001\n" +
+	"lda $ffff, x\nsta $2008\nlda $ffff, y\nsta $2008\n" +
+	"lda #$44\nsta $03ff, x\nlda $0401\nsta $2008\n" +
+	"lda #$00\nsta $2009\n"
+
+func TestCompileExecutableAbsoluteIndexed(t *testing.T) {
+	expected := []byte{0x11, 0x22, 0x33, 0x33, 0x44}
+	for _, opts := range []CompileOptions{{}, {RamSize: MaxRamSize}} {
+		out, code := runExecutable(t, absoluteIndexedTestSource, opts)
+		if code != 0 || bytes.Compare(out, expected) != 0 {
+			t.Error(fmt.Sprintf("RamSize %d: expected % x, got % x and exit code %d", opts.RamSize, expected, out, code))
+		}
+	}
+}
+
+// stores with every mode of sta, stx and sty, then prints what each
+// one wrote
+const storesTestSource = "ldx #$02\nldy #$03\nlda #$00\nsta $20\nlda #$04\nsta $21\n" +
+	"lda #$11\nsta $10\nlda #$12\nsta $10, x\nlda #$13\nsta $0300, x\nlda #$14\nsta $0300, y\n" +
+	"lda #$15\nsta ($1e, x)\nlda #$16\nsta ($20), y\n" +
+	"stx $30, y\nstx $0310\nsty $40, x\nsty $0320\n" +
+	"lda $10\nsta $2008\nlda $12\nsta $2008\nlda $0302\nsta $2008\nlda $0303\nsta $2008\n" +
+	"lda $0400\nsta $2008\nlda $0403\nsta $2008\n" +
+	"lda $33\nsta $2008\nlda $0310\nsta $2008\nlda $42\nsta $2008\nlda $0320\nsta $2008\n" +
+	"lda #$00\nsta $2009\n"
+
+func TestCompileExecutableStores(t *testing.T) {
+	expected := []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x02, 0x02, 0x03, 0x03}
+	out, code := runExecutable(t, storesTestSource, CompileOptions{})
+	if code != 0 || bytes.Compare(out, expected) != 0 {
+		t.Error(fmt.Sprintf("expected % x, got % x and exit code %d", expected, out, code))
+	}
+}
+
+// rom_watch sees the constant, indexed and read-modify-write stores to
+// $0300, and none of the ones beside it
+func TestCompileExecutableWatchpoints(t *testing.T) {
+	program, err := assembleTestProgram("lda #$07\nsta $0300\nldx #$01\nlda #$08\nsta $02ff, x\n" +
+		"inc $0300\nsta $0301\nldx #$02\nsta $02ff, x\n" +
+		"lda #$00\nsta $2009\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := "void rom_watch(uint16_t addr, uint8_t value) {}"
+	if !strings.Contains(stubRuntimeSource, noop) {
+		t.Fatal("expected the stub runtime to define rom_watch")
+	}
+	runtime := strings.Replace(stubRuntimeSource, noop,
+		"void rom_watch(uint16_t addr, uint8_t value) {\n    printf(\"%04x:%02x \", addr, value);\n}", 1)
+	expected := "0300:07 0300:08 0300:09 "
+	for _, ramSize := range []int{0, MaxRamSize} {
+		out := runWithRuntime(t, program, CompileOptions{Watchpoints: []int{0x0300}, RamSize: ramSize}, runtime)
+		if string(out) != expected {
+			t.Error(fmt.Sprintf("RamSize %d: expected %q, got %q", ramSize, expected, out))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package jamulator
+
+// writes assembler listings: each statement alongside its address and
+// the bytes it assembled to
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const listingBytesPerLine = 8
+
+func writeListingLine(w *bufio.Writer, addr int, payload []byte, source string) error {
+	hex := ""
+	for _, b := range payload {
+		hex += fmt.Sprintf("%02x ", b)
+	}
+	line := fmt.Sprintf("%04x: %-*s %s", addr, listingBytesPerLine*3, hex, source)
+	_, err := w.WriteString(strings.TrimRight(line, " ") + "\n")
+	return err
+}
+
+func (p *Program) WriteListing(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	offset := 0
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		var err error
+		switch t := e.Value.(type) {
+		default:
+			return errors.New(fmt.Sprintf("Can't list %T", e.Value))
+		case *Instruction, *DataStatement, *AlignStatement, *ReserveStatement:
+			a := t.(Assembler)
+			err = a.Assemble(p)
+			if err != nil {
+				return err
+			}
+			offset = a.GetOffset()
+			payload := a.GetPayload()
+			source := "    " + t.(Renderer).Render()
+			// long data gets continuation lines without the source
+			for len(payload) > listingBytesPerLine {
+				err = writeListingLine(w, offset, payload[:listingBytesPerLine], source)
+				if err != nil {
+					return err
+				}
+				offset += listingBytesPerLine
+				payload = payload[listingBytesPerLine:]
+				source = ""
+			}
+			err = writeListingLine(w, offset, payload, source)
+			offset += len(payload)
+		case *OrgPseudoOp:
+			offset = t.Value
+			err = writeListingLine(w, offset, nil, t.Render())
+		case *LabelStatement:
+			err = writeListingLine(w, offset, nil, t.Render())
+		case *AssignStatement:
+			err = writeListingLine(w, t.Value, nil, t.Render())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (p *Program) WriteListingFile(filename string) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = p.WriteListing(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package jamulator
+
+// macro definitions and their expansion, which happens after parsing and
+// before anything else looks at the AST
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+)
+
+// how deeply macros may invoke each other before expansion gives up,
+// which is what stops a recursive macro
+const maxMacroDepth = 16
+
+type macroDef struct {
+	Name   string
+	Params []string
+	Body   []interface{}
+	Line   int
+}
+
+type macroExpander struct {
+	macros map[string]*macroDef
+	// ProgramAst.Files, which expansions are added to
+	files map[interface{}]string
+	// numbers each expansion, to make the labels it defines unique
+	expansionCount int
+}
+
+// removes macro definitions from the AST and replaces each invocation
+// with a copy of the macro's body
+func (ast ProgramAst) expandMacros() error {
+	m := &macroExpander{macros: make(map[string]*macroDef), files: ast.Files}
+	for e := ast.List.Front(); e != nil; {
+		next := e.Next()
+		switch t := e.Value.(type) {
+		case *MacroStatement:
+			def := &macroDef{Name: t.Name, Params: t.Params, Line: t.Line}
+			_, exists := m.macros[t.Name]
+			if exists {
+				return errors.New(fmt.Sprintf("Line %d: Macro %s is already defined", t.Line, t.Name))
+			}
+			ast.List.Remove(e)
+			ended := false
+			for next != nil && !ended {
+				be := next
+				next = next.Next()
+				switch bt := be.Value.(type) {
+				case *MacroStatement:
+					return errors.New(fmt.Sprintf("Line %d: Macro %s is defined inside macro %s", bt.Line, bt.Name, t.Name))
+				case *EndMacroStatement:
+					ended = true
+				default:
+					def.Body = append(def.Body, bt)
+				}
+				ast.List.Remove(be)
+			}
+			if !ended {
+				return errors.New(fmt.Sprintf("Line %d: Macro %s has no .endm", t.Line, t.Name))
+			}
+			m.macros[t.Name] = def
+		case *EndMacroStatement:
+			return errors.New(fmt.Sprintf("Line %d: .endm without .macro", t.Line))
+		}
+		e = next
+	}
+
+	for e := ast.List.Front(); e != nil; {
+		next := e.Next()
+		expansion, err := m.expandStatement(e.Value, 0)
+		if err != nil {
+			return err
+		}
+		if expansion != nil {
+			for _, stmt := range expansion {
+				ast.List.InsertBefore(stmt, e)
+			}
+			ast.List.Remove(e)
+		}
+		e = next
+	}
+	return nil
+}
+
+// returns the statements which replace stmt, or nil if it is not a macro
+// invocation
+func (m *macroExpander) expandStatement(stmt interface{}, depth int) ([]interface{}, error) {
+	var name string
+	var args []interface{}
+	var line int
+	switch t := stmt.(type) {
+	case *MacroCall:
+		name = t.Name
+		line = t.Line
+		for e := t.Args.Front(); e != nil; e = e.Next() {
+			args = append(args, e.Value)
+		}
+		_, ok := m.macros[name]
+		if !ok {
+			// most likely a misspelled instruction
+			msg := fmt.Sprintf("Line %d: Undefined macro %s", line, name)
+			suggestion := suggestMnemonic(name)
+			if suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %s?", suggestion)
+			}
+			return nil, errors.New(msg)
+		}
+	case *LabelStatement:
+		_, ok := m.macros[t.LabelName]
+		if !ok {
+			return nil, nil
+		}
+		name = t.LabelName
+		line = t.Line
+	default:
+		return nil, nil
+	}
+
+	def := m.macros[name]
+	if depth >= maxMacroDepth {
+		return nil, errors.New(fmt.Sprintf("Line %d: Macro %s is nested more than %d deep", line, name, maxMacroDepth))
+	}
+	if len(args) != len(def.Params) {
+		return nil, errors.New(fmt.Sprintf("Line %d: Macro %s expects %d arguments, got %d", line, name, len(def.Params), len(args)))
+	}
+
+	m.expansionCount += 1
+	s := &macroSubstitution{
+		args:   make(map[string]interface{}),
+		labels: make(map[string]string),
+	}
+	for i, param := range def.Params {
+		s.args[param] = args[i]
+	}
+	for _, bodyStmt := range def.Body {
+		for _, labelName := range m.definedLabels(bodyStmt) {
+			s.labels[labelName] = fmt.Sprintf("%s__%d", labelName, m.expansionCount)
+		}
+	}
+
+	expansion := []interface{}{}
+	for _, bodyStmt := range def.Body {
+		copied := s.statement(bodyStmt)
+		file, included := m.files[bodyStmt]
+		if included {
+			m.files[copied] = file
+		}
+		nested, err := m.expandStatement(copied, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if nested != nil {
+			expansion = append(expansion, nested...)
+		} else {
+			expansion = append(expansion, copied)
+		}
+	}
+	return expansion, nil
+}
+
+func (m *macroExpander) definedLabels(stmt interface{}) []string {
+	switch t := stmt.(type) {
+	case *LabelStatement:
+		_, isMacro := m.macros[t.LabelName]
+		if isMacro {
+			return nil
+		}
+		return []string{t.LabelName}
+	case *LabeledStatement:
+		return []string{t.Label.LabelName}
+	}
+	return nil
+}
+
+// copies statements from a macro body, replacing parameters with the
+// arguments and renaming the labels the body defines
+type macroSubstitution struct {
+	args   map[string]interface{}
+	labels map[string]string
+}
+
+func (s *macroSubstitution) labelName(name string) string {
+	renamed, ok := s.labels[name]
+	if ok {
+		return renamed
+	}
+	return name
+}
+
+func (s *macroSubstitution) expr(expr interface{}) interface{} {
+	switch t := expr.(type) {
+	case *LabelCall:
+		arg, ok := s.args[t.LabelName]
+		if ok {
+			return arg
+		}
+		return &LabelCall{s.labelName(t.LabelName)}
+	case *SizeofExpr:
+		return &SizeofExpr{s.labelName(t.LabelName)}
+	case *BinaryExpr:
+		return newBinaryExpr(t.Op, s.expr(t.Left), s.expr(t.Right))
+	case *ByteExpr:
+		return newByteExpr(t.High, s.expr(t.Expr))
+	}
+	return expr
+}
+
+func (s *macroSubstitution) instruction(i *Instruction) *Instruction {
+	copied := &Instruction{
+		Type:          i.Type,
+		OpName:        i.OpName,
+		Line:          i.Line,
+		RegisterName:  i.RegisterName,
+		ForceAbsolute: i.ForceAbsolute,
+	}
+	if i.Type == ImpliedInstruction || i.Type == AccumulatorInstruction {
+		return copied
+	}
+	var operand interface{}
+	switch {
+	case i.LabelName != "":
+		operand = &LabelCall{i.LabelName}
+	case i.Expr != nil:
+		operand = i.Expr
+	default:
+		value := IntegerDataItem(i.Value)
+		operand = &value
+	}
+	operand = s.expr(operand)
+
+	switch i.Type {
+	case DirectWithLabelIndexedInstruction, DirectIndexedInstruction:
+		copied.setOperand(operand)
+		copied.Type = DirectWithLabelIndexedInstruction
+		if copied.Expr == nil && copied.LabelName == "" {
+			copied.Type = DirectIndexedInstruction
+		}
+	case DirectWithLabelInstruction, DirectInstruction:
+		copied.setOperand(operand)
+		copied.Type = DirectWithLabelInstruction
+		if copied.Expr == nil && copied.LabelName == "" {
+			copied.Type = DirectInstruction
+		}
+	default:
+		copied.setValueOperand(operand)
+	}
+	return copied
+}
+
+func (s *macroSubstitution) statement(stmt interface{}) interface{} {
+	switch t := stmt.(type) {
+	case *Instruction:
+		return s.instruction(t)
+	case *LabelStatement:
+		return &LabelStatement{s.labelName(t.LabelName), t.Line}
+	case *LabeledStatement:
+		return &LabeledStatement{
+			s.statement(t.Label).(*LabelStatement),
+			s.statement(t.Stmt),
+		}
+	case *DataStatement:
+		copied := &DataStatement{Type: t.Type, dataList: list.New(), Line: t.Line, BigEndian: t.BigEndian}
+		for e := t.dataList.Front(); e != nil; e = e.Next() {
+			copied.dataList.PushBack(s.expr(e.Value))
+		}
+		return copied
+	case *AssignStatement:
+		copied := *t
+		if t.Expr != nil {
+			copied.Expr = s.expr(t.Expr)
+			value, ok := copied.Expr.(*IntegerDataItem)
+			if ok {
+				copied.Value = int(*value)
+				copied.Expr = nil
+			}
+		}
+		return &copied
+	case *OrgPseudoOp:
+		copied := *t
+		return &copied
+	case *AlignStatement:
+		return &AlignStatement{Value: t.Value, Fill: t.Fill, Line: t.Line, DefaultFill: t.DefaultFill}
+	case *ReserveStatement:
+		return &ReserveStatement{Size: t.Size, Fill: t.Fill, Line: t.Line, DefaultFill: t.DefaultFill}
+	case *IfStatement:
+		return &IfStatement{s.expr(t.Cond), t.Line}
+	case *MacroCall:
+		copied := &MacroCall{t.Name, list.New(), t.Line}
+		for e := t.Args.Front(); e != nil; e = e.Next() {
+			copied.Args.PushBack(s.expr(e.Value))
+		}
+		return copied
+	}
+	return stmt
+}
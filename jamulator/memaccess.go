@@ -0,0 +1,108 @@
+package jamulator
+
+// static analysis of which memory each instruction touches
+
+// one instruction's access to memory
+type AccessInfo struct {
+	Line int
+	// address of the instruction
+	Offset int
+	OpName string
+	// the lowest address which may be accessed
+	Address int
+	// how many addresses from Address may be accessed. indexed modes can
+	// reach 256 of them; zero page indexing wraps within the zero page.
+	Length int
+	Read   bool
+	Write  bool
+	// the address is loaded from a pointer in the zero page, which is at
+	// Address. nothing is known about the address accessed.
+	Dynamic bool
+}
+
+// instructions which only write their operand
+var memoryWriters = map[string]bool{
+	"sta": true, "stx": true, "sty": true, "sax": true,
+}
+
+// instructions which read their operand and write the result back
+var memoryModifiers = map[string]bool{
+	"asl": true, "lsr": true, "rol": true, "ror": true,
+	"inc": true, "dec": true, "dcp": true, "isc": true,
+}
+
+// reports the memory which each instruction reads or writes, in program
+// order. jumps, branches and the stack are not counted as accesses. the
+// program must be resolved, so that op codes are known.
+func (p *Program) MemoryAccesses() []AccessInfo {
+	accesses := []AccessInfo{}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			continue
+		}
+		info := opCodeTable[i.OpCode]
+		if info.opName == "jmp" || info.opName == "jsr" {
+			continue
+		}
+		access := AccessInfo{
+			Line:    i.Line,
+			Offset:  i.Offset,
+			OpName:  info.opName,
+			Address: i.Value,
+			Length:  1,
+			Write:   memoryWriters[info.opName] || memoryModifiers[info.opName],
+			Read:    !memoryWriters[info.opName],
+		}
+		switch info.addrMode {
+		case absAddr, zeroPageAddr:
+		case absXAddr, absYAddr, zeroXIndexAddr, zeroYIndexAddr:
+			access.Length = 0x100
+		case xIndexIndirectAddr, indirectYIndexAddr:
+			access.Length = 0
+			access.Dynamic = true
+		default:
+			continue
+		}
+		accesses = append(accesses, access)
+	}
+	return accesses
+}
+
+// a store which may overwrite one of the program's own instructions
+type CodeWrite struct {
+	AccessInfo
+	// the first instruction in reach of the store
+	TargetLine   int
+	TargetOffset int
+}
+
+// finds the stores which may land on an instruction, which is
+// self-modifying code. stores through a pointer are left out, since
+// nothing is known about where they go.
+func (p *Program) CodeWrites() []CodeWrite {
+	code := make(map[int]*Instruction)
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			continue
+		}
+		for addr := i.Offset; addr < i.Offset+len(i.Payload); addr++ {
+			code[addr] = i
+		}
+	}
+	writes := []CodeWrite{}
+	for _, access := range p.MemoryAccesses() {
+		if !access.Write || access.Dynamic {
+			continue
+		}
+		for addr := access.Address; addr < access.Address+access.Length; addr++ {
+			target, ok := code[addr]
+			if ok {
+				writes = append(writes, CodeWrite{access, target.Line, target.Offset})
+				break
+			}
+		}
+	}
+	return writes
+}
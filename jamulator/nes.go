@@ -201,6 +201,9 @@ func AssembleRom(dir string, ioreader io.Reader) (*Rom, error) {
 				return nil, errors.New(fmt.Sprintf("%s: PRG ROM should be 0x4000 bytes; instead it is 0x%x", prgfile, buf.Len()))
 			}
 			r.PrgRom = append(r.PrgRom, buf.Bytes())
+			if program.FillValue != 0 {
+				r.FillValue = program.FillValue
+			}
 		case "chr":
 			chrfile := path.Join(dir, parts[1])
 			chrFd, err := os.Open(chrfile)
@@ -0,0 +1,286 @@
+package jamulator
+
+// peephole optimizations on assembled programs
+
+import (
+	"container/list"
+	"strings"
+)
+
+type peepholeRule struct {
+	// number of consecutive instructions the rule looks at
+	size int
+	// returns the instructions to replace them with, or false if the
+	// rule does not apply
+	rewrite func(instrs []*Instruction) ([]*Instruction, bool)
+	// flags which the replacement leaves differently from the original.
+	// the rule only applies if the code after it overwrites each of them
+	// before reading it.
+	clobbers string
+	// whether the rule assumes adc and sbc are binary, which they are
+	// unless the D flag is honored and could be set
+	binary bool
+}
+
+// the flag each flag instruction sets or clears
+var flagInstrFlag = map[string]string{
+	"clc": "c",
+	"sec": "c",
+	"cli": "i",
+	"sei": "i",
+	"cld": "d",
+	"sed": "d",
+	"clv": "v",
+}
+
+// transfers that undo each other. the second one writes the value the
+// register already has, and sets N and Z from it again.
+var redundantTransfers = map[string]string{
+	"tax": "txa",
+	"txa": "tax",
+	"tay": "tya",
+	"tya": "tay",
+}
+
+// the flags besides N and Z which each instruction reads or writes. php
+// pushes every flag, so it reads them all.
+var flagReads = map[string]string{
+	"adc": "c", "sbc": "c", "rol": "c", "ror": "c", "isc": "c",
+	"bcc": "c", "bcs": "c", "bvc": "v", "bvs": "v",
+	"php": "cvid",
+}
+var flagWrites = map[string]string{
+	"adc": "cv", "sbc": "cv", "isc": "cv",
+	"asl": "c", "lsr": "c", "rol": "c", "ror": "c",
+	"cmp": "c", "cpx": "c", "cpy": "c", "dcp": "c",
+	"clc": "c", "sec": "c", "clv": "v", "bit": "v",
+	"plp": "cvid",
+}
+
+// whether each of flags is overwritten before anything can read it,
+// following the straight line code which starts at e.
+func flagsDeadAt(e *list.Element, flags string) bool {
+	pending := flags
+	for ; e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			// a label could be jumped to from anywhere
+			return false
+		}
+		op := strings.ToLower(i.OpName)
+		if strings.ContainsAny(flagReads[op], pending) {
+			return false
+		}
+		for _, f := range flagWrites[op] {
+			pending = strings.Replace(pending, string(f), "", -1)
+		}
+		if pending == "" {
+			return true
+		}
+		_, isBranch := opNameToOpCode[relativeAddr][op]
+		if isBranch || op == "jmp" || op == "jsr" || op == "rts" || op == "rti" || op == "brk" {
+			// the flags may be read wherever this goes
+			return false
+		}
+	}
+	return false
+}
+
+// the value of an immediate operand, if it is a plain number
+func immediateValue(i *Instruction) (int, bool) {
+	if i.Type != ImmediateInstruction || i.LabelName != "" || i.Expr != nil {
+		return 0, false
+	}
+	return i.Value, true
+}
+
+func opNameIs(i *Instruction, names ...string) bool {
+	lowerOpName := strings.ToLower(i.OpName)
+	for _, name := range names {
+		if lowerOpName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// every rule must leave A, X, Y, SP, memory and the flags as the
+// original code would, except for the free part of the stack page: a
+// push which is pulled straight back is dropped, so its byte at $0100+SP
+// is never written. cycle counts are not preserved.
+var peepholeRules = []peepholeRule{
+	// nop. only the documented one; the undocumented forms with an
+	// operand read it, which $2002 and the like notice.
+	{1, func(instrs []*Instruction) ([]*Instruction, bool) {
+		return nil, instrs[0].OpCode == 0xea
+	}, "", false},
+	// php, plp restores the flags it just saved
+	{2, func(instrs []*Instruction) ([]*Instruction, bool) {
+		return nil, opNameIs(instrs[0], "php") && opNameIs(instrs[1], "plp")
+	}, "", false},
+	// pha, pla only sets N and Z from A
+	{2, func(instrs []*Instruction) ([]*Instruction, bool) {
+		if !opNameIs(instrs[0], "pha") || !opNameIs(instrs[1], "pla") {
+			return nil, false
+		}
+		ora := &Instruction{
+			Type:   ImmediateInstruction,
+			OpName: "ora",
+			Value:  0,
+			Line:   instrs[0].Line,
+		}
+		return []*Instruction{ora}, true
+	}, "", false},
+	// clc, sec: the second flag instruction wins
+	{2, func(instrs []*Instruction) ([]*Instruction, bool) {
+		first, ok := flagInstrFlag[strings.ToLower(instrs[0].OpName)]
+		if !ok {
+			return nil, false
+		}
+		second, ok := flagInstrFlag[strings.ToLower(instrs[1].OpName)]
+		if !ok || first != second {
+			return nil, false
+		}
+		return instrs[1:], true
+	}, "", false},
+	// lda #1, lda $10: the second load overwrites A, N and Z. only
+	// immediate loads are dropped, since reading memory can have side
+	// effects, such as $2002 clearing the vblank flag.
+	{2, func(instrs []*Instruction) ([]*Instruction, bool) {
+		if instrs[0].Type != ImmediateInstruction {
+			return nil, false
+		}
+		op := strings.ToLower(instrs[0].OpName)
+		if op != "lda" && op != "ldx" && op != "ldy" {
+			return nil, false
+		}
+		return instrs[1:], opNameIs(instrs[1], op)
+	}, "", false},
+	// tax, txa
+	{2, func(instrs []*Instruction) ([]*Instruction, bool) {
+		undo, ok := redundantTransfers[strings.ToLower(instrs[0].OpName)]
+		if !ok || !opNameIs(instrs[1], undo) {
+			return nil, false
+		}
+		return instrs[:1], true
+	}, "", false},
+	// lda #$10, clc, adc #$05 leaves a constant in A. the carry and
+	// overflow results are constant too, but lda can't set them.
+	{3, func(instrs []*Instruction) ([]*Instruction, bool) {
+		a, ok := immediateValue(instrs[0])
+		if !ok || !opNameIs(instrs[0], "lda") {
+			return nil, false
+		}
+		b, ok := immediateValue(instrs[2])
+		if !ok {
+			return nil, false
+		}
+		var result int
+		switch {
+		case opNameIs(instrs[1], "clc") && opNameIs(instrs[2], "adc"):
+			result = a + b
+		case opNameIs(instrs[1], "sec") && opNameIs(instrs[2], "sbc"):
+			result = a - b
+		default:
+			return nil, false
+		}
+		lda := &Instruction{
+			Type:   ImmediateInstruction,
+			OpName: instrs[0].OpName,
+			Value:  result & 0xff,
+			Line:   instrs[0].Line,
+		}
+		return []*Instruction{lda}, true
+	}, "cv", true},
+}
+
+// applies the first rule that matches the instructions starting at e.
+// only runs of instructions are considered; a label in between could be
+// jumped to.
+func applyPeepholeRules(l *list.List, e *list.Element, decimal bool) bool {
+	for _, rule := range peepholeRules {
+		if rule.binary && decimal {
+			continue
+		}
+		instrs := make([]*Instruction, 0, rule.size)
+		elems := make([]*list.Element, 0, rule.size)
+		for ie := e; ie != nil && len(instrs) < rule.size; ie = ie.Next() {
+			i, ok := ie.Value.(*Instruction)
+			if !ok {
+				break
+			}
+			instrs = append(instrs, i)
+			elems = append(elems, ie)
+		}
+		if len(instrs) < rule.size {
+			continue
+		}
+		replacement, ok := rule.rewrite(instrs)
+		if !ok {
+			continue
+		}
+		if rule.clobbers != "" && !flagsDeadAt(elems[len(elems)-1].Next(), rule.clobbers) {
+			continue
+		}
+		for _, i := range replacement {
+			l.InsertBefore(i, elems[0])
+		}
+		for _, ie := range elems {
+			l.Remove(ie)
+		}
+		return true
+	}
+	return false
+}
+
+// rewrites common idioms into shorter equivalents and then resolves the
+// program again, since addresses may have moved. not suitable for code
+// which depends on its own timing or addresses, such as disassembled ROMs.
+// decimalMode is CompileOptions.DecimalMode. arithmetic isn't folded with
+// it, or if the program has a sed which could make adc and sbc BCD.
+func (p *Program) Optimize(decimalMode bool) {
+	decimal := decimalMode || p.hasSed()
+	for changed := true; changed; {
+		changed = false
+		for e := p.List.Front(); e != nil; {
+			prev := e.Prev()
+			if applyPeepholeRules(p.List, e, decimal) {
+				changed = true
+				// the replacement may combine with what came before it
+				if prev != nil {
+					e = prev
+				} else {
+					e = p.List.Front()
+				}
+				continue
+			}
+			e = e.Next()
+		}
+	}
+
+	p.resolveAgain()
+}
+
+func (p *Program) hasSed() bool {
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok && opNameIs(i, "sed") {
+			return true
+		}
+	}
+	return false
+}
+
+// recomputes addresses and operands after statements were removed or
+// replaced
+func (p *Program) resolveAgain() {
+	p.Labels = make(map[string]int)
+	p.Offsets = make(map[int]*list.Element)
+	p.Variables = make(map[string]int)
+	p.Errors = nil
+	p.Warnings = nil
+	p.Resolve()
+	if len(p.Errors) == 0 {
+		p.resolveSymbols()
+	}
+}
@@ -11,11 +11,15 @@ import (
 )
 
 func (rom *Rom) RecompileToBinary(filename string, flags CompileFlags) error {
+	return rom.RecompileToBinaryWithOptions(filename, CompileOptions{Flags: flags})
+}
+
+func (rom *Rom) RecompileToBinaryWithOptions(filename string, opts CompileOptions) error {
 	if len(rom.PrgRom) != 1 && len(rom.PrgRom) != 2 {
 		return errors.New("only roms with 1-2 prg rom banks are supported")
 	}
 	fmt.Fprintf(os.Stderr, "Disassembling...\n")
-	program, err := rom.Disassemble()
+	program, err := rom.DisassembleWithOptions(DisassembleOptions{AllowIllegal: opts.AllowIllegal})
 	if err != nil {
 		return err
 	}
@@ -35,15 +39,12 @@ func (rom *Rom) RecompileToBinary(filename string, flags CompileFlags) error {
 	tmpPrgObject := path.Join(tmpDir, "prg.o")
 
 	fmt.Fprintf(os.Stderr, "Decompiling...\n")
-	c, err := program.CompileToFilename(tmpPrgBitcode, flags)
+	result, err := program.Compile(tmpPrgBitcode, opts)
 	if err != nil {
 		return err
 	}
-	if len(c.Errors) != 0 {
-		return errors.New(strings.Join(c.Errors, "\n"))
-	}
-	if len(c.Warnings) != 0 {
-		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(c.Warnings, "\n"))
+	if len(result.Warnings) != 0 {
+		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(result.Warnings, "\n"))
 	}
 	fmt.Fprintf(os.Stderr, "Compiling...\n")
 	out, err := exec.Command("llc", "-o", tmpPrgObject, "-filetype=obj", "-relocation-model=pic", tmpPrgBitcode).CombinedOutput()
@@ -0,0 +1,124 @@
+package jamulator
+
+// relocation tables, so that a linker can move assembled code to a
+// different address
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// a two byte little endian operand which holds the address of Label,
+// plus a constant. to move the code, a linker adds the distance moved to
+// the word at Offset.
+type Relocation struct {
+	// address of the operand, not the instruction
+	Offset int
+	Label  string
+	Line   int
+}
+
+// the label that expr is the address of, allowing for a constant to be
+// added or subtracted. the difference between two labels doesn't move
+// with the code, so it isn't relocatable.
+func (p *Program) relocatableLabel(expr interface{}) (string, bool) {
+	switch t := expr.(type) {
+	case *LabelCall:
+		_, isVariable := p.Variables[t.LabelName]
+		_, isLabel := p.Labels[t.LabelName]
+		return t.LabelName, isLabel && !isVariable
+	case *BinaryExpr:
+		if t.Op != AddOperator && t.Op != SubOperator {
+			return "", false
+		}
+		left, leftOk := p.relocatableLabel(t.Left)
+		right, rightOk := p.relocatableLabel(t.Right)
+		if leftOk && !rightOk && !exprHasLabel(p, t.Right) {
+			return left, true
+		}
+		if rightOk && t.Op == AddOperator && !exprHasLabel(p, t.Left) {
+			return right, true
+		}
+	}
+	return "", false
+}
+
+func exprHasLabel(p *Program, expr interface{}) bool {
+	switch t := expr.(type) {
+	case *LabelCall:
+		_, isLabel := p.Labels[t.LabelName]
+		return isLabel
+	case *BinaryExpr:
+		return exprHasLabel(p, t.Left) || exprHasLabel(p, t.Right)
+	case *ByteExpr:
+		return exprHasLabel(p, t.Expr)
+	}
+	return false
+}
+
+// lists every absolute operand and data word which refers to a label, in
+// address order. branches are relative, so they never need relocating.
+// the program must be resolved, so that offsets are known.
+func (p *Program) Relocations() []Relocation {
+	relocs := []Relocation{}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *Instruction:
+			if len(t.Payload) != 3 {
+				continue
+			}
+			expr := t.Expr
+			if t.LabelName != "" {
+				expr = &LabelCall{t.LabelName}
+			}
+			label, ok := p.relocatableLabel(expr)
+			if ok {
+				relocs = append(relocs, Relocation{t.Offset + 1, label, t.Line})
+			}
+		case *DataStatement:
+			// relocations are patched in little-endian
+			if t.Type != WordDataStmt || t.BigEndian {
+				continue
+			}
+			offset := t.Offset
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				label, ok := p.relocatableLabel(de.Value)
+				if ok {
+					relocs = append(relocs, Relocation{offset, label, t.Line})
+				}
+				offset += 2
+			}
+		}
+	}
+	return relocs
+}
+
+// writes the relocation table as text, one "$offset label" per line
+func (p *Program) WriteRelocations(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	for _, r := range p.Relocations() {
+		_, err := fmt.Fprintf(w, "$%04x %s\n", r.Offset, r.Label)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (p *Program) WriteRelocationsFile(filename string) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = p.WriteRelocations(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
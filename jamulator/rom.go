@@ -2,6 +2,7 @@ package jamulator
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"os"
@@ -52,6 +53,9 @@ type Rom struct {
 	BatteryBacked bool
 	TvSystem      TvSystem
 	SRamPresent   bool
+	// what WriteNes pads PRG ROM with, from the .fillvalue of the
+	// assembled programs
+	FillValue byte
 }
 
 func Load(ioreader io.Reader) (*Rom, error) {
@@ -248,3 +252,46 @@ func (r *Rom) SaveFile(dir string) error {
 	}
 	return nil
 }
+
+// joins banks and splits them again into bankSize pieces, padding with
+// fill as needed. padding goes at the front when padFront is set.
+func rebank(banks [][]byte, bankSize int, padFront bool, fill byte) [][]byte {
+	data := bytes.Join(banks, []byte{})
+	if len(data)%bankSize != 0 {
+		padding := bytes.Repeat([]byte{fill}, bankSize-len(data)%bankSize)
+		if padFront {
+			data = append(padding, data...)
+		} else {
+			data = append(data, padding...)
+		}
+	}
+	result := make([][]byte, 0, len(data)/bankSize)
+	for i := 0; i < len(data); i += bankSize {
+		result = append(result, data[i:i+bankSize])
+	}
+	return result
+}
+
+// saves rom to filename as an iNES file. PRG ROM is padded at the front
+// to a multiple of 16KB, so that a program assembled against the top of
+// the address space keeps its interrupt vectors at the end of the last
+// bank. CHR ROM is padded at the end to a multiple of 8KB.
+func WriteNes(rom *Rom, filename string) error {
+	padded := *rom
+	padded.PrgRom = rebank(rom.PrgRom, 0x4000, true, rom.FillValue)
+	padded.ChrRom = rebank(rom.ChrRom, 0x2000, false, 0)
+
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = padded.Save(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package jamulator
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeNesToBytes(r *Rom) ([]byte, error) {
+	fd, err := ioutil.TempFile("", "jamulator")
+	if err != nil {
+		return nil, err
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+	err = WriteNes(r, fd.Name())
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fd.Name())
+}
+
+func TestWriteNesRoundTrip(t *testing.T) {
+	r := &Rom{
+		PrgRom:      [][]byte{make([]byte, 0x4000), make([]byte, 0x4000)},
+		ChrRom:      [][]byte{make([]byte, 0x2000)},
+		Mapper:      1,
+		Mirroring:   VerticalMirroring,
+		TvSystem:    NtscTv,
+		SRamPresent: true,
+	}
+	for i := range r.PrgRom[1] {
+		r.PrgRom[0][i] = byte(i)
+		r.PrgRom[1][i] = byte(i >> 8)
+	}
+	for i := range r.ChrRom[0] {
+		r.ChrRom[0][i] = byte(i * 3)
+	}
+	original := new(bytes.Buffer)
+	err := r.Save(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := writeNesToBytes(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(rewritten, original.Bytes()) != 0 {
+		t.Error("rewritten rom does not match the original")
+	}
+}
+
+func TestWriteNesPadding(t *testing.T) {
+	// vectors only, as assembled from .org $fffa
+	vectors := []byte{0x00, 0xc0, 0x00, 0xc0, 0x00, 0xc0}
+	r := &Rom{
+		PrgRom: [][]byte{vectors},
+		ChrRom: [][]byte{[]byte{0x01, 0x02}},
+	}
+	out, err := writeNesToBytes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 16+0x4000+0x2000 {
+		t.Fatal(fmt.Sprintf("expected $%x bytes, got $%x", 16+0x4000+0x2000, len(out)))
+	}
+	if out[4] != 1 || out[5] != 1 {
+		t.Error(fmt.Sprintf("expected 1 PRG and 1 CHR bank, got %d and %d", out[4], out[5]))
+	}
+	prg := out[16 : 16+0x4000]
+	if bytes.Compare(prg[0x4000-6:], vectors) != 0 {
+		t.Error(fmt.Sprintf("expected vectors at the end of PRG ROM, got % x", prg[0x4000-6:]))
+	}
+	chr := out[16+0x4000:]
+	if chr[0] != 0x01 || chr[1] != 0x02 || chr[2] != 0 {
+		t.Error(fmt.Sprintf("expected CHR ROM padded at the end, got % x", chr[:4]))
+	}
+
+	r.FillValue = 0xff
+	out, err = writeNesToBytes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[16] != 0xff || out[16+0x4000-7] != 0xff {
+		t.Error(fmt.Sprintf("expected PRG ROM padded with $ff, got % x", out[16:20]))
+	}
+}
+
+func TestCompileUnsupportedMapper(t *testing.T) {
+	// Loop: jmp Loop, then rti for the interrupts
+	bank := make([]byte, 0x4000)
+	copy(bank, []byte{0x4c, 0x00, 0xc0, 0x40})
+	copy(bank[0x3ffa:], []byte{0x03, 0xc0, 0x00, 0xc0, 0x03, 0xc0})
+	for _, mapper := range []byte{0, 2} {
+		r := &Rom{
+			PrgRom: [][]byte{bank},
+			ChrRom: [][]byte{make([]byte, 0x2000)},
+			Mapper: mapper,
+		}
+		buf := new(bytes.Buffer)
+		err := r.Save(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := Load(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Mapper != mapper {
+			t.Fatal(fmt.Sprintf("expected mapper %d, got %d", mapper, loaded.Mapper))
+		}
+		program, err := loaded.Disassemble()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := ioutil.TempFile("", "jamulator")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := program.CompileToFileWithOptions(fd, CompileOptions{})
+		fd.Close()
+		os.Remove(fd.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("mapper %d is not supported", mapper)
+		warned := false
+		for _, warning := range c.Warnings {
+			warned = warned || strings.Contains(warning, expected)
+		}
+		if warned != (mapper != 0) {
+			t.Error(fmt.Sprintf("mapper %d: expected a warning %t, got %q", mapper, mapper != 0, c.Warnings))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package jamulator
+
+// a JSON map from the compiled module back to the assembly source, for
+// debuggers which don't read DWARF
+
+type SourceMap struct {
+	// the assembly file, which the compiler isn't told. left for the
+	// caller to fill in.
+	File   string           `json:"file,omitempty"`
+	Blocks []SourceMapBlock `json:"blocks"`
+}
+
+// the basic block for a label, and the instructions compiled into it up
+// to the next label
+type SourceMapBlock struct {
+	// "" for instructions before the first label
+	Label string `json:"label"`
+	// the LLVM function holding the block: rom_start, or the function a
+	// subroutine was compiled into
+	Function string          `json:"function"`
+	Address  int             `json:"address"`
+	Lines    []SourceMapLine `json:"lines"`
+}
+
+type SourceMapLine struct {
+	Address int `json:"address"`
+	Line    int `json:"line"`
+}
+
+// lists the source line of each instruction, grouped by the label whose
+// block it was compiled into, in program order. labels of data have no
+// block, so their data is left out.
+func (c *Compilation) SourceMap() *SourceMap {
+	m := &SourceMap{Blocks: []SourceMapBlock{}}
+	var block *SourceMapBlock
+	for e := c.program.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement:
+			block = nil
+			if c.labeledData[t.LabelName] {
+				continue
+			}
+			m.Blocks = append(m.Blocks, c.sourceMapBlock(t.LabelName, c.program.Labels[t.LabelName]))
+			block = &m.Blocks[len(m.Blocks)-1]
+		case *Instruction:
+			if block == nil {
+				m.Blocks = append(m.Blocks, c.sourceMapBlock("", t.Offset))
+				block = &m.Blocks[len(m.Blocks)-1]
+			}
+			block.Lines = append(block.Lines, SourceMapLine{t.Offset, t.Line})
+		}
+	}
+	return m
+}
+
+func (c *Compilation) sourceMapBlock(labelName string, addr int) SourceMapBlock {
+	fn := "rom_start"
+	r, ok := c.labelRoutines[labelName]
+	if ok {
+		fn = r.name
+	}
+	return SourceMapBlock{
+		Label:    labelName,
+		Function: fn,
+		Address:  addr,
+		Lines:    []SourceMapLine{},
+	}
+}
@@ -0,0 +1,250 @@
+package jamulator
+
+// assembles statements as they arrive rather than building the whole
+// program first. statements are written out as soon as every symbol
+// they use is defined, so only the ones waiting on a later label are
+// kept in memory.
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type StreamAssembler struct {
+	Labels    map[string]int
+	Variables map[string]int
+	Warnings  []string
+
+	writer       *bufio.Writer
+	conditionals conditionalStack
+	scope        string
+	// the offset of the next statement
+	offset int
+	// statements which have an offset, waiting to be written in order
+	pending *list.List
+
+	// where the writer is up to, as in Program.Assemble
+	expectedOffset int
+	firstOrg       bool
+	orgFillValue   byte
+	// the last .fillvalue, for the statements after it without a fill
+	fill *FillValueStatement
+}
+
+func NewStreamAssembler(w io.Writer) *StreamAssembler {
+	return &StreamAssembler{
+		Labels:    make(map[string]int),
+		Variables: make(map[string]int),
+		writer:    bufio.NewWriter(w),
+		pending:   list.New(),
+		firstOrg:  true,
+	}
+}
+
+func (a *StreamAssembler) getSymbol(name string, offset int) (int, bool) {
+	if name == "." {
+		return offset, true
+	}
+	value, ok := a.Variables[name]
+	if !ok {
+		value, ok = a.Labels[name]
+	}
+	return value, ok
+}
+
+// adds the next statement of the program. variables must be assigned
+// before they are used, but labels may be used before they are defined.
+// macros and includes have to be expanded beforehand.
+func (a *StreamAssembler) Add(stmt interface{}) error {
+	labeled, ok := stmt.(*LabeledStatement)
+	if ok {
+		err := a.Add(labeled.Label)
+		if err != nil {
+			return err
+		}
+		return a.Add(labeled.Stmt)
+	}
+	included, err := a.conditionals.include(stmt, a)
+	if err != nil || !included {
+		return err
+	}
+	a.scope = qualifyStatement(a.scope, stmt)
+
+	switch t := stmt.(type) {
+	case *MacroStatement:
+		return errors.New(fmt.Sprintf("Line %d: Macros can't be defined while streaming", t.Line))
+	case *MacroCall:
+		return errors.New(fmt.Sprintf("Line %d: Macros can't be expanded while streaming", t.Line))
+	case *IncludeStatement:
+		return errors.New(fmt.Sprintf("Line %d: Files can't be included while streaming", t.Line))
+	case *FillValueStatement:
+		a.fill = t
+		return nil
+	case *AssignStatement:
+		value := t.Value
+		if t.Expr != nil {
+			value, err = evalExpr(t.Expr, a, a.offset, t.Line)
+			if err != nil {
+				return err
+			}
+		}
+		_, exists := a.Variables[t.VarName]
+		if exists {
+			warn := fmt.Sprintf("Line %d: Variable %s redefined.", t.Line, t.VarName)
+			a.Warnings = append(a.Warnings, warn)
+		}
+		a.Variables[t.VarName] = value
+		return nil
+	case *OrgPseudoOp:
+		if a.fill != nil && t.DefaultFill {
+			t.Fill = a.fill.Value
+		}
+		a.offset = t.Value
+		a.pending.PushBack(t)
+		return a.flush(false)
+	case *LabelStatement:
+		if a.offset >= 0xffff {
+			return errors.New(fmt.Sprintf("Line %d: Label memory address must fit in 2 bytes.", t.Line))
+		}
+		_, exists := a.Labels[t.LabelName]
+		if exists {
+			return errors.New(fmt.Sprintf("Line %d: Label %s already defined.", t.Line, t.LabelName))
+		}
+		a.Labels[t.LabelName] = a.offset
+		return a.flush(false)
+	case Assembler:
+		if a.offset >= 0xffff {
+			return errors.New(fmt.Sprintf("Line %d: Instruction is at offset $%04x which is greater than 2 bytes.", t.GetLine(), a.offset))
+		}
+		t.SetOffset(a.offset)
+		switch s := t.(type) {
+		case *Instruction:
+			s.substituteVariables(a.Variables)
+		case *DataStatement:
+			s.substituteVariables(a.Variables)
+		case *AlignStatement:
+			if a.fill != nil && s.DefaultFill {
+				s.Fill = a.fill.Value
+			}
+		case *ReserveStatement:
+			if a.fill != nil && s.DefaultFill {
+				s.Fill = a.fill.Value
+			}
+		}
+		err := t.Resolve()
+		if err != nil {
+			return err
+		}
+		a.offset += len(t.GetPayload())
+		a.pending.PushBack(t)
+		return a.flush(false)
+	}
+	return errors.New(fmt.Sprintf("Unexpected statement: %T", stmt))
+}
+
+// whether every symbol the statement uses is defined
+func (a *StreamAssembler) canAssemble(t Assembler) bool {
+	defined := func(expr interface{}) bool {
+		if expr == nil {
+			return true
+		}
+		_, err := evalExpr(expr, a, t.GetOffset(), t.GetLine())
+		return err == nil
+	}
+	switch s := t.(type) {
+	case *Instruction:
+		if s.LabelName != "" && !defined(&LabelCall{s.LabelName}) {
+			return false
+		}
+		return defined(s.Expr)
+	case *DataStatement:
+		for e := s.dataList.Front(); e != nil; e = e.Next() {
+			_, isString := e.Value.(*StringDataItem)
+			if !isString && !defined(e.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writes out pending statements until one uses a symbol which isn't
+// defined yet. if force is set, it writes them all, and undefined
+// symbols are errors.
+func (a *StreamAssembler) flush(force bool) error {
+	for e := a.pending.Front(); e != nil; e = a.pending.Front() {
+		switch t := e.Value.(type) {
+		case *OrgPseudoOp:
+			a.orgFillValue = t.Fill
+			if a.firstOrg {
+				a.firstOrg = false
+				a.expectedOffset = t.Value
+			}
+		case Assembler:
+			if !force && !a.canAssemble(t) {
+				return nil
+			}
+			for t.GetOffset() > a.expectedOffset {
+				// org fill
+				err := a.writer.WriteByte(a.orgFillValue)
+				if err != nil {
+					return err
+				}
+				a.expectedOffset += 1
+			}
+			err := t.Assemble(a)
+			if err != nil {
+				return err
+			}
+			_, err = a.writer.Write(t.GetPayload())
+			if err != nil {
+				return err
+			}
+			a.expectedOffset = t.GetOffset() + len(t.GetPayload())
+		}
+		a.pending.Remove(e)
+	}
+	return nil
+}
+
+// writes out everything that is left. call it after the last statement.
+func (a *StreamAssembler) Close() error {
+	err := a.conditionals.close()
+	if err != nil {
+		return err
+	}
+	err = a.flush(true)
+	if err != nil {
+		return err
+	}
+	return a.writer.Flush()
+}
+
+// assembles source a line at a time, so that the parsed program never
+// has to be held in memory all at once
+func AssembleStream(r io.Reader, w io.Writer) error {
+	parseFilename = ""
+	a := NewStreamAssembler(w)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		programAst, err := parseAt(strings.NewReader(scanner.Text()+"\n"), line)
+		if err != nil {
+			return err
+		}
+		for e := programAst.List.Front(); e != nil; e = e.Next() {
+			err = a.Add(e.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return err
+	}
+	return a.Close()
+}
@@ -0,0 +1,230 @@
+package jamulator
+
+// compiles the routines which are only ever entered by jsr as functions
+// of their own instead of blocks in rom_start, so that LLVM can inline
+// them and optimize them separately
+
+import (
+	"container/list"
+	"github.com/axw/gollvm/llvm"
+)
+
+type subroutine struct {
+	name string
+	// the label of the routine and its last instruction, an rts or jmp
+	first *list.Element
+	last  *list.Element
+	fn    llvm.Value
+	// returns to the caller, which dispatches on the PC unless it is
+	// the return address. rts ends up here, and so does anything the
+	// function can't run itself.
+	exitBlock llvm.BasicBlock
+}
+
+// finds the routines which are the target of a jsr, can't be entered
+// any other way, and run from their label to an rts or jmp without any
+// data in between. a function is declared for each.
+func (c *Compilation) findSubroutines() {
+	c.subroutines = map[string]*subroutine{}
+	c.labelRoutines = map[string]*subroutine{}
+	c.subroutineStarts = map[*list.Element]*subroutine{}
+
+	var stmts []*list.Element
+	labelIndex := map[string]int{}
+	called := map[string]bool{}
+	for e := c.program.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement:
+			labelIndex[t.LabelName] = len(stmts)
+		case *Instruction:
+			if t.OpCode == 0x20 && t.LabelName != "" {
+				called[t.LabelName] = true
+			}
+		}
+		stmts = append(stmts, e)
+	}
+
+	for i := 0; i < len(stmts); i++ {
+		label, ok := stmts[i].Value.(*LabelStatement)
+		if !ok || !called[label.LabelName] || c.labeledData[label.LabelName] {
+			continue
+		}
+		switch label.LabelName {
+		case c.nmiLabelName, c.resetLabelName, c.irqLabelName:
+			continue
+		}
+		if !noFallThrough(stmts, i) {
+			continue
+		}
+		last := subroutineEnd(stmts, labelIndex, i)
+		if last < 0 || !c.onlyEnteredByJsr(stmts, i, last) {
+			continue
+		}
+
+		r := &subroutine{name: label.LabelName, first: stmts[i], last: stmts[last]}
+		stateType := llvm.PointerType(c.cpuStateType, 0)
+		r.fn = llvm.AddFunction(c.mod, label.LabelName, llvm.FunctionType(llvm.VoidType(), []llvm.Type{stateType}, false))
+		r.fn.SetLinkage(llvm.PrivateLinkage)
+		llvm.AddBasicBlock(r.fn, "Entry")
+		r.exitBlock = llvm.AddBasicBlock(r.fn, "Return")
+		c.subroutines[r.name] = r
+		c.subroutineStarts[r.first] = r
+		for j := i; j <= last; j++ {
+			inner, ok := stmts[j].Value.(*LabelStatement)
+			if ok {
+				c.labelRoutines[inner.LabelName] = r
+			}
+		}
+		i = last
+	}
+}
+
+// whether execution can't run into stmts[i] from the statement before
+// it, as a block in rom_start can't branch into a function.
+func noFallThrough(stmts []*list.Element, i int) bool {
+	for j := i - 1; j >= 0; j-- {
+		switch t := stmts[j].Value.(type) {
+		case *OrgPseudoOp:
+			continue
+		case *Instruction:
+			switch t.OpCode {
+			case 0x4c, 0x6c, 0x60, 0x40: // jmp, rts, rti
+				return true
+			}
+			return false
+		case *LabelStatement:
+			// another name for the routine
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+// the index of the rts or jmp which ends the routine labeled by
+// stmts[first], after any forward branches within it. -1 if it runs
+// into anything else first.
+func subroutineEnd(stmts []*list.Element, labelIndex map[string]int, first int) int {
+	furthest := first
+	for j := first + 1; j < len(stmts); j++ {
+		switch t := stmts[j].Value.(type) {
+		case *LabelStatement:
+			continue
+		case *Instruction:
+			switch t.OpCode {
+			case 0x40, 0x00: // rti, brk
+				// these leave through the interrupt blocks in rom_start
+				return -1
+			}
+			target, ok := labelIndex[t.LabelName]
+			if ok && target > furthest {
+				furthest = target
+			}
+			switch t.OpCode {
+			case 0x4c, 0x6c, 0x60: // jmp, rts
+				if furthest < j {
+					return j
+				}
+			}
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// whether the labels in stmts[first:last+1] are used by nothing other
+// than a jsr to the first one, and branches from within
+func (c *Compilation) onlyEnteredByJsr(stmts []*list.Element, first int, last int) bool {
+	entry := stmts[first].Value.(*LabelStatement).LabelName
+	inner := map[string]bool{}
+	innerAddrs := map[int]bool{}
+	for j := first; j <= last; j++ {
+		label, ok := stmts[j].Value.(*LabelStatement)
+		if ok {
+			inner[label.LabelName] = true
+			innerAddrs[c.program.Labels[label.LabelName]] = true
+		}
+	}
+	if inner[c.resetLabelName] {
+		// entered from rom_start, as with OnlyLabels
+		return false
+	}
+
+	for j, e := range stmts {
+		refs := map[string]bool{}
+		switch t := e.Value.(type) {
+		case *Instruction:
+			switch {
+			case t.LabelName == "":
+			case t.OpCode == 0x20 && t.LabelName == entry:
+				// compiled as a call
+			case j >= first && j <= last && t.OpCode != 0x20:
+				// a branch within the function
+			default:
+				refs[t.LabelName] = true
+			}
+			addReferencedLabels(refs, t.Expr)
+			if t.Type == DirectInstruction && opNameIs(t, "jmp", "jsr") && innerAddrs[t.Value] {
+				return false
+			}
+		case *DataStatement:
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				addReferencedLabels(refs, de.Value)
+			}
+		}
+		for name := range refs {
+			if inner[name] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// the block for a label in the function being compiled. labels in
+// other functions can only be reached by returning to rom_start.
+func (c *Compilation) localBlock(labelName string) (llvm.BasicBlock, bool) {
+	bb, ok := c.labeledBlocks[labelName]
+	if !ok || c.labelRoutines[labelName] != c.currentRoutine {
+		return llvm.BasicBlock{}, false
+	}
+	return bb, true
+}
+
+// switches codegen to the function for r. within it, the registers are
+// in the CpuState it is passed, and dynamic jumps and the interpreter
+// return to the caller instead.
+func (c *Compilation) enterSubroutine(r *subroutine) {
+	c.builder.SetInsertPointAtEnd(r.fn.EntryBasicBlock())
+	c.useCpuState(r.fn.Param(0))
+	c.builder.CreateBr(c.labeledBlocks[r.name])
+	c.builder.SetInsertPointAtEnd(r.exitBlock)
+	c.builder.CreateRetVoid()
+
+	c.currentRoutine = r
+	c.currentBlock = nil
+	c.dynJumpBlock = r.exitBlock
+	c.interpretBlock = r.exitBlock
+}
+
+func (c *Compilation) leaveSubroutine() {
+	c.useCpuState(c.cpuState)
+	c.currentRoutine = nil
+	c.currentBlock = nil
+	c.dynJumpBlock = c.mainDynJumpBlock
+	c.interpretBlock = c.mainInterpretBlock
+}
+
+// calls r for a jsr whose rts returns to returnAddr. the rts may have
+// gone somewhere else if the routine adjusted the stack, in which case
+// the PC is dispatched on.
+func (c *Compilation) callSubroutine(r *subroutine, returnAddr int) {
+	c.builder.CreateCall(r.fn, []llvm.Value{c.cpuStatePtr}, "")
+	pc := c.builder.CreateLoad(c.rPC, "")
+	expected := llvm.ConstInt(llvm.Int16Type(), uint64(returnAddr), false)
+	isReturn := c.builder.CreateICmp(llvm.IntEQ, pc, expected, "")
+	returnBlock := c.createBlock("Returned")
+	c.builder.CreateCondBr(isReturn, returnBlock, c.dynJumpBlock)
+	c.selectBlock(returnBlock)
+}
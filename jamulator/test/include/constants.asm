@@ -0,0 +1,2 @@
+PPUCTRL = $2000
+SPRITE_COUNT = 64
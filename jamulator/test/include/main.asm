@@ -0,0 +1,7 @@
+    .include "constants.asm"
+
+    .org $c000
+Reset_Routine:
+    lda #SPRITE_COUNT
+    sta PPUCTRL
+    rts
@@ -2,8 +2,10 @@ package main
 
 import (
 	"./jamulator"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -11,6 +13,7 @@ import (
 
 var (
 	astFlag         bool
+	dumpAstFlag     bool
 	assembleFlag    bool
 	disassembleFlag bool
 	unRomFlag       bool
@@ -21,13 +24,39 @@ var (
 	dumpPreFlag     bool
 	debugFlag       bool
 	recompileFlag   bool
+	nmiCyclesFlag   int
+	decimalFlag     bool
+	ihexFlag        bool
+	listFlag        bool
+	relocFlag       bool
+	jsonFlag        bool
+	peepholeFlag    bool
+	pruneFlag       bool
+	illegalFlag     bool
+	targetFlag      string
+	verifyFlag      bool
+	exeFlag         bool
+	werrorFlag      bool
+	ramFlag         int
+	autoVectorsFlag bool
+	lintBlocksFlag  bool
+	traceFlag       bool
+	sourceMapFlag   bool
+	onlyFlag        string
 )
 
 // TODO: change this to use commands
 func init() {
 	flag.BoolVar(&astFlag, "ast", false, "Print the abstract syntax tree and quit")
+	flag.BoolVar(&dumpAstFlag, "dump-ast", false, "Print the abstract syntax tree with the line, label and operand of each node, and quit")
 	flag.BoolVar(&assembleFlag, "asm", false, "Assemble into 6502 machine code")
 	flag.BoolVar(&disassembleFlag, "dis", false, "Disassemble 6502 machine code")
+	flag.BoolVar(&ihexFlag, "ihex", false, "With -asm, write Intel HEX instead of a raw binary")
+	flag.BoolVar(&listFlag, "list", false, "With -asm, also write a listing of addresses and bytes next to the source")
+	flag.BoolVar(&relocFlag, "reloc", false, "With -asm, also write a table of the operands which refer to labels, for relocating the code")
+	flag.BoolVar(&jsonFlag, "json", false, "With -asm, also write a JSON description of the instructions, data and symbols")
+	flag.BoolVar(&peepholeFlag, "peephole", false, "With -asm or -c, simplify common instruction sequences in the source")
+	flag.BoolVar(&pruneFlag, "prune", false, "With -asm or -c, remove unreachable code and unused labels")
 	flag.BoolVar(&romFlag, "rom", false, "Assemble a jam package into an NES ROM")
 	flag.BoolVar(&unRomFlag, "unrom", false, "Disassemble an NES ROM into a jam package")
 	flag.BoolVar(&compileFlag, "c", false, "Compile into a native executable")
@@ -35,7 +64,20 @@ func init() {
 	flag.BoolVar(&dumpFlag, "d", false, "Dump LLVM IR code for generated code")
 	flag.BoolVar(&dumpPreFlag, "dd", false, "Dump LLVM IR code for generated code before verifying module")
 	flag.BoolVar(&debugFlag, "g", false, "Include debug print statements in generated code")
+	flag.BoolVar(&traceFlag, "trace", false, "With -c or -recompile, log the address and op code of each instruction as it runs")
+	flag.BoolVar(&sourceMapFlag, "sourcemap", false, "With -c, also write a JSON map from the generated blocks to the source lines")
+	flag.StringVar(&onlyFlag, "only", "", "With -c, compile only the code reachable from these comma separated labels, starting at the first")
+	flag.BoolVar(&lintBlocksFlag, "lint-blocks", false, "Warn about labels whose generated blocks nothing branches to")
 	flag.BoolVar(&recompileFlag, "recompile", false, "Recompile an NES ROM into a native binary")
+	flag.BoolVar(&decimalFlag, "decimal", false, "Honor the decimal flag in adc and sbc, which the NES ignores")
+	flag.BoolVar(&illegalFlag, "illegal", false, "With -c or -recompile, accept the stable undocumented op codes such as lax")
+	flag.BoolVar(&verifyFlag, "verify", false, "With -c, only compile and verify the module, without writing a file")
+	flag.BoolVar(&exeFlag, "exe", false, "With -c, link an executable which supports only putchar and exit, for running test programs")
+	flag.BoolVar(&werrorFlag, "Werror", false, "With -c or -recompile, fail on warnings")
+	flag.StringVar(&targetFlag, "target", "", "With -c, write an object file for this target triple instead of bitcode")
+	flag.BoolVar(&autoVectorsFlag, "autovectors", false, "With -c, start at the first label when there is no reset vector, and ignore a missing NMI or IRQ vector")
+	flag.IntVar(&ramFlag, "ram", 0, "With -c, use this many bytes of flat RAM instead of the NES memory map, for programs which don't run on an NES")
+	flag.IntVar(&nmiCyclesFlag, "nmi", 0, "Call the NMI routine every N cpu cycles instead of when the runtime requests it")
 }
 
 func usageAndQuit() {
@@ -48,38 +90,82 @@ func removeExtension(filename string) string {
 	return filename[0 : len(filename)-len(path.Ext(filename))]
 }
 
-func compileFlags() (flags jamulator.CompileFlags) {
+func compileOptions() (opts jamulator.CompileOptions) {
 	if disableOptFlag {
-		flags |= jamulator.DisableOptFlag
+		opts.Flags |= jamulator.DisableOptFlag
 	}
 	if dumpFlag {
-		flags |= jamulator.DumpModuleFlag
+		opts.Flags |= jamulator.DumpModuleFlag
 	}
 	if dumpPreFlag {
-		flags |= jamulator.DumpModulePreFlag
+		opts.Flags |= jamulator.DumpModulePreFlag
 	}
 	if debugFlag {
-		flags |= jamulator.IncludeDebugFlag
+		opts.Flags |= jamulator.IncludeDebugFlag
 	}
+	if lintBlocksFlag {
+		opts.Flags |= jamulator.LintBlocksFlag
+	}
+	opts.NmiCycles = nmiCyclesFlag
+	opts.DecimalMode = decimalFlag
+	opts.AllowIllegal = illegalFlag
+	opts.WarningsAsErrors = werrorFlag
+	opts.RamSize = ramFlag
+	opts.AutoVectors = autoVectorsFlag
+	opts.Trace = traceFlag
+	opts.SourceMap = sourceMapFlag
+	if onlyFlag != "" {
+		opts.OnlyLabels = strings.Split(onlyFlag, ",")
+	}
+	opts.TargetTriple = targetFlag
 	return
 }
 
 func compile(filename string, program *jamulator.Program) {
 	outfile := removeExtension(filename) + ".bc"
+	if targetFlag != "" {
+		outfile = removeExtension(filename) + ".o"
+	}
+	if exeFlag {
+		outfile = removeExtension(filename)
+	}
 	if flag.NArg() == 2 {
 		outfile = flag.Arg(1)
 	}
-	fmt.Fprintf(os.Stderr, "Compiling to %s\n", outfile)
-	c, err := program.CompileToFilename(outfile, compileFlags())
+	var result *jamulator.CompileResult
+	var err error
+	if verifyFlag {
+		fmt.Fprintf(os.Stderr, "Verifying %s\n", filename)
+		result, err = program.Verify(compileOptions())
+	} else if exeFlag {
+		fmt.Fprintf(os.Stderr, "Linking %s\n", outfile)
+		result, err = program.CompileExecutable(outfile, compileOptions())
+	} else {
+		fmt.Fprintf(os.Stderr, "Compiling to %s\n", outfile)
+		result, err = program.Compile(outfile, compileOptions())
+	}
+	if _, ok := err.(jamulator.CompileErrors); ok {
+		fmt.Fprintf(os.Stderr, "Errors:\n%s\n", err.Error())
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
-	if len(c.Errors) != 0 {
-		fmt.Fprintf(os.Stderr, "Errors:\n%s\n", strings.Join(c.Errors, "\n"))
-		os.Exit(1)
+	if len(result.Warnings) != 0 {
+		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(result.Warnings, "\n"))
 	}
-	if len(c.Warnings) != 0 {
-		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(c.Warnings, "\n"))
+	if result.SourceMap != nil {
+		mapfile := removeExtension(outfile) + ".map.json"
+		fmt.Fprintf(os.Stderr, "Writing source map to %s\n", mapfile)
+		result.SourceMap.File = filename
+		out, err := json.MarshalIndent(result.SourceMap, "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(mapfile, out, 0644)
+		if err != nil {
+			panic(err)
+		}
 	}
 }
 
@@ -89,7 +175,7 @@ func main() {
 		usageAndQuit()
 	}
 	filename := flag.Arg(0)
-	if astFlag || assembleFlag {
+	if astFlag || dumpAstFlag || assembleFlag {
 		fmt.Fprintf(os.Stderr, "Parsing %s\n", filename)
 		programAst, err := jamulator.ParseFile(filename)
 		if err != nil {
@@ -99,11 +185,28 @@ func main() {
 		if astFlag {
 			programAst.Print()
 		}
+		if dumpAstFlag {
+			err = programAst.Dump(os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		}
 		if !assembleFlag && !compileFlag {
 			return
 		}
 		fmt.Fprintf(os.Stderr, "Assembling %s\n", filename)
 		program := programAst.ToProgram()
+		if peepholeFlag && len(program.Errors) == 0 {
+			program.Optimize(decimalFlag)
+		}
+		if pruneFlag && len(program.Errors) == 0 {
+			removed := program.EliminateDeadCode()
+			fmt.Fprintf(os.Stderr, "Removed %d bytes of unreachable code\n", removed)
+		}
+		for _, warn := range program.Warnings {
+			fmt.Fprintln(os.Stderr, warn)
+		}
 		if len(program.Errors) > 0 {
 			for _, err := range program.Errors {
 				fmt.Fprintln(os.Stderr, err)
@@ -115,15 +218,51 @@ func main() {
 			return
 		}
 		if assembleFlag {
-			outfile := removeExtension(filename) + ".bin"
+			ext := ".bin"
+			if ihexFlag {
+				ext = ".hex"
+			}
+			outfile := removeExtension(filename) + ext
 			if flag.NArg() == 2 {
 				outfile = flag.Arg(1)
 			}
 			fmt.Fprintf(os.Stderr, "Writing to %s\n", outfile)
-			err = program.AssembleToFile(outfile)
+			if ihexFlag {
+				err = program.WriteIhexFile(outfile)
+			} else {
+				err = program.AssembleToFile(outfile)
+			}
 			if err != nil {
 				panic(err)
 			}
+			if listFlag {
+				listfile := removeExtension(outfile) + ".lst"
+				fmt.Fprintf(os.Stderr, "Writing listing to %s\n", listfile)
+				err = program.WriteListingFile(listfile)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if relocFlag {
+				relocfile := removeExtension(outfile) + ".reloc"
+				fmt.Fprintf(os.Stderr, "Writing relocation table to %s\n", relocfile)
+				err = program.WriteRelocationsFile(relocfile)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if jsonFlag {
+				jsonfile := removeExtension(outfile) + ".json"
+				fmt.Fprintf(os.Stderr, "Writing JSON description to %s\n", jsonfile)
+				out, err := json.MarshalIndent(program, "", "\t")
+				if err != nil {
+					panic(err)
+				}
+				err = ioutil.WriteFile(jsonfile, out, 0644)
+				if err != nil {
+					panic(err)
+				}
+			}
 		}
 		return
 	} else if unRomFlag || recompileFlag {
@@ -151,7 +290,7 @@ func main() {
 		if flag.NArg() == 2 {
 			outfile = flag.Arg(1)
 		}
-		err = rom.RecompileToBinary(outfile, compileFlags())
+		err = rom.RecompileToBinaryWithOptions(outfile, compileOptions())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
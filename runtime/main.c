@@ -357,3 +357,23 @@ void rom_apu_write_dmcsampleaddress(uint8_t b){}
 void rom_apu_write_dmcsamplelength(uint8_t b){}
 void rom_apu_write_controlflags1(uint8_t b){}
 void rom_apu_write_controlflags2(uint8_t b){}
+
+// only mapper 0 is supported, which has no bank switching
+// the runtime requests NMIs itself on vblank, so roms compiled with
+// an NMI cadence have nothing extra to do here
+void rom_frame() {}
+
+void rom_bankswitch(uint16_t addr, uint8_t b){}
+
+void rom_watch(uint16_t addr, uint8_t value) {
+    fprintf(stderr, "watch: $%02x stored in $%04x\n", value, addr);
+}
+
+void rom_trace(uint16_t pc, uint8_t opcode) {
+    fprintf(stderr, "%04X  %02X\n", pc, opcode);
+}
+
+void rom_illegal_opcode(uint16_t pc, uint8_t opcode) {
+    fprintf(stderr, "illegal op code $%02x at $%04x\n", opcode, pc);
+    exit(1);
+}
@@ -47,6 +47,10 @@ void rom_start(uint8_t interrupt);
 // cpu cycles that have passed.
 void rom_cycle(uint8_t);
 
+// only called when the rom is compiled with an NMI cadence.
+// called once per frame, right before the NMI routine runs.
+void rom_frame();
+
 // PPU hooks
 uint8_t rom_ppu_read_status();
 uint8_t rom_ppu_read_oamdata();
@@ -83,8 +87,31 @@ void rom_apu_write_dmcsamplelength(uint8_t);
 void rom_apu_write_controlflags1(uint8_t);
 void rom_apu_write_controlflags2(uint8_t);
 
+// mapper hook. called when the program writes to PRG ROM
+// space, which is how mappers are told to switch banks.
+void rom_bankswitch(uint16_t addr, uint8_t value);
+
+// only called when the rom is compiled with watchpoints.
+// called right before the program stores value to one of them.
+void rom_watch(uint16_t addr, uint8_t value);
+
+// only called when the rom is compiled with tracing, right before
+// each instruction runs.
+void rom_trace(uint16_t pc, uint8_t opcode);
+
+// called when the program runs into an op code which the generated
+// code can't interpret. if this returns, the program carries on with
+// the next byte.
+void rom_illegal_opcode(uint16_t pc, uint8_t opcode);
+
 // controller
 void rom_set_button_state(uint8_t padIndex, uint8_t buttonIndex, uint8_t value);
 
 // RAM
 uint8_t rom_ram_read(uint16_t addr);
+// the 2KB of work RAM, starting with the zero page, which the compiled
+// program defines. addresses up to $1fff mirror it.
+extern uint8_t rom_wram[0x800];
+// number of indexed reads which crossed a page boundary so far. only
+// defined when the program is compiled with page crossing counting.
+extern uint32_t rom_page_crossings;